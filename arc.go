@@ -0,0 +1,393 @@
+package smtpServerProtocol
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArcStatus represents ARC chain validation status (rfc8617 section 4.4).
+type ArcStatus string
+
+const (
+	ArcNone = ArcStatus("none")
+	ArcPass = ArcStatus("pass")
+	ArcFail = ArcStatus("fail")
+	// ArcTempError means chain could not be validated because of temporary error, for example DNS failure.
+	ArcTempError = ArcStatus("temperror")
+)
+
+// List of header fields what form ARC set.
+const (
+	ArcAuthenticationResults = "ARC-Authentication-Results"
+	ArcMessageSignature      = "ARC-Message-Signature"
+	ArcSeal                  = "ARC-Seal"
+)
+
+// arcMaximumInstances is highest allowed instance number (rfc8617 section 4.2.1).
+const arcMaximumInstances = 50
+
+// arcSignedHeaders is default list of header fields signed by ARC-Message-Signature.
+var arcSignedHeaders = []string{"from", "to", "cc", "subject", "date", "message-id", "reply-to",
+	"in-reply-to", "references", "mime-version", "content-type", "content-transfer-encoding", "dkim-signature"}
+
+// ArcResult is result of validation of ARC sets of message.
+type ArcResult struct {
+	Status ArcStatus
+	// Instance is number of last ARC set, 0 when message has no ARC sets.
+	Instance int
+	// Reason describes why validation failed.
+	Reason string
+}
+
+// ArcSealer contains key used to add own ARC set to message.
+type ArcSealer struct {
+	Domain   string
+	Selector string
+	// Key is *rsa.PrivateKey or ed25519.PrivateKey, public key should be published
+	// in "<selector>._domainkey.<domain>" TXT record.
+	Key crypto.Signer
+	// Headers overrides list of header fields signed by ARC-Message-Signature.
+	Headers []string
+}
+
+// arcSet is group of ARC header fields with same instance number.
+type arcSet struct {
+	results   *headerField
+	signature *headerField
+	seal      *headerField
+}
+
+// VerifyArc validates chain of ARC sets of message (rfc8617 section 5.2).
+func VerifyArc(resolver Resolver, origin string) ArcResult {
+	headers, body := splitMessage(origin)
+
+	sets, err := collectArcSets(headers)
+	if err != nil {
+		return ArcResult{Status: ArcFail, Reason: err.Error()}
+	}
+	if len(sets) == 0 {
+		return ArcResult{Status: ArcNone}
+	}
+
+	ctx, cancel := lookupContext()
+	defer cancel()
+
+	result := ArcResult{Status: ArcPass, Instance: len(sets)}
+	if err = verifyArcChain(ctx, resolver, sets, headers, body); err != nil {
+		result.Status = ArcFail
+		result.Reason = err.Error()
+
+		var verificationError *dkimError
+		if errors.As(err, &verificationError) {
+			result.Reason = verificationError.message
+			if verificationError.status == DkimTempError {
+				result.Status = ArcTempError
+			}
+		}
+	}
+
+	return result
+}
+
+// collectArcSets groups ARC header fields by instance, each instance from 1 to highest one should be complete.
+func collectArcSets(headers []headerField) ([]*arcSet, error) {
+	instances := map[int]*arcSet{}
+	highest := 0
+
+	for i := range headers {
+		field := &headers[i]
+		name := field.fieldName()
+		if !strings.EqualFold(name, ArcAuthenticationResults) &&
+			!strings.EqualFold(name, ArcMessageSignature) &&
+			!strings.EqualFold(name, ArcSeal) {
+			continue
+		}
+
+		instance, err := arcInstance(field)
+		if err != nil {
+			return nil, err
+		}
+		if instances[instance] == nil {
+			instances[instance] = &arcSet{}
+		}
+		if instance > highest {
+			highest = instance
+		}
+
+		set := instances[instance]
+		target := &set.seal
+		if strings.EqualFold(name, ArcAuthenticationResults) {
+			target = &set.results
+		} else if strings.EqualFold(name, ArcMessageSignature) {
+			target = &set.signature
+		}
+		if *target != nil {
+			return nil, fmt.Errorf("duplicate %s header for instance %d", name, instance)
+		}
+		*target = field
+	}
+
+	sets := make([]*arcSet, highest)
+	for instance := 1; instance <= highest; instance++ {
+		set := instances[instance]
+		if set == nil || set.results == nil || set.signature == nil || set.seal == nil {
+			return nil, fmt.Errorf("incomplete ARC set %d", instance)
+		}
+		sets[instance-1] = set
+	}
+
+	return sets, nil
+}
+
+// arcInstance returns value of i= tag, in ARC-Authentication-Results it is always first.
+func arcInstance(field *headerField) (int, error) {
+	segments := strings.Split(field.value, ";")
+	if strings.EqualFold(field.fieldName(), ArcAuthenticationResults) {
+		segments = segments[:1]
+	}
+
+	for _, segment := range segments {
+		index := strings.Index(segment, "=")
+		if index > 0 && strings.TrimSpace(segment[:index]) == "i" {
+			instance, err := strconv.Atoi(strings.TrimSpace(segment[index+1:]))
+			if err == nil && instance > 0 && instance <= arcMaximumInstances {
+				return instance, nil
+			}
+			break
+		}
+	}
+
+	return 0, fmt.Errorf("invalid instance in %s header", field.fieldName())
+}
+
+func verifyArcChain(ctx context.Context, resolver Resolver, sets []*arcSet, headers []headerField, body string) error {
+	seals := make([]*dkimSignature, len(sets))
+	for i, set := range sets {
+		tags, err := parseDkimTags(set.seal.value)
+		if err != nil {
+			return fmt.Errorf("malformed %s %d", ArcSeal, i+1)
+		}
+
+		// First set has nothing to validate, each next one must confirm what chain was valid.
+		expected := ArcPass
+		if i == 0 {
+			expected = ArcNone
+		}
+		if !strings.EqualFold(tags["cv"], string(expected)) {
+			return fmt.Errorf("%s %d has cv=%s", ArcSeal, i+1, tags["cv"])
+		}
+
+		if seals[i], err = createDkimSignature(tags, []string{"a", "b", "d", "s"}); err != nil {
+			return err
+		}
+		seals[i].headerCanonicalization = DkimRelaxed
+		seals[i].identity = "@" + seals[i].domain
+	}
+
+	// Only most recent message signature is validated, older ones could be broken by intermediaries.
+	messageSignature := sets[len(sets)-1].signature
+	tags, err := parseDkimTags(messageSignature.value)
+	if err != nil {
+		return fmt.Errorf("malformed %s %d", ArcMessageSignature, len(sets))
+	}
+	signature, err := createDkimSignature(tags, []string{"a", "b", "bh", "d", "h", "s"})
+	if err != nil {
+		return err
+	}
+	signature.identity = "@" + signature.domain
+
+	key, err := lookupDkimKey(ctx, resolver, signature)
+	if err == nil {
+		err = signature.verifyBody(body)
+	}
+	if err == nil {
+		err = signature.verifyHeaders(key, headers, *messageSignature)
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := len(sets) - 1; i >= 0; i-- {
+		key, err := lookupDkimKey(ctx, resolver, seals[i])
+		if err == nil {
+			err = seals[i].verifyDigest(key, arcSealHash(sets[:i+1]).Sum(nil))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// arcSealHash hashes ARC sets in instance order, seal of last set is hashed with empty b= tag (rfc8617 section 5.1.1).
+func arcSealHash(sets []*arcSet) hash.Hash {
+	sealHash := sha256.New()
+	for i, set := range sets {
+		sealHash.Write([]byte(canonicalizeHeader(*set.results, DkimRelaxed)))
+		sealHash.Write([]byte(canonicalizeHeader(*set.signature, DkimRelaxed)))
+		if i < len(sets)-1 {
+			sealHash.Write([]byte(canonicalizeHeader(*set.seal, DkimRelaxed)))
+			continue
+		}
+
+		unsigned := headerField{name: set.seal.name, value: removeDkimSignatureValue(set.seal.value)}
+		sealHash.Write([]byte(strings.TrimSuffix(canonicalizeHeader(unsigned, DkimRelaxed), CommandEndSymbol)))
+	}
+
+	return sealHash
+}
+
+// seal creates new ARC set for message, chain is result of validation of existing sets.
+func (sealer *ArcSealer) seal(origin string, chain ArcResult, authServId string, results []string, now time.Time) ([]headerField, error) {
+	algorithm, signerHash, err := dkimSigningAlgorithm(sealer.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, body := splitMessage(origin)
+	sets, err := collectArcSets(headers)
+	if err != nil {
+		return nil, err
+	}
+	instance := len(sets) + 1
+	if instance > arcMaximumInstances {
+		return nil, errors.New("too many ARC sets")
+	}
+
+	resultsValue := fmt.Sprintf(" i=%d; %s; none", instance, authServId)
+	if len(results) > 0 {
+		resultsValue = fmt.Sprintf(" i=%d; %s;%s\t%s", instance, authServId, CommandEndSymbol,
+			strings.Join(results, ";"+CommandEndSymbol+"\t"))
+	}
+	authenticationResults := headerField{name: ArcAuthenticationResults, value: resultsValue}
+
+	signedHeaders := sealer.Headers
+	if len(signedHeaders) == 0 {
+		for _, name := range arcSignedHeaders {
+			for _, field := range headers {
+				if strings.EqualFold(field.fieldName(), name) {
+					signedHeaders = append(signedHeaders, name)
+					break
+				}
+			}
+		}
+	}
+
+	bodyHash := sha256.Sum256([]byte(canonicalizeBody(body, DkimRelaxed)))
+	messageSignature := headerField{
+		name: ArcMessageSignature,
+		value: fmt.Sprintf(" i=%d; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d;%s\th=%s;%s\tbh=%s;%s\tb=",
+			instance, algorithm, sealer.Domain, sealer.Selector, now.Unix(), CommandEndSymbol,
+			strings.Join(signedHeaders, ":"), CommandEndSymbol, base64.StdEncoding.EncodeToString(bodyHash[:]), CommandEndSymbol),
+	}
+	unsigned := &dkimSignature{headerCanonicalization: DkimRelaxed, headers: signedHeaders}
+	signature, err := sealer.Key.Sign(rand.Reader, unsigned.headersHash(headers, messageSignature).Sum(nil), signerHash)
+	if err != nil {
+		return nil, err
+	}
+	messageSignature.value += base64.StdEncoding.EncodeToString(signature)
+
+	seal := headerField{
+		name: ArcSeal,
+		value: fmt.Sprintf(" i=%d; a=%s; t=%d; cv=%s;%s\td=%s; s=%s;%s\tb=",
+			instance, algorithm, now.Unix(), chain.Status, CommandEndSymbol, sealer.Domain, sealer.Selector, CommandEndSymbol),
+	}
+	sets = append(sets, &arcSet{results: &authenticationResults, signature: &messageSignature, seal: &seal})
+	signature, err = sealer.Key.Sign(rand.Reader, arcSealHash(sets).Sum(nil), signerHash)
+	if err != nil {
+		return nil, err
+	}
+	seal.value += base64.StdEncoding.EncodeToString(signature)
+
+	return []headerField{seal, messageSignature, authenticationResults}, nil
+}
+
+// dkimSigningAlgorithm returns algorithm name and hash option for signing key.
+func dkimSigningAlgorithm(key crypto.Signer) (string, crypto.Hash, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return DkimRsaSha256, crypto.SHA256, nil
+	case ed25519.PrivateKey:
+		// Ed25519 signs already hashed data, so no hash option passed to signer.
+		return DkimEd25519Sha256, crypto.Hash(0), nil
+	}
+
+	return "", 0, errors.New("unsupported signing key")
+}
+
+// ArcPolicy validates ARC sets of received message, result stored in Session.ArcResult
+// and added to Authentication-Results header. Sealer, when configured, adds own ARC set, so
+// policy should be added after other authentication policies, as their results are sealed too.
+type ArcPolicy struct {
+	Resolver Resolver
+	// Sealer adds own ARC set to message, nil when message only validated.
+	Sealer *ArcSealer
+}
+
+// CreateArcPolicy creates policy what uses DefaultResolver, sealer can be nil.
+func CreateArcPolicy(sealer *ArcSealer) *ArcPolicy {
+	return &ArcPolicy{
+		Resolver: DefaultResolver,
+		Sealer:   sealer,
+	}
+}
+
+func (policy *ArcPolicy) CheckData(protocol *Protocol, origin string) *Reply {
+	result := VerifyArc(policy.Resolver, origin)
+	protocol.Session().ArcResult = result
+	protocol.AddAuthenticationResult(result.authenticationResult())
+
+	if policy.Sealer == nil {
+		return nil
+	}
+	// Temporary failure should not be sealed as permanent one, failed chain is not extended (rfc8617 section 5.1.2).
+	if result.Status == ArcTempError || isArcChainSealedFailed(origin) {
+		logManager().Debug(fmt.Sprintf("ARC set not added, chain status %s", result.Status))
+		return nil
+	}
+
+	fields, err := policy.Sealer.seal(origin, result, protocol.authServId(), protocol.authenticationResults, protocol.now())
+	if err != nil {
+		logManager().Error(fmt.Sprintf("Unable to add ARC set: %s", err.Error()))
+		return nil
+	}
+	for _, field := range fields {
+		protocol.AddHeader(field.name, strings.TrimPrefix(field.value, " "))
+	}
+
+	return nil
+}
+
+// isArcChainSealedFailed checks if most recent ARC-Seal of message has cv=fail.
+func isArcChainSealedFailed(origin string) bool {
+	headers, _ := splitMessage(origin)
+	sets, err := collectArcSets(headers)
+	if err != nil || len(sets) == 0 {
+		return false
+	}
+
+	tags, err := parseDkimTags(sets[len(sets)-1].seal.value)
+	return err == nil && strings.EqualFold(tags["cv"], string(ArcFail))
+}
+
+// authenticationResult formats result as "resinfo" of Authentication-Results header.
+func (result ArcResult) authenticationResult() string {
+	resinfo := "arc=" + string(result.Status)
+	if len(result.Reason) > 0 {
+		resinfo += fmt.Sprintf(" reason=%q", result.Reason)
+	}
+
+	return resinfo
+}
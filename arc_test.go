@@ -0,0 +1,191 @@
+package smtpServerProtocol
+
+import (
+	"github.com/mailhedgehog/gounit"
+	"net"
+	"strings"
+	"testing"
+)
+
+// sealTestMessage adds ARC set to origin same way as ArcPolicy does.
+func sealTestMessage(t *testing.T, resolver Resolver, origin string, sealer *ArcSealer) string {
+	fields, err := sealer.seal(origin, VerifyArc(resolver, origin), "mx.example.com", []string{"spf=pass smtp.mailfrom=example.org"}, fixedClock())
+	(*gounit.T)(t).AssertNotError(err)
+
+	block := ""
+	for _, field := range fields {
+		block += field.name + ":" + field.value + "\r\n"
+	}
+
+	return block + origin
+}
+
+func TestVerifyArc(t *testing.T) {
+	resolver := createDkimResolver()
+	rsaSealer := &ArcSealer{Domain: "example.org", Selector: "rsa", Key: testDkimRsaKey}
+	edSealer := &ArcSealer{Domain: "example.org", Selector: "ed", Key: testDkimEd25519Key}
+
+	result := VerifyArc(resolver, testDkimOrigin)
+	(*gounit.T)(t).AssertEqualsString(string(ArcNone), string(result.Status))
+	(*gounit.T)(t).AssertEqualsInt(0, result.Instance)
+
+	sealed := sealTestMessage(t, resolver, testDkimOrigin, rsaSealer)
+	(*gounit.T)(t).AssertTrue(strings.HasPrefix(sealed, "ARC-Seal: i=1; a=rsa-sha256; t=1704207845; cv=none;\r\n\td=example.org; s=rsa;\r\n\tb="))
+	(*gounit.T)(t).AssertTrue(strings.Contains(sealed, "ARC-Authentication-Results: i=1; mx.example.com;\r\n\tspf=pass smtp.mailfrom=example.org\r\n"))
+	(*gounit.T)(t).AssertTrue(strings.Contains(sealed, "\th=from:to:subject;\r\n"))
+
+	result = VerifyArc(resolver, sealed)
+	(*gounit.T)(t).AssertEqualsString(string(ArcPass), string(result.Status))
+	(*gounit.T)(t).AssertEqualsInt(1, result.Instance)
+
+	// Next hop changes not signed header and adds own set.
+	sealed = sealTestMessage(t, resolver, "Received: from mx.example.com\r\n"+sealed, edSealer)
+	(*gounit.T)(t).AssertTrue(strings.HasPrefix(sealed, "ARC-Seal: i=2; a=ed25519-sha256; t=1704207845; cv=pass;"))
+
+	result = VerifyArc(resolver, sealed)
+	(*gounit.T)(t).AssertEqualsString(string(ArcPass), string(result.Status))
+	(*gounit.T)(t).AssertEqualsInt(2, result.Instance)
+}
+
+func TestVerifyArcBrokenChain(t *testing.T) {
+	resolver := createDkimResolver()
+	sealer := &ArcSealer{Domain: "example.org", Selector: "rsa", Key: testDkimRsaKey}
+	sealed := sealTestMessage(t, resolver, sealTestMessage(t, resolver, testDkimOrigin, sealer), sealer)
+
+	tests := map[string]string{
+		strings.Replace(sealed, "hungry yet?", "thirsty yet?", 1):                                          "body hash did not verify",
+		strings.Replace(sealed, "Subject:  Is dinner", "Subject: Is lunch", 1):                             "signature did not verify",
+		strings.Replace(sealed, "i=1; mx.example.com;", "i=1; mx.example.net;", 1):                         "signature did not verify",
+		strings.Replace(sealed, "cv=none", "cv=pass", 1):                                                   "ARC-Seal 1 has cv=pass",
+		strings.Replace(sealed, "ARC-Message-Signature: i=1;", "X-Removed: i=1;", 1):                       "incomplete ARC set 1",
+		strings.Replace(sealed, "ARC-Authentication-Results: i=1;", "ARC-Authentication-Results: i=2;", 1): "duplicate ARC-Authentication-Results header for instance 2",
+		strings.Replace(sealed, "ARC-Seal: i=2;", "ARC-Seal: i=51;", 1):                                    "invalid instance in ARC-Seal header",
+		strings.Replace(sealed, "s=rsa;", "s=missing;", 1):                                                 "no key for signature",
+	}
+
+	for origin, reason := range tests {
+		result := VerifyArc(resolver, origin)
+		(*gounit.T)(t).AssertEqualsString(string(ArcFail), string(result.Status))
+		(*gounit.T)(t).AssertEqualsString(reason, result.Reason)
+	}
+
+	// Broken chain still can be sealed, but only with cv=fail.
+	broken := strings.Replace(sealed, "hungry yet?", "thirsty yet?", 1)
+	resealed := sealTestMessage(t, resolver, broken, sealer)
+	(*gounit.T)(t).AssertTrue(strings.HasPrefix(resealed, "ARC-Seal: i=3; a=rsa-sha256; t=1704207845; cv=fail;"))
+	(*gounit.T)(t).AssertEqualsString("ARC-Seal 3 has cv=fail", VerifyArc(resolver, resealed).Reason)
+}
+
+func TestArcPolicy(t *testing.T) {
+	resolver := createDmarcResolver()
+	sealer := &ArcSealer{Domain: "example.org", Selector: "rsa", Key: testDkimRsaKey}
+
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, nil)
+	protocol.SetClock(fixedClock)
+	protocol.SetTraceHeaders(TraceHeaders{Received: true})
+	protocol.AddPolicy(&SpfPolicy{Resolver: resolver})
+	protocol.AddPolicy(&ArcPolicy{Resolver: resolver, Sealer: sealer})
+
+	lines := append([]string{"EHLO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>", "DATA"},
+		strings.Split(strings.TrimSuffix(testDkimOrigin, "\r\n"), "\r\n")...)
+	message := sendTestMessage(protocol, append(lines, ".")...)
+
+	(*gounit.T)(t).AssertEqualsString(string(ArcNone), string(protocol.Session().ArcResult.Status))
+	(*gounit.T)(t).AssertTrue(strings.Contains(message.GetOrigin(), "Authentication-Results: mx.example.com;\r\n"+
+		"\tspf=pass smtp.mailfrom=example.org;\r\n"+
+		"\tarc=none\r\n"+
+		"ARC-Seal: i=1;"))
+	(*gounit.T)(t).AssertTrue(strings.Contains(message.GetOrigin(), "ARC-Authentication-Results: i=1; mx.example.com;\r\n"+
+		"\tspf=pass smtp.mailfrom=example.org;\r\n"+
+		"\tarc=none\r\n"))
+
+	result := VerifyArc(resolver, message.GetOrigin())
+	(*gounit.T)(t).AssertEqualsString(string(ArcPass), string(result.Status))
+	(*gounit.T)(t).AssertEqualsInt(1, result.Instance)
+
+	protocol = CreateProtocol("mx.example.net", nil, nil)
+	protocol.AddPolicy(&ArcPolicy{Resolver: resolver})
+	lines = append([]string{"MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>", "DATA"},
+		strings.Split(message.GetOrigin(), "\r\n")...)
+	message = sendTestMessage(protocol, append(lines, ".")...)
+
+	(*gounit.T)(t).AssertEqualsString(string(ArcPass), string(protocol.Session().ArcResult.Status))
+	(*gounit.T)(t).AssertTrue(strings.HasPrefix(message.GetOrigin(), "Authentication-Results: mx.example.net;\r\n\tarc=pass\r\n"))
+}
+
+func TestArcPolicySkipsSealing(t *testing.T) {
+	resolver := createDkimResolver()
+	sealer := &ArcSealer{Domain: "example.org", Selector: "rsa", Key: testDkimRsaKey}
+	sealed := sealTestMessage(t, resolver, sealTestMessage(t, resolver, testDkimOrigin, sealer), sealer)
+	failed := sealTestMessage(t, resolver, strings.Replace(sealed, "hungry yet?", "thirsty yet?", 1), sealer)
+
+	receive := func(resolver Resolver, origin string) (*Protocol, string) {
+		protocol := CreateProtocol("mx.example.com", nil, nil)
+		protocol.AddPolicy(&ArcPolicy{Resolver: resolver, Sealer: sealer})
+		lines := append([]string{"MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>", "DATA"},
+			strings.Split(strings.TrimSuffix(origin, "\r\n"), "\r\n")...)
+		return protocol, sendTestMessage(protocol, append(lines, ".")...).GetOrigin()
+	}
+
+	// Chain with cv=fail is not extended.
+	protocol, origin := receive(resolver, failed)
+	(*gounit.T)(t).AssertEqualsString(string(ArcFail), string(protocol.Session().ArcResult.Status))
+	(*gounit.T)(t).AssertFalse(strings.Contains(origin, "i=4;"))
+
+	// Temporary DNS failure is not sealed as cv=fail.
+	failing := createDkimResolver()
+	failing.Failing["rsa._domainkey.example.org"] = true
+	protocol, origin = receive(failing, sealed)
+	(*gounit.T)(t).AssertEqualsString(string(ArcTempError), string(protocol.Session().ArcResult.Status))
+	(*gounit.T)(t).AssertTrue(strings.Contains(origin, "arc=temperror"))
+	(*gounit.T)(t).AssertFalse(strings.Contains(origin, "i=3;"))
+
+	// Chain what failed validation, but was not sealed as failed, is sealed with cv=fail.
+	protocol, origin = receive(resolver, strings.Replace(sealed, "hungry yet?", "thirsty yet?", 1))
+	(*gounit.T)(t).AssertEqualsString(string(ArcFail), string(protocol.Session().ArcResult.Status))
+	(*gounit.T)(t).AssertTrue(strings.Contains(origin, "ARC-Seal: i=3; a=rsa-sha256;"))
+}
+
+// testArcOrigin is message with two ARC sets created by independent implementation of rfc8617,
+// so canonicalization errors do not cancel out as in tests what seal messages using same code.
+const testArcOrigin = "ARC-Seal: i=2; a=rsa-sha256; t=1704207845; cv=pass; d=example.org; s=arc;\r\n" +
+	"\tb=dVcZLpwMM88JN9tyR/6mPICLZrL/mnnN8KxsSC1sS5zhhSG6mUTHwCOgITGN1kJjQuAxnDE/U9uEUDFmGPuU/DBpYdH9ige1tuXBaVI3NdRCW9ELFWIDOFnPJG7CISXV5vjuypPg4uHa7uzAQOUcrVQ2xuarThTA2q/Wd/8L9Xc=\r\n" +
+	"ARC-Message-Signature: i=2; a=rsa-sha256; c=relaxed/relaxed; d=example.org; s=arc; t=1704207845;\r\n" +
+	"\th=from:to:subject:date; bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	"\tb=O/w9X/nzEOQsQlBuBT0DdtfFJuA6+FC4/GxrXdGoE8PEuxPDQVHZ8Ym8j8yruyVHdG2rx9xf0BIQSVdoS2Y18VxnFAl0KZSDqyITbbveHqLtK47AnaGRjuYf5rbHGEFYpxUBgDXOoUR1lTssyx1qFM7tRt+lDwVPKvRcwDRrUk4=\r\n" +
+	"ARC-Authentication-Results: i=2; mx.example.net; arc=pass\r\n" +
+	"Received: from lists.example.org by mx.example.net\r\n" +
+	"ARC-Seal: i=1; a=rsa-sha256; t=1704207845; cv=none; d=example.org; s=arc;\r\n" +
+	"\tb=BA2lCrlln1auAz6oXaumtId/r4g58qRvXdaI0mpCFUrOgTWf/MbRm/KD6UO0MX6IA2UqrmPfBwQdj2OyRrUNf7JfRz0nb1xKjp7WQA+Pme/jdHpSdYIJe5sw+0qN/ujNjLHc6R+cUhkCMokv4WxM+jCDDYsWzPsFS0RoaQCBpqU=\r\n" +
+	"ARC-Message-Signature: i=1; a=rsa-sha256; c=relaxed/relaxed; d=example.org; s=arc; t=1704207845;\r\n" +
+	"\th=from:to:subject:date; bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	"\tb=kV/jTqq49kuVK4HpDOwl3CGUxiSdyy0AQpeBKVuIssORduGHKnVEkzsXMRxFXDpz6bcAX3bjXeT5HgsoF1PIOxPJeYbULECPA6wYPDo87zHLgA+6pVEDCv4dFYrNeRMxv0IOGrjlN9rjD+6acy35y5tB6Na3R6nGLoBczkX6KOQ=\r\n" +
+	"ARC-Authentication-Results: i=1; lists.example.org; spf=pass smtp.mailfrom=football.example.com\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+func TestVerifyArcIndependentVector(t *testing.T) {
+	resolver := CreateMemoryResolver()
+	resolver.TXT["arc._domainkey.example.org"] = []string{"v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDgVxA9Q73Lwa1iay5+ooLBfq63PplosA0LQwlduC6JfUOz8D8nwyvr0gwpxC8ncOVBTQryesswu+RRHAp2JxrVNIv6ydKzPvYOnQg0uasumSGa4O9WqI3WDY4osRl8JlyayX7mv3TPO6VVu+Y8rEc5kPFdoJWijDuuLT3zZ8lk/wIDAQAB"}
+
+	result := VerifyArc(resolver, testArcOrigin)
+	(*gounit.T)(t).AssertEqualsString(string(ArcPass), string(result.Status))
+	(*gounit.T)(t).AssertEqualsInt(2, result.Instance)
+
+	// Header not signed by ARC-Message-Signature can be changed, signed one can't.
+	result = VerifyArc(resolver, strings.Replace(testArcOrigin, "by mx.example.net", "by mx2.example.net", 1))
+	(*gounit.T)(t).AssertEqualsString(string(ArcPass), string(result.Status))
+	result = VerifyArc(resolver, strings.Replace(testArcOrigin, "Subject: Is dinner ready?", "Subject: Is lunch ready?", 1))
+	(*gounit.T)(t).AssertEqualsString(string(ArcFail), string(result.Status))
+	result = VerifyArc(resolver, strings.Replace(testArcOrigin, "i=1; lists.example.org; spf=pass", "i=1; lists.example.org; spf=fail", 1))
+	(*gounit.T)(t).AssertEqualsString(string(ArcFail), string(result.Status))
+	(*gounit.T)(t).AssertEqualsString("signature did not verify", result.Reason)
+}
@@ -0,0 +1,155 @@
+package smtpServerProtocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// ClamdAction configures what ClamdPolicy does with infected message.
+type ClamdAction string
+
+const (
+	// ClamdActionReject rejects infected message with 554 reply.
+	ClamdActionReject = ClamdAction("reject")
+	// ClamdActionQuarantine accepts infected message, but marks it as quarantined,
+	// reason available in callback as protocol.QuarantineReason().
+	ClamdActionQuarantine = ClamdAction("quarantine")
+)
+
+const (
+	// clamdChunkSize is size of INSTREAM chunk, should be less than clamd StreamMaxLength.
+	clamdChunkSize = 64 * 1024
+	// clamdDefaultTimeout limits whole scan request.
+	clamdDefaultTimeout = 60 * time.Second
+)
+
+// VirusScanResult is result of message scanning by antivirus.
+type VirusScanResult struct {
+	// Scanned is false when message was not scanned.
+	Scanned bool
+	// Virus is name of found signature, empty for clean message.
+	Virus string
+}
+
+// ClamdPolicy scans received message with ClamAV clamd using INSTREAM command,
+// result stored in Session.VirusScanResult. Scanner errors temporarily reject message.
+type ClamdPolicy struct {
+	// Network is "tcp" or "unix".
+	Network string
+	Address string
+	// Timeout limits whole scan request.
+	Timeout time.Duration
+	Action  ClamdAction
+}
+
+// CreateClamdPolicy creates policy, for example ("unix", "/var/run/clamav/clamd.ctl").
+func CreateClamdPolicy(network string, address string, action ClamdAction) *ClamdPolicy {
+	return &ClamdPolicy{
+		Network: network,
+		Address: address,
+		Timeout: clamdDefaultTimeout,
+		Action:  action,
+	}
+}
+
+func (policy *ClamdPolicy) CheckData(protocol *Protocol, origin string) *Reply {
+	session := protocol.Session()
+	session.VirusScanResult = VirusScanResult{}
+
+	result, err := policy.Scan(origin, CommandEndSymbol)
+	if err != nil {
+		logManager().Error(fmt.Sprintf("Clamd %s %s failed: %s", policy.Network, policy.Address, err.Error()))
+		return ReplyLocalError("4.7.1 Virus scanner unavailable - try again later")
+	}
+	session.VirusScanResult = result
+
+	if len(result.Virus) == 0 {
+		return nil
+	}
+	logManager().Debug(fmt.Sprintf("Message infected with %s", result.Virus))
+	if policy.Action == ClamdActionQuarantine {
+		protocol.Quarantine("Infected with " + result.Virus)
+		return nil
+	}
+
+	return ReplyTransactionFailed("5.7.1 Message infected with " + result.Virus)
+}
+
+// Scan streams parts of message to clamd in chunks, parts are not joined, so message is not copied.
+func (policy *ClamdPolicy) Scan(parts ...string) (VirusScanResult, error) {
+	timeout := policy.Timeout
+	if timeout <= 0 {
+		timeout = clamdDefaultTimeout
+	}
+
+	conn, err := net.DialTimeout(policy.Network, policy.Address, timeout)
+	if err != nil {
+		return VirusScanResult{}, err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return VirusScanResult{}, err
+	}
+
+	// "z" prefix means null terminated command and reply.
+	if _, err = io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return VirusScanResult{}, err
+	}
+	writer := bufio.NewWriterSize(conn, clamdChunkSize+4)
+	size := make([]byte, 4)
+	for _, part := range parts {
+		for len(part) > 0 {
+			chunk := part
+			if len(chunk) > clamdChunkSize {
+				chunk = chunk[:clamdChunkSize]
+			}
+			part = part[len(chunk):]
+
+			binary.BigEndian.PutUint32(size, uint32(len(chunk)))
+			writer.Write(size)
+			writer.WriteString(chunk)
+			if err = writer.Flush(); err != nil {
+				return VirusScanResult{}, err
+			}
+		}
+	}
+	// Zero length chunk finishes stream.
+	binary.BigEndian.PutUint32(size, 0)
+	writer.Write(size)
+	if err = writer.Flush(); err != nil {
+		return VirusScanResult{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && (err != io.EOF || len(reply) == 0) {
+		return VirusScanResult{}, err
+	}
+
+	return parseClamdReply(reply)
+}
+
+// parseClamdReply parses reply to INSTREAM command, for example "stream: Eicar-Signature FOUND".
+func parseClamdReply(reply string) (VirusScanResult, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	_, status, found := strings.Cut(reply, ": ")
+	if !found {
+		return VirusScanResult{}, fmt.Errorf("clamd error: %s", reply)
+	}
+
+	switch {
+	case status == "OK":
+		return VirusScanResult{Scanned: true}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return VirusScanResult{Scanned: true, Virus: strings.TrimSuffix(status, " FOUND")}, nil
+	case strings.HasSuffix(status, " ERROR"):
+		return VirusScanResult{}, errors.New("clamd error: " + strings.TrimSuffix(status, " ERROR"))
+	}
+
+	return VirusScanResult{}, fmt.Errorf("unexpected clamd reply: %s", reply)
+}
@@ -0,0 +1,154 @@
+package smtpServerProtocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/mailhedgehog/gounit"
+	"github.com/mailhedgehog/smtpMessage"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// startFakeClamd starts clamd what finds EICAR string in streamed data,
+// sizes of received chunks sent to returned channel.
+func startFakeClamd(t *testing.T, reply string) (string, chan []int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	(*gounit.T)(t).AssertNotError(err)
+	t.Cleanup(func() { listener.Close() })
+
+	chunks := make(chan []int, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			command, _ := reader.ReadString(0)
+			if command != "zINSTREAM\x00" {
+				io.WriteString(conn, "UNKNOWN COMMAND\x00")
+				conn.Close()
+				continue
+			}
+
+			var sizes []int
+			data := ""
+			size := make([]byte, 4)
+			for {
+				if _, err := io.ReadFull(reader, size); err != nil {
+					break
+				}
+				chunk := make([]byte, binary.BigEndian.Uint32(size))
+				if len(chunk) == 0 {
+					break
+				}
+				io.ReadFull(reader, chunk)
+				sizes = append(sizes, len(chunk))
+				data += string(chunk)
+			}
+			chunks <- sizes
+
+			response := reply
+			if len(response) == 0 {
+				response = "stream: OK\x00"
+				if strings.Contains(data, "EICAR-STANDARD-ANTIVIRUS-TEST-FILE") {
+					response = "stream: Eicar-Signature FOUND\x00"
+				}
+			}
+			io.WriteString(conn, response)
+			conn.Close()
+		}
+	}()
+
+	return listener.Addr().String(), chunks
+}
+
+func TestClamdPolicyReject(t *testing.T) {
+	address, chunks := startFakeClamd(t, "")
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.AddPolicy(CreateClamdPolicy("tcp", address, ClamdActionReject))
+
+	message := sendTestMessage(protocol, "HELO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>",
+		"DATA", "Subject: test", "", "body", ".")
+	(*gounit.T)(t).AssertEqualsString("Subject: test\r\n\r\nbody", message.GetOrigin())
+	(*gounit.T)(t).AssertTrue(protocol.Session().VirusScanResult.Scanned)
+	(*gounit.T)(t).AssertEqualsString("", protocol.Session().VirusScanResult.Virus)
+	(*gounit.T)(t).AssertEqualsInt(2, len(<-chunks))
+
+	for _, line := range []string{"MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>", "DATA", "Subject: test", "",
+		"X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*"} {
+		protocol.HandleReceivedLine(line)
+	}
+	reply := protocol.HandleReceivedLine(".")
+	(*gounit.T)(t).AssertEqualsInt(CODE_TRANSACTION_FAILED, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("5.7.1 Message infected with Eicar-Signature", reply.lines[0])
+	(*gounit.T)(t).AssertEqualsString("Eicar-Signature", protocol.Session().VirusScanResult.Virus)
+}
+
+func TestClamdPolicyQuarantine(t *testing.T) {
+	address, _ := startFakeClamd(t, "")
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.AddPolicy(CreateClamdPolicy("tcp", address, ClamdActionQuarantine))
+
+	quarantineReason := ""
+	protocol.OnMessageReceived(func(message *smtpMessage.SmtpMessage) (string, error) {
+		quarantineReason = protocol.QuarantineReason()
+		return "id", nil
+	})
+	for _, line := range []string{"HELO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>", "DATA", "Subject: test", "",
+		"X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*"} {
+		protocol.HandleReceivedLine(line)
+	}
+	reply := protocol.HandleReceivedLine(".")
+
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("Infected with Eicar-Signature", quarantineReason)
+}
+
+func TestClamdScanChunks(t *testing.T) {
+	address, chunks := startFakeClamd(t, "")
+	policy := CreateClamdPolicy("tcp", address, ClamdActionReject)
+
+	result, err := policy.Scan(strings.Repeat("a", clamdChunkSize+10), "\r\n")
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertTrue(result.Scanned)
+
+	sizes := <-chunks
+	(*gounit.T)(t).AssertEqualsInt(3, len(sizes))
+	(*gounit.T)(t).AssertEqualsInt(clamdChunkSize, sizes[0])
+	(*gounit.T)(t).AssertEqualsInt(10, sizes[1])
+	(*gounit.T)(t).AssertEqualsInt(2, sizes[2])
+}
+
+func TestClamdPolicyErrors(t *testing.T) {
+	address, _ := startFakeClamd(t, "INSTREAM size limit exceeded. ERROR\x00")
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.AddPolicy(CreateClamdPolicy("tcp", address, ClamdActionReject))
+
+	for _, line := range []string{"HELO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>", "DATA", "body"} {
+		protocol.HandleReceivedLine(line)
+	}
+	reply := protocol.HandleReceivedLine(".")
+	(*gounit.T)(t).AssertEqualsInt(CODE_LOCAL_ERROR, reply.Status)
+	(*gounit.T)(t).AssertFalse(protocol.Session().VirusScanResult.Scanned)
+
+	replies := map[string]string{
+		"stream: OK\x00":                              "",
+		"stream: Eicar-Signature FOUND\x00":           "",
+		"stream: Can't allocate memory ERROR\x00":     "clamd error: Can't allocate memory",
+		"INSTREAM size limit exceeded. ERROR\x00":     "clamd error: INSTREAM size limit exceeded. ERROR",
+		"stream: something unexpected\x00":            "unexpected clamd reply: stream: something unexpected",
+		"stream: /tmp/file: Permission denied. ERROR": "clamd error: /tmp/file: Permission denied.",
+	}
+	for reply, expected := range replies {
+		_, err := parseClamdReply(reply)
+		if len(expected) == 0 {
+			(*gounit.T)(t).AssertNotError(err)
+			continue
+		}
+		(*gounit.T)(t).ExpectError(err)
+		(*gounit.T)(t).AssertEqualsString(expected, err.Error())
+	}
+}
@@ -20,6 +20,10 @@ const (
 	CommandRcpt = CommandName("RCPT")
 	CommandData = CommandName("DATA")
 	CommandQuit = CommandName("QUIT")
+	// CommandStartTls described in rfc3207
+	CommandStartTls = CommandName("STARTTLS")
+	// CommandBdat described in rfc3030, not implemented, but listed to refuse it properly in HELO session
+	CommandBdat = CommandName("BDAT")
 )
 
 // Command is a struct representing an SMTP command (verb + arguments)
@@ -31,4 +31,5 @@ func TestCommandStrings(t *testing.T) {
 	(*gounit.T)(t).AssertEqualsString(string(CommandRcpt), "RCPT")
 	(*gounit.T)(t).AssertEqualsString(string(CommandData), "DATA")
 	(*gounit.T)(t).AssertEqualsString(string(CommandQuit), "QUIT")
+	(*gounit.T)(t).AssertEqualsString(string(CommandStartTls), "STARTTLS")
 }
@@ -0,0 +1,238 @@
+package smtpServerProtocol
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// readBufferSize is size of chunk read from connection at once.
+const readBufferSize = 4096
+
+// Connection drives protocol conversation over network connection: sends greeting,
+// reads client lines, writes replies and enforces protocol timeouts.
+type Connection struct {
+	conn      net.Conn
+	protocol  *Protocol
+	writer    *bufio.Writer
+	tlsConfig *tls.Config
+
+	// proxyUpstreams are networks of proxies what must send PROXY protocol header, nil when disabled.
+	proxyUpstreams []*net.IPNet
+	proxyHeader    *ProxyHeader
+}
+
+// CreateConnection creates driver for already accepted connection.
+func CreateConnection(conn net.Conn, protocol *Protocol) *Connection {
+	return &Connection{
+		conn:     conn,
+		protocol: protocol,
+		writer:   bufio.NewWriter(conn),
+	}
+}
+
+// EnableStartTls allows client to upgrade connection to TLS using provided config.
+func (connection *Connection) EnableStartTls(tlsConfig *tls.Config) {
+	connection.tlsConfig = tlsConfig
+	connection.protocol.EnableStartTls()
+}
+
+// EnableProxyProtocol requires PROXY protocol header (v1 or v2) from connections of trusted upstreams,
+// client address from header replaces protocol Ip before greeting. Connections from other addresses
+// served as direct clients, so header sent by them is handled as unrecognised command.
+func (connection *Connection) EnableProxyProtocol(trustedUpstreams []*net.IPNet) {
+	connection.proxyUpstreams = trustedUpstreams
+	if connection.proxyUpstreams == nil {
+		connection.proxyUpstreams = []*net.IPNet{}
+	}
+}
+
+// ProxyHeader returns header received from upstream proxy, nil when connection was not proxied.
+func (connection *Connection) ProxyHeader() *ProxyHeader {
+	return connection.proxyHeader
+}
+
+// Serve handles session until client quits, session closed by protocol or timeout exceeded.
+// Connection is closed on return.
+func (connection *Connection) Serve(identification string) error {
+	defer func() {
+		connection.protocol.Close()
+		connection.conn.Close()
+	}()
+
+	if err := connection.readProxyHeader(); err != nil {
+		return err
+	}
+
+	buffer := make([]byte, readBufferSize)
+
+	if delay := connection.protocol.GreetingDelay(); delay > 0 {
+		finished, err := connection.waitBeforeGreeting(delay, buffer)
+		if finished || err != nil {
+			return err
+		}
+	}
+
+	if err := connection.writeReplies(connection.protocol.SayWelcome(identification)); err != nil {
+		return err
+	}
+
+	// Data received before greeting, allowed by early talker detection
+	if connection.protocol.HasPendingInput() {
+		if finished, err := connection.handleData(nil); finished || err != nil {
+			return err
+		}
+	}
+
+	for {
+		if err := connection.conn.SetReadDeadline(connection.protocol.ReadDeadline()); err != nil {
+			return err
+		}
+
+		size, readErr := connection.conn.Read(buffer)
+		if size > 0 {
+			if finished, err := connection.handleData(buffer[:size]); finished || err != nil {
+				return err
+			}
+		}
+
+		if readErr != nil {
+			if isTimeout(readErr) {
+				logManager().Debug(fmt.Sprintf("Connection timeout: %s", connection.conn.RemoteAddr()))
+				return connection.writeReplies(connection.protocol.Timeout())
+			}
+			return readErr
+		}
+	}
+}
+
+// readProxyHeader reads PROXY protocol header when connection established by trusted upstream
+// and sets client address to protocol.
+func (connection *Connection) readProxyHeader() error {
+	if connection.proxyUpstreams == nil {
+		return nil
+	}
+
+	upstream, ok := connection.conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !containsIp(connection.proxyUpstreams, upstream.IP) {
+		logManager().Debug(fmt.Sprintf("Connection from %s is not proxied", connection.conn.RemoteAddr()))
+		return nil
+	}
+
+	if err := connection.conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return err
+	}
+	header, err := ReadProxyHeader(connection.conn)
+	if err != nil {
+		return fmt.Errorf("invalid proxy protocol header from %s: %w", upstream, err)
+	}
+
+	connection.proxyHeader = header
+	if header.Source != nil {
+		logManager().Debug(fmt.Sprintf("Connection from %s proxied by %s", header.Source, upstream))
+		connection.protocol.Ip = header.Source
+	}
+
+	return nil
+}
+
+// waitBeforeGreeting waits given delay and passes to protocol any data received before greeting,
+// reading continues until deadline, so client can't shorten delay by sending data.
+func (connection *Connection) waitBeforeGreeting(delay time.Duration, buffer []byte) (bool, error) {
+	if err := connection.conn.SetReadDeadline(time.Now().Add(delay)); err != nil {
+		return false, err
+	}
+
+	for {
+		size, readErr := connection.conn.Read(buffer)
+		if size > 0 {
+			if finished, err := connection.handleData(buffer[:size]); finished || err != nil {
+				return finished, err
+			}
+		}
+		if readErr != nil {
+			if isTimeout(readErr) {
+				return false, nil
+			}
+			return false, readErr
+		}
+	}
+}
+
+// handleData passes received chunk to protocol, writes replies and executes action of last reply.
+// Returns true when session is finished.
+func (connection *Connection) handleData(chunk []byte) (bool, error) {
+	replies := connection.protocol.HandleReceivedData(chunk)
+	if err := connection.writeReplies(replies...); err != nil {
+		return false, err
+	}
+	if len(replies) == 0 {
+		return false, nil
+	}
+
+	switch replies[len(replies)-1].Action {
+	case ActionClose:
+		return true, nil
+	case ActionStartTls:
+		return false, connection.startTls()
+	}
+
+	return false, nil
+}
+
+func (connection *Connection) startTls() error {
+	// Commands pipelined after STARTTLS were sent in plaintext and could be injected (rfc3207 section 5).
+	if connection.protocol.HasPendingInput() {
+		return errors.New("plaintext data received after STARTTLS")
+	}
+	if connection.tlsConfig == nil {
+		return errors.New("tls config not provided")
+	}
+
+	tlsConn := tls.Server(connection.conn, connection.tlsConfig)
+	if err := tlsConn.SetDeadline(connection.protocol.ReadDeadline()); err != nil {
+		return err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("tls handshake failed: %w", err)
+	}
+	if err := tlsConn.SetWriteDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	state := tlsConn.ConnectionState()
+	connection.protocol.SetTLS(&state)
+
+	connection.conn = tlsConn
+	connection.writer = bufio.NewWriter(tlsConn)
+
+	return nil
+}
+
+// writeReplies writes all replies to client using one flush, replies with delay flushed separately
+// after delay, only goroutine of this connection is blocked.
+func (connection *Connection) writeReplies(replies ...*Reply) error {
+	for _, reply := range replies {
+		if reply.Delay > 0 {
+			if err := connection.writer.Flush(); err != nil {
+				return err
+			}
+			time.Sleep(reply.Delay)
+		}
+		for _, line := range reply.FormattedLines() {
+			if _, err := connection.writer.WriteString(line); err != nil {
+				return err
+			}
+		}
+	}
+
+	return connection.writer.Flush()
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,180 @@
+package smtpServerProtocol
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/mailhedgehog/gounit"
+	"github.com/mailhedgehog/smtpMessage"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func startTestConnection(protocol *Protocol) (net.Conn, *bufio.Reader, chan error) {
+	server, client := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- CreateConnection(server, protocol).Serve("")
+	}()
+
+	return client, bufio.NewReader(client), done
+}
+
+func readReplyLine(t *testing.T, reader *bufio.Reader) string {
+	line, err := reader.ReadString('\n')
+	(*gounit.T)(t).AssertNotError(err)
+	return line
+}
+
+func writeClientData(t *testing.T, writer io.Writer, data string) {
+	_, err := writer.Write([]byte(data))
+	(*gounit.T)(t).AssertNotError(err)
+}
+
+func TestConnectionServe(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	var received *smtpMessage.SmtpMessage
+	protocol.OnMessageReceived(func(message *smtpMessage.SmtpMessage) (string, error) {
+		received = message
+		return "queued-id", nil
+	})
+	client, reader, done := startTestConnection(protocol)
+
+	(*gounit.T)(t).AssertEqualsString("220 mx.example.com Service ready\r\n", readReplyLine(t, reader))
+
+	writeClientData(t, client, "HELO client.example.org\r\n")
+	(*gounit.T)(t).AssertEqualsString("250 Hello client.example.org\r\n", readReplyLine(t, reader))
+	writeClientData(t, client, "MAIL FROM:<foo@bar.com>\r\n")
+	readReplyLine(t, reader)
+	writeClientData(t, client, "RCPT TO:<baz@example.com>\r\n")
+	readReplyLine(t, reader)
+	writeClientData(t, client, "DATA\r\n")
+	readReplyLine(t, reader)
+	writeClientData(t, client, "Subject: test\r\n\r\nbody\r\n.\r\n")
+	(*gounit.T)(t).AssertEqualsString("250 Ok: queued as queued-id\r\n", readReplyLine(t, reader))
+	writeClientData(t, client, "QUIT\r\n")
+	(*gounit.T)(t).AssertEqualsString("221 Bye\r\n", readReplyLine(t, reader))
+
+	(*gounit.T)(t).AssertNotError(<-done)
+	(*gounit.T)(t).AssertEqualsString("Subject: test\r\n\r\nbody", received.GetOrigin())
+}
+
+func TestConnectionTimeout(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.SetTimeouts(Timeouts{Greeting: 50 * time.Millisecond})
+	_, reader, done := startTestConnection(protocol)
+
+	readReplyLine(t, reader)
+	(*gounit.T)(t).AssertEqualsString("421 4.4.2 mx.example.com Timeout exceeded, closing connection\r\n", readReplyLine(t, reader))
+	(*gounit.T)(t).AssertNotError(<-done)
+}
+
+func TestConnectionTimeoutNotExtendedByPartialLine(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.SetTimeouts(Timeouts{Idle: 100 * time.Millisecond})
+	client, reader, done := startTestConnection(protocol)
+
+	readReplyLine(t, reader)
+	writeClientData(t, client, "HELO client.example.org\r\n")
+	readReplyLine(t, reader)
+
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := reader.ReadString('\n')
+		lines <- line
+	}()
+
+	// Every byte arrives before Idle timeout, but command is not finished in time.
+	line := ""
+	for i := 0; len(line) == 0 && i < 20; i++ {
+		select {
+		case line = <-lines:
+		case <-time.After(30 * time.Millisecond):
+			if _, err := client.Write([]byte("N")); err != nil {
+				line = <-lines
+			}
+		}
+	}
+	client.Close()
+
+	(*gounit.T)(t).AssertEqualsString("421 4.4.2 mx.example.com Timeout exceeded, closing connection\r\n", line)
+	(*gounit.T)(t).AssertNotError(<-done)
+}
+
+func testTlsConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	(*gounit.T)(t).AssertNotError(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example.com"},
+		DNSNames:     []string{"mx.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	(*gounit.T)(t).AssertNotError(err)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certificate}, PrivateKey: key}},
+	}
+}
+
+func TestConnectionStartTls(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	server, client := net.Pipe()
+	done := make(chan error, 1)
+	// Config created before goroutine, assertion can't stop test from other goroutine.
+	tlsConfig := testTlsConfig(t)
+	go func() {
+		connection := CreateConnection(server, protocol)
+		connection.EnableStartTls(tlsConfig)
+		done <- connection.Serve("")
+	}()
+	reader := bufio.NewReader(client)
+
+	readReplyLine(t, reader)
+	writeClientData(t, client, "EHLO client.example.org\r\n")
+	readReplyLine(t, reader)
+	readReplyLine(t, reader)
+	(*gounit.T)(t).AssertEqualsString("250 STARTTLS\r\n", readReplyLine(t, reader))
+	writeClientData(t, client, "STARTTLS\r\n")
+	(*gounit.T)(t).AssertEqualsString("220 2.0.0 Ready to start TLS\r\n", readReplyLine(t, reader))
+
+	tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	(*gounit.T)(t).AssertNotError(tlsClient.Handshake())
+	reader = bufio.NewReader(tlsClient)
+
+	writeClientData(t, tlsClient, "EHLO client.example.org\r\n")
+	(*gounit.T)(t).AssertEqualsString("250-Hello client.example.org\r\n", readReplyLine(t, reader))
+	(*gounit.T)(t).AssertEqualsString("250 PIPELINING\r\n", readReplyLine(t, reader))
+	(*gounit.T)(t).AssertEqualsString(KeywordEsmtpS, protocol.protocolKeyword())
+	writeClientData(t, tlsClient, "QUIT\r\n")
+	(*gounit.T)(t).AssertEqualsString("221 Bye\r\n", readReplyLine(t, reader))
+	client.Close()
+	(*gounit.T)(t).AssertNotError(<-done)
+}
+
+func TestConnectionStartTlsInjection(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	server, client := net.Pipe()
+	done := make(chan error, 1)
+	tlsConfig := testTlsConfig(t)
+	go func() {
+		connection := CreateConnection(server, protocol)
+		connection.EnableStartTls(tlsConfig)
+		done <- connection.Serve("")
+	}()
+	reader := bufio.NewReader(client)
+
+	readReplyLine(t, reader)
+	writeClientData(t, client, "STARTTLS\r\nRSET\r\n")
+	readReplyLine(t, reader)
+	(*gounit.T)(t).ExpectError(<-done)
+}
@@ -0,0 +1,593 @@
+package smtpServerProtocol
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DkimStatus represents result of DKIM signature verification (rfc8601 section 2.7.1).
+type DkimStatus string
+
+const (
+	DkimNone      = DkimStatus("none")
+	DkimPass      = DkimStatus("pass")
+	DkimFail      = DkimStatus("fail")
+	DkimNeutral   = DkimStatus("neutral")
+	DkimTempError = DkimStatus("temperror")
+	DkimPermError = DkimStatus("permerror")
+)
+
+// List of supported signing algorithms.
+const (
+	DkimRsaSha256     = "rsa-sha256"
+	DkimEd25519Sha256 = "ed25519-sha256"
+)
+
+// List of canonicalization algorithms described in rfc6376 section 3.4.
+const (
+	DkimSimple  = "simple"
+	DkimRelaxed = "relaxed"
+)
+
+const (
+	// dkimMaximumSignatures limits verified signatures per message, as each one requires DNS lookup.
+	dkimMaximumSignatures = 5
+	// dkimMinimumRsaKeyBits is smallest allowed RSA key size (rfc8301 section 3.2).
+	dkimMinimumRsaKeyBits = 1024
+)
+
+// DkimResult is result of verification of one DKIM-Signature header.
+type DkimResult struct {
+	Status    DkimStatus
+	Domain    string
+	Selector  string
+	Identity  string
+	Algorithm string
+	// Signature is beginning of b= tag, used to distinguish signatures with same domain.
+	Signature string
+	// Reason describes why verification failed.
+	Reason string
+}
+
+// dkimError stops verification of signature with given status.
+type dkimError struct {
+	status  DkimStatus
+	message string
+}
+
+func (err *dkimError) Error() string {
+	return string(err.status) + ": " + err.message
+}
+
+// headerField is message header field, value contains raw text after colon including folding.
+type headerField struct {
+	name  string
+	value string
+}
+
+// dkimSignature is parsed DKIM-Signature header.
+type dkimSignature struct {
+	algorithm              string
+	headerCanonicalization string
+	bodyCanonicalization   string
+	domain                 string
+	selector               string
+	identity               string
+	headers                []string
+	bodyHash               []byte
+	signature              []byte
+	// bodyLength is value of l= tag, -1 when whole body is signed.
+	bodyLength int
+	expiration int64
+}
+
+// VerifyDkim verifies all DKIM-Signature headers of message (rfc6376),
+// returns empty list when message is not signed.
+func VerifyDkim(resolver Resolver, origin string, now time.Time) []DkimResult {
+	headers, body := splitMessage(origin)
+
+	ctx, cancel := lookupContext()
+	defer cancel()
+
+	var results []DkimResult
+	for _, field := range headers {
+		if !strings.EqualFold(field.fieldName(), "DKIM-Signature") {
+			continue
+		}
+		if len(results) >= dkimMaximumSignatures {
+			break
+		}
+		results = append(results, verifyDkimSignature(ctx, resolver, headers, body, field, now))
+	}
+
+	return results
+}
+
+func verifyDkimSignature(ctx context.Context, resolver Resolver, headers []headerField, body string, field headerField, now time.Time) DkimResult {
+	result := DkimResult{Status: DkimPass}
+
+	signature, err := parseDkimSignature(field.value)
+	if signature != nil {
+		result.Domain = signature.domain
+		result.Selector = signature.selector
+		result.Identity = signature.identity
+		result.Algorithm = signature.algorithm
+		result.Signature = base64.StdEncoding.EncodeToString(signature.signature)
+		if len(result.Signature) > 8 {
+			result.Signature = result.Signature[:8]
+		}
+	}
+
+	if err == nil && signature.expiration > 0 && now.Unix() > signature.expiration {
+		err = &dkimError{DkimFail, "signature expired"}
+	}
+
+	var key crypto.PublicKey
+	if err == nil {
+		key, err = lookupDkimKey(ctx, resolver, signature)
+	}
+	if err == nil {
+		err = signature.verifyBody(body)
+	}
+	if err == nil {
+		err = signature.verifyHeaders(key, headers, field)
+	}
+
+	var verificationError *dkimError
+	if errors.As(err, &verificationError) {
+		result.Status = verificationError.status
+		result.Reason = verificationError.message
+	}
+
+	return result
+}
+
+func parseDkimSignature(value string) (*dkimSignature, error) {
+	tags, err := parseDkimTags(value)
+	if err != nil {
+		return nil, &dkimError{DkimNeutral, err.Error()}
+	}
+
+	signature, err := createDkimSignature(tags, []string{"v", "a", "b", "bh", "d", "h", "s"})
+	if err != nil {
+		return signature, err
+	}
+	if tags["v"] != "1" {
+		return signature, &dkimError{DkimNeutral, "unsupported version"}
+	}
+	if !signature.signsHeader("from") {
+		return signature, &dkimError{DkimNeutral, "From field not signed"}
+	}
+
+	signature.identity = tags["i"]
+	if len(signature.identity) == 0 {
+		signature.identity = "@" + signature.domain
+	}
+	identityDomain := normalizeDnsName(signature.identity[strings.LastIndex(signature.identity, "@")+1:])
+	if identityDomain != signature.domain && !strings.HasSuffix(identityDomain, "."+signature.domain) {
+		return signature, &dkimError{DkimNeutral, "identity does not match domain"}
+	}
+
+	return signature, nil
+}
+
+// createDkimSignature parses tags what are common for DKIM-Signature and ARC headers.
+func createDkimSignature(tags map[string]string, required []string) (*dkimSignature, error) {
+	var err error
+	signature := &dkimSignature{
+		algorithm:  strings.ToLower(tags["a"]),
+		domain:     normalizeDnsName(tags["d"]),
+		selector:   strings.ToLower(tags["s"]),
+		bodyLength: -1,
+	}
+	var signatureError error
+	signature.signature, signatureError = base64.StdEncoding.DecodeString(removeWhitespace(tags["b"]))
+
+	for _, name := range required {
+		if len(tags[name]) == 0 {
+			return signature, &dkimError{DkimNeutral, "missing " + name + "= tag"}
+		}
+	}
+	if signature.algorithm != DkimRsaSha256 && signature.algorithm != DkimEd25519Sha256 {
+		return signature, &dkimError{DkimPermError, "unsupported algorithm " + signature.algorithm}
+	}
+
+	canonicalization := strings.Split(strings.ToLower(tags["c"]), "/")
+	signature.headerCanonicalization = DkimSimple
+	signature.bodyCanonicalization = DkimSimple
+	if len(canonicalization[0]) > 0 {
+		signature.headerCanonicalization = canonicalization[0]
+	}
+	if len(canonicalization) > 1 {
+		signature.bodyCanonicalization = canonicalization[1]
+	}
+	if len(canonicalization) > 2 ||
+		!isDkimCanonicalization(signature.headerCanonicalization) ||
+		!isDkimCanonicalization(signature.bodyCanonicalization) {
+		return signature, &dkimError{DkimNeutral, "unsupported canonicalization " + tags["c"]}
+	}
+
+	if len(tags["h"]) > 0 {
+		for _, name := range strings.Split(tags["h"], ":") {
+			signature.headers = append(signature.headers, strings.ToLower(strings.TrimSpace(name)))
+		}
+	}
+
+	if signature.bodyHash, err = base64.StdEncoding.DecodeString(removeWhitespace(tags["bh"])); err != nil {
+		return signature, &dkimError{DkimNeutral, "malformed bh= tag"}
+	}
+	if signatureError != nil {
+		return signature, &dkimError{DkimNeutral, "malformed b= tag"}
+	}
+
+	if length, ok := tags["l"]; ok {
+		if signature.bodyLength, err = strconv.Atoi(length); err != nil || signature.bodyLength < 0 {
+			return signature, &dkimError{DkimNeutral, "malformed l= tag"}
+		}
+	}
+	if expiration, ok := tags["x"]; ok {
+		if signature.expiration, err = strconv.ParseInt(expiration, 10, 64); err != nil {
+			return signature, &dkimError{DkimNeutral, "malformed x= tag"}
+		}
+	}
+
+	return signature, nil
+}
+
+func (signature *dkimSignature) signsHeader(name string) bool {
+	for _, header := range signature.headers {
+		if header == name {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupDkimKey fetches public key from "<selector>._domainkey.<domain>" TXT record (rfc6376 section 3.6.2).
+func lookupDkimKey(ctx context.Context, resolver Resolver, signature *dkimSignature) (crypto.PublicKey, error) {
+	name := signature.selector + "._domainkey." + signature.domain
+	txts, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, &dkimError{DkimPermError, "no key for signature"}
+		}
+		return nil, &dkimError{DkimTempError, "key unavailable"}
+	}
+	if len(txts) == 0 {
+		return nil, &dkimError{DkimPermError, "no key for signature"}
+	}
+
+	tags, err := parseDkimTags(txts[0])
+	if err != nil {
+		return nil, &dkimError{DkimPermError, "malformed key record"}
+	}
+	if version, ok := tags["v"]; ok && version != "DKIM1" {
+		return nil, &dkimError{DkimPermError, "unsupported key version"}
+	}
+	if hashes, ok := tags["h"]; ok && !containsDkimTagValue(hashes, "sha256") {
+		return nil, &dkimError{DkimPermError, "hash algorithm not allowed by key"}
+	}
+	if services, ok := tags["s"]; ok && !containsDkimTagValue(services, "*") && !containsDkimTagValue(services, "email") {
+		return nil, &dkimError{DkimPermError, "key is not for email"}
+	}
+	if containsDkimTagValue(tags["t"], "s") && !strings.HasSuffix(signature.identity, "@"+signature.domain) {
+		return nil, &dkimError{DkimPermError, "key does not allow subdomain identity"}
+	}
+
+	publicKey := removeWhitespace(tags["p"])
+	if len(publicKey) == 0 {
+		return nil, &dkimError{DkimPermError, "key revoked"}
+	}
+	data, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, &dkimError{DkimPermError, "malformed key"}
+	}
+
+	keyType := strings.ToLower(tags["k"])
+	if len(keyType) == 0 {
+		keyType = "rsa"
+	}
+	if !strings.HasPrefix(signature.algorithm, keyType+"-") {
+		return nil, &dkimError{DkimPermError, "key type does not match algorithm"}
+	}
+
+	switch keyType {
+	case "rsa":
+		parsed, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			parsed, err = x509.ParsePKCS1PublicKey(data)
+		}
+		key, ok := parsed.(*rsa.PublicKey)
+		if err != nil || !ok {
+			return nil, &dkimError{DkimPermError, "malformed key"}
+		}
+		if key.N.BitLen() < dkimMinimumRsaKeyBits {
+			return nil, &dkimError{DkimPermError, "key too short"}
+		}
+		return key, nil
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, &dkimError{DkimPermError, "malformed key"}
+		}
+		return ed25519.PublicKey(data), nil
+	}
+
+	return nil, &dkimError{DkimPermError, "unsupported key type " + keyType}
+}
+
+func (signature *dkimSignature) verifyBody(body string) error {
+	canonical := canonicalizeBody(body, signature.bodyCanonicalization)
+	if signature.bodyLength >= 0 {
+		if signature.bodyLength > len(canonical) {
+			return &dkimError{DkimFail, "body shorter than l= tag"}
+		}
+		canonical = canonical[:signature.bodyLength]
+	}
+
+	bodyHash := sha256.Sum256([]byte(canonical))
+	if !bytes.Equal(bodyHash[:], signature.bodyHash) {
+		return &dkimError{DkimFail, "body hash did not verify"}
+	}
+
+	return nil
+}
+
+func (signature *dkimSignature) verifyHeaders(key crypto.PublicKey, headers []headerField, field headerField) error {
+	return signature.verifyDigest(key, signature.headersHash(headers, field).Sum(nil))
+}
+
+func (signature *dkimSignature) verifyDigest(key crypto.PublicKey, digest []byte) error {
+	verified := false
+	switch publicKey := key.(type) {
+	case *rsa.PublicKey:
+		verified = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest, signature.signature) == nil
+	case ed25519.PublicKey:
+		// Ed25519 signs hash of data, not data itself (rfc8463 section 3).
+		verified = ed25519.Verify(publicKey, digest, signature.signature)
+	}
+	if !verified {
+		return &dkimError{DkimFail, "signature did not verify"}
+	}
+
+	return nil
+}
+
+// headersHash hashes signed header fields and signature field itself with empty b= tag (rfc6376 section 3.7).
+func (signature *dkimSignature) headersHash(headers []headerField, field headerField) hash.Hash {
+	headersHash := sha256.New()
+
+	// Multiple instances of same field are signed from bottom to top.
+	used := map[string]int{}
+	for _, name := range signature.headers {
+		skip := used[name]
+		used[name]++
+		for i := len(headers) - 1; i >= 0; i-- {
+			if !strings.EqualFold(headers[i].fieldName(), name) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			headersHash.Write([]byte(canonicalizeHeader(headers[i], signature.headerCanonicalization)))
+			break
+		}
+	}
+
+	unsigned := headerField{name: field.name, value: removeDkimSignatureValue(field.value)}
+	headersHash.Write([]byte(strings.TrimSuffix(canonicalizeHeader(unsigned, signature.headerCanonicalization), CommandEndSymbol)))
+
+	return headersHash
+}
+
+// DkimPolicy verifies DKIM signatures of received message, results stored in
+// Session.DkimResults and added to Authentication-Results header. Message verified only
+// once, when DmarcPolicy already verified it, policy does nothing.
+type DkimPolicy struct {
+	Resolver Resolver
+}
+
+// CreateDkimPolicy creates policy what uses DefaultResolver.
+func CreateDkimPolicy() *DkimPolicy {
+	return &DkimPolicy{
+		Resolver: DefaultResolver,
+	}
+}
+
+func (policy *DkimPolicy) CheckData(protocol *Protocol, origin string) *Reply {
+	if protocol.hasAuthenticationResult("dkim") {
+		return nil
+	}
+
+	results := VerifyDkim(policy.Resolver, origin, protocol.now())
+	protocol.Session().DkimResults = results
+
+	if len(results) == 0 {
+		protocol.AddAuthenticationResult("dkim=" + string(DkimNone))
+	}
+	for _, result := range results {
+		protocol.AddAuthenticationResult(result.authenticationResult())
+	}
+
+	return nil
+}
+
+// authenticationResult formats result as "resinfo" of Authentication-Results header.
+func (result DkimResult) authenticationResult() string {
+	resinfo := "dkim=" + string(result.Status)
+	if len(result.Reason) > 0 {
+		resinfo += fmt.Sprintf(" reason=%q", result.Reason)
+	}
+	if len(result.Domain) > 0 {
+		resinfo += " header.d=" + result.Domain
+	}
+	if len(result.Identity) > 0 {
+		resinfo += " header.i=" + result.Identity
+	}
+	if len(result.Selector) > 0 {
+		resinfo += " header.s=" + result.Selector
+	}
+	if len(result.Algorithm) > 0 {
+		resinfo += " header.a=" + result.Algorithm
+	}
+	if len(result.Signature) > 0 {
+		resinfo += " header.b=" + result.Signature
+	}
+
+	return resinfo
+}
+
+// splitMessage splits message origin to header fields and body.
+func splitMessage(origin string) ([]headerField, string) {
+	header, body := origin, ""
+	if strings.HasPrefix(origin, CommandEndSymbol) {
+		header, body = "", origin[len(CommandEndSymbol):]
+	} else if index := strings.Index(origin, CommandEndSymbol+CommandEndSymbol); index >= 0 {
+		header, body = origin[:index], origin[index+2*len(CommandEndSymbol):]
+	}
+
+	var fields []headerField
+	for _, line := range strings.Split(header, CommandEndSymbol) {
+		if len(line) == 0 {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].value += CommandEndSymbol + line
+			continue
+		}
+		if index := strings.Index(line, ":"); index > 0 {
+			fields = append(fields, headerField{name: line[:index], value: line[index+1:]})
+		}
+	}
+
+	return fields, body
+}
+
+func (field headerField) fieldName() string {
+	return strings.TrimRight(field.name, " \t")
+}
+
+// canonicalizeHeader canonicalizes header field including trailing <CRLF> (rfc6376 section 3.4.1 and 3.4.2).
+func canonicalizeHeader(field headerField, canonicalization string) string {
+	if canonicalization == DkimSimple {
+		return field.name + ":" + field.value + CommandEndSymbol
+	}
+
+	value := strings.ReplaceAll(field.value, CommandEndSymbol, "")
+	value = strings.Trim(collapseWhitespace(value), " ")
+
+	return strings.ToLower(field.fieldName()) + ":" + value + CommandEndSymbol
+}
+
+// canonicalizeBody canonicalizes message body (rfc6376 section 3.4.3 and 3.4.4).
+func canonicalizeBody(body string, canonicalization string) string {
+	lines := strings.Split(body, CommandEndSymbol)
+	if canonicalization == DkimRelaxed {
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(collapseWhitespace(line), " ")
+		}
+	}
+
+	for len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if canonicalization == DkimRelaxed {
+			return ""
+		}
+		return CommandEndSymbol
+	}
+
+	return strings.Join(lines, CommandEndSymbol) + CommandEndSymbol
+}
+
+// collapseWhitespace replaces each sequence of spaces and tabs with single space.
+func collapseWhitespace(value string) string {
+	var builder strings.Builder
+	whitespace := false
+	for _, char := range value {
+		if char == ' ' || char == '\t' {
+			whitespace = true
+			continue
+		}
+		if whitespace {
+			builder.WriteByte(' ')
+			whitespace = false
+		}
+		builder.WriteRune(char)
+	}
+	if whitespace {
+		builder.WriteByte(' ')
+	}
+
+	return builder.String()
+}
+
+// removeDkimSignatureValue empties b= tag of signature field, other tags are kept untouched.
+func removeDkimSignatureValue(value string) string {
+	tags := strings.Split(value, ";")
+	for i, tag := range tags {
+		if index := strings.Index(tag, "="); index >= 0 && strings.TrimSpace(tag[:index]) == "b" {
+			tags[i] = tag[:index+1]
+		}
+	}
+
+	return strings.Join(tags, ";")
+}
+
+// parseDkimTags parses "tag=value" list separated by semicolons (rfc6376 section 3.2).
+func parseDkimTags(list string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, spec := range strings.Split(list, ";") {
+		spec = strings.TrimSpace(spec)
+		if len(spec) == 0 {
+			continue
+		}
+
+		index := strings.Index(spec, "=")
+		if index < 1 {
+			return nil, fmt.Errorf("malformed tag %q", spec)
+		}
+		name := strings.TrimSpace(spec[:index])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(spec[index+1:])
+	}
+
+	return tags, nil
+}
+
+func containsDkimTagValue(list string, value string) bool {
+	for _, item := range strings.Split(list, ":") {
+		if strings.EqualFold(strings.TrimSpace(item), value) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDkimCanonicalization(canonicalization string) bool {
+	return canonicalization == DkimSimple || canonicalization == DkimRelaxed
+}
+
+func removeWhitespace(value string) string {
+	return strings.Map(func(char rune) rune {
+		if char == ' ' || char == '\t' || char == '\r' || char == '\n' {
+			return -1
+		}
+		return char
+	}, value)
+}
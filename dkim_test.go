@@ -0,0 +1,260 @@
+package smtpServerProtocol
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"github.com/mailhedgehog/gounit"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testDkimRsaKey, _ = rsa.GenerateKey(rand.Reader, 1024)
+var _, testDkimEd25519Key, _ = ed25519.GenerateKey(rand.Reader)
+
+const testDkimOrigin = "From: Joe <joe@example.org>\r\n" +
+	"To: admin@example.com\r\n" +
+	"Subject:  Is dinner  ready?\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n"
+
+func createDkimResolver() *MemoryResolver {
+	rsaKey, _ := x509.MarshalPKIXPublicKey(&testDkimRsaKey.PublicKey)
+
+	resolver := CreateMemoryResolver()
+	resolver.TXT["rsa._domainkey.example.org"] = []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaKey)}
+	resolver.TXT["ed._domainkey.example.org"] = []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(testDkimEd25519Key.Public().(ed25519.PublicKey))}
+	resolver.TXT["revoked._domainkey.example.org"] = []string{"v=DKIM1; p="}
+	resolver.Failing["broken._domainkey.example.org"] = true
+
+	return resolver
+}
+
+// signTestDkim prepends DKIM-Signature header to origin, bodyLength -1 means whole body.
+func signTestDkim(origin string, selector string, canonicalization string, bodyLength int, extraTags string) string {
+	headers, body := splitMessage(origin)
+	parts := strings.Split(canonicalization, "/")
+
+	algorithm := DkimRsaSha256
+	var signer crypto.Signer = testDkimRsaKey
+	var signerHash crypto.Hash = crypto.SHA256
+	if selector == "ed" {
+		algorithm = DkimEd25519Sha256
+		signer = testDkimEd25519Key
+		signerHash = crypto.Hash(0)
+	}
+
+	canonicalBody := canonicalizeBody(body, parts[1])
+	if bodyLength >= 0 {
+		canonicalBody = canonicalBody[:bodyLength]
+		extraTags += fmt.Sprintf(" l=%d;", bodyLength)
+	}
+	bodyHash := sha256.Sum256([]byte(canonicalBody))
+
+	value := fmt.Sprintf(" v=1; a=%s; c=%s; d=example.org; s=%s;%s\r\n\th=From:Subject; bh=%s;\r\n\tb=",
+		algorithm, canonicalization, selector, extraTags, base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	signature := &dkimSignature{headerCanonicalization: parts[0], headers: []string{"from", "subject"}}
+	digest := signature.headersHash(headers, headerField{name: "DKIM-Signature", value: value}).Sum(nil)
+	signed, _ := signer.Sign(rand.Reader, digest, signerHash)
+
+	return "DKIM-Signature:" + value + base64.StdEncoding.EncodeToString(signed) + "\r\n" + origin
+}
+
+func TestCanonicalization(t *testing.T) {
+	// Example from rfc6376 section 3.4.6.
+	headers, body := splitMessage("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n")
+
+	(*gounit.T)(t).AssertEqualsString("a:X\r\n", canonicalizeHeader(headers[0], DkimRelaxed))
+	(*gounit.T)(t).AssertEqualsString("b:Y Z\r\n", canonicalizeHeader(headers[1], DkimRelaxed))
+	(*gounit.T)(t).AssertEqualsString(" C\r\nD E\r\n", canonicalizeBody(body, DkimRelaxed))
+
+	(*gounit.T)(t).AssertEqualsString("A: X\r\n", canonicalizeHeader(headers[0], DkimSimple))
+	(*gounit.T)(t).AssertEqualsString("B : Y\t\r\n\tZ  \r\n", canonicalizeHeader(headers[1], DkimSimple))
+	(*gounit.T)(t).AssertEqualsString(" C \r\nD \t E\r\n", canonicalizeBody(body, DkimSimple))
+
+	(*gounit.T)(t).AssertEqualsString("\r\n", canonicalizeBody("", DkimSimple))
+	(*gounit.T)(t).AssertEqualsString("", canonicalizeBody("\r\n\r\n", DkimRelaxed))
+}
+
+func TestVerifyDkimRfc8463Example(t *testing.T) {
+	resolver := CreateMemoryResolver()
+	resolver.TXT["brisbane._domainkey.football.example.com"] = []string{"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="}
+
+	origin := "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+		" subject : date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+		" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+		"From: Joe SixPack <joe@football.example.com>\r\n" +
+		"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+		"Subject: Is dinner ready?\r\n" +
+		"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+		"\r\n" +
+		"Hi.\r\n\r\nWe lost the game.  Are you hungry yet?\r\n\r\nJoe."
+
+	results := VerifyDkim(resolver, origin, fixedClock())
+	(*gounit.T)(t).AssertEqualsInt(1, len(results))
+	(*gounit.T)(t).AssertEqualsString(string(DkimPass), string(results[0].Status))
+	(*gounit.T)(t).AssertEqualsString("football.example.com", results[0].Domain)
+	(*gounit.T)(t).AssertEqualsString("brisbane", results[0].Selector)
+	(*gounit.T)(t).AssertEqualsString("/gCrinpc", results[0].Signature)
+}
+
+func TestVerifyDkim(t *testing.T) {
+	resolver := createDkimResolver()
+
+	for _, selector := range []string{"rsa", "ed"} {
+		for _, canonicalization := range []string{"simple/simple", "relaxed/relaxed", "relaxed/simple"} {
+			results := VerifyDkim(resolver, signTestDkim(testDkimOrigin, selector, canonicalization, -1, ""), fixedClock())
+			(*gounit.T)(t).AssertEqualsInt(1, len(results))
+			(*gounit.T)(t).AssertEqualsString(string(DkimPass), string(results[0].Status))
+			(*gounit.T)(t).AssertEqualsString("example.org", results[0].Domain)
+			(*gounit.T)(t).AssertEqualsString("@example.org", results[0].Identity)
+		}
+	}
+
+	(*gounit.T)(t).AssertEqualsInt(0, len(VerifyDkim(resolver, testDkimOrigin, fixedClock())))
+}
+
+func TestVerifyDkimModifiedMessage(t *testing.T) {
+	resolver := createDkimResolver()
+
+	relaxed := signTestDkim(testDkimOrigin, "rsa", "relaxed/relaxed", -1, "")
+	relaxed = strings.Replace(relaxed, "Subject:  Is dinner  ready?", "subject : Is\tdinner ready? ", 1)
+	relaxed = strings.Replace(relaxed, "hungry yet?\r\n", "hungry  yet? \r\n\r\n", 1)
+	(*gounit.T)(t).AssertEqualsString(string(DkimPass), string(VerifyDkim(resolver, relaxed, fixedClock())[0].Status))
+
+	simple := signTestDkim(testDkimOrigin, "rsa", "simple/simple", -1, "")
+	modifiedBody := VerifyDkim(resolver, strings.Replace(simple, "hungry yet?", "hungry  yet?", 1), fixedClock())
+	(*gounit.T)(t).AssertEqualsString(string(DkimFail), string(modifiedBody[0].Status))
+	(*gounit.T)(t).AssertEqualsString("body hash did not verify", modifiedBody[0].Reason)
+
+	modifiedHeader := VerifyDkim(resolver, strings.Replace(simple, "Subject:  Is dinner  ready?", "Subject: Is dinner ready?", 1), fixedClock())
+	(*gounit.T)(t).AssertEqualsString(string(DkimFail), string(modifiedHeader[0].Status))
+	(*gounit.T)(t).AssertEqualsString("signature did not verify", modifiedHeader[0].Reason)
+
+	// Not signed headers can be changed.
+	(*gounit.T)(t).AssertEqualsString(string(DkimPass), string(VerifyDkim(resolver, strings.Replace(simple, "To: admin@example.com", "To: other@example.com", 1), fixedClock())[0].Status))
+}
+
+func TestVerifyDkimBodyLength(t *testing.T) {
+	resolver := createDkimResolver()
+
+	signed := signTestDkim(testDkimOrigin, "ed", "simple/simple", 5, "")
+	(*gounit.T)(t).AssertEqualsString(string(DkimPass), string(VerifyDkim(resolver, signed+"Appended content\r\n", fixedClock())[0].Status))
+
+	results := VerifyDkim(resolver, strings.Replace(signed, "l=5;", "l=5000;", 1), fixedClock())
+	(*gounit.T)(t).AssertEqualsString(string(DkimFail), string(results[0].Status))
+	(*gounit.T)(t).AssertEqualsString("body shorter than l= tag", results[0].Reason)
+}
+
+func TestVerifyDkimErrors(t *testing.T) {
+	resolver := createDkimResolver()
+
+	tests := map[string]DkimStatus{
+		signTestDkim(testDkimOrigin, "missing", "simple/simple", -1, ""):                                   DkimPermError,
+		signTestDkim(testDkimOrigin, "revoked", "simple/simple", -1, ""):                                   DkimPermError,
+		signTestDkim(testDkimOrigin, "broken", "simple/simple", -1, ""):                                    DkimTempError,
+		signTestDkim(testDkimOrigin, "rsa", "simple/simple", -1, " x=1000;"):                               DkimFail,
+		signTestDkim(testDkimOrigin, "rsa", "simple/simple", -1, " i=joe@example.net;"):                    DkimNeutral,
+		signTestDkim(testDkimOrigin, "rsa", "simple/simple", -1, " i=joe@mail.example.org;"):               DkimPass,
+		signTestDkim(testDkimOrigin, "rsa", "unknown/simple", -1, ""):                                      DkimNeutral,
+		"DKIM-Signature: v=1; a=rsa-sha256; d=example.org; s=rsa\r\n" + testDkimOrigin:                     DkimNeutral,
+		"DKIM-Signature: v=1; a=rsa-sha1; d=example.org; s=rsa; h=from; bh=; b=YQ==\r\n" + testDkimOrigin:  DkimNeutral,
+		strings.Replace(signTestDkim(testDkimOrigin, "ed", "simple/simple", -1, ""), "s=ed;", "s=rsa;", 1): DkimPermError,
+	}
+
+	for origin, expected := range tests {
+		results := VerifyDkim(resolver, origin, fixedClock())
+		if len(results) != 1 || results[0].Status != expected {
+			t.Errorf("Expected %s for:\n%s\ngot: %+v", expected, origin, results)
+		}
+	}
+}
+
+func TestDkimPolicy(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.AddPolicy(&DkimPolicy{Resolver: createDkimResolver()})
+
+	signed := signTestDkim(testDkimOrigin, "rsa", "relaxed/relaxed", -1, "")
+	lines := append([]string{"HELO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>", "DATA"},
+		strings.Split(signed, "\r\n")...)
+	message := sendTestMessage(protocol, append(lines, ".")...)
+
+	results := protocol.Session().DkimResults
+	(*gounit.T)(t).AssertEqualsInt(1, len(results))
+	(*gounit.T)(t).AssertEqualsString(string(DkimPass), string(results[0].Status))
+	(*gounit.T)(t).AssertTrue(strings.HasPrefix(message.GetOrigin(), "Authentication-Results: mx.example.com;\r\n"+
+		"\tdkim=pass header.d=example.org header.i=@example.org header.s=rsa header.a=rsa-sha256 header.b="+results[0].Signature+"\r\n"+
+		"DKIM-Signature: v=1;"))
+
+	message = sendTestMessage(protocol, "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>", "DATA", "Subject: test", "", "body", ".")
+	(*gounit.T)(t).AssertEqualsInt(0, len(protocol.Session().DkimResults))
+	(*gounit.T)(t).AssertEqualsString("Authentication-Results: mx.example.com;\r\n\tdkim=none\r\nSubject: test\r\n\r\nbody", message.GetOrigin())
+}
+
+func TestDkimSignatureExpiration(t *testing.T) {
+	resolver := createDkimResolver()
+	expiration := fixedClock().Add(time.Hour).Unix()
+	signed := signTestDkim(testDkimOrigin, "rsa", "simple/simple", -1, fmt.Sprintf(" x=%d;", expiration))
+
+	(*gounit.T)(t).AssertEqualsString(string(DkimPass), string(VerifyDkim(resolver, signed, fixedClock())[0].Status))
+	(*gounit.T)(t).AssertEqualsString(string(DkimFail), string(VerifyDkim(resolver, signed, fixedClock().Add(2*time.Hour))[0].Status))
+}
+
+// TestVerifyDkimRfc8463 verifies signatures from rfc8463 appendix A, they are created by other implementation,
+// so canonicalization errors do not cancel out as in tests what sign messages using same code.
+func TestVerifyDkimRfc8463(t *testing.T) {
+	resolver := CreateMemoryResolver()
+	resolver.TXT["brisbane._domainkey.football.example.com"] = []string{"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="}
+	resolver.TXT["test._domainkey.football.example.com"] = []string{"v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDkHlOQoBTzWRiGs5V6NpP3idY6Wk08a5qhdR6wy5bdOKb2jLQiY/J16JYi0Qvx/byYzCNb3W91y3FutACDfzwQ/BC/e/8uBsCR+yz1Lxj+PL6lHvqMKrM3rG4hstT5QjvHO9PzoxZyVYLzBfO2EeC3Ip3G+2kryOTIKT+l/K4w3QIDAQAB"}
+	origin := "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+		" subject : date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+		" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+		"DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=test; t=1528637909; h=from : to : subject :\r\n" +
+		" date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=F45dVWDfMbQDGHJFlXUNB2HKfbCeLRyhDXgFpEL8GwpsRe0IeIixNTe3\r\n" +
+		" DhCVlUrSjV4BwcVcOF6+FF3Zo9Rpo1tFOeS9mPYQTnGdaSGsgeefOsk2Jz\r\n" +
+		" dA+L10TeYt9BgDfQNZtKdN1WO//KgIqXP7OdEFE4LjFYNcUxZQ4FADY+8=\r\n" +
+		"From: Joe SixPack <joe@football.example.com>\r\n" +
+		"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+		"Subject: Is dinner ready?\r\n" +
+		"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+		"\r\n" +
+		"Hi.\r\n" +
+		"\r\n" +
+		"We lost the game.  Are you hungry yet?\r\n" +
+		"\r\n" +
+		"Joe.\r\n"
+	results := VerifyDkim(resolver, origin, time.Now())
+	(*gounit.T)(t).AssertEqualsInt(2, len(results))
+	(*gounit.T)(t).AssertEqualsString(string(DkimPass), string(results[0].Status))
+	(*gounit.T)(t).AssertEqualsString(DkimEd25519Sha256, results[0].Algorithm)
+	(*gounit.T)(t).AssertEqualsString(string(DkimPass), string(results[1].Status))
+	(*gounit.T)(t).AssertEqualsString(DkimRsaSha256, results[1].Algorithm)
+
+	results = VerifyDkim(resolver, strings.Replace(origin, "Subject: Is dinner ready?", "Subject: Is lunch ready?", 1), time.Now())
+	(*gounit.T)(t).AssertEqualsString(string(DkimFail), string(results[0].Status))
+	(*gounit.T)(t).AssertEqualsString(string(DkimFail), string(results[1].Status))
+}
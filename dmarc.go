@@ -0,0 +1,284 @@
+package smtpServerProtocol
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/mail"
+	"strconv"
+	"strings"
+)
+
+// DmarcStatus represents result of DMARC evaluation (rfc7489 section 11.2).
+type DmarcStatus string
+
+const (
+	DmarcNone      = DmarcStatus("none")
+	DmarcPass      = DmarcStatus("pass")
+	DmarcFail      = DmarcStatus("fail")
+	DmarcTempError = DmarcStatus("temperror")
+	DmarcPermError = DmarcStatus("permerror")
+)
+
+// List of policies what domain owner can request for messages what failed DMARC.
+const (
+	DmarcDispositionNone       = "none"
+	DmarcDispositionQuarantine = "quarantine"
+	DmarcDispositionReject     = "reject"
+)
+
+// DmarcResult is result of DMARC evaluation of message.
+type DmarcResult struct {
+	Status DmarcStatus
+	// Domain is domain of From header.
+	Domain string
+	// Policy is requested policy (p= or sp= tag), empty when domain has no DMARC record.
+	Policy string
+	// Disposition is policy what should be applied to message, "none" for passed messages
+	// or when message was not selected by pct= tag.
+	Disposition string
+	// Reason describes why evaluation failed.
+	Reason string
+}
+
+// dmarcRecord is parsed DMARC policy record (rfc7489 section 6.3).
+type dmarcRecord struct {
+	policy          string
+	subdomainPolicy string
+	strictDkim      bool
+	strictSpf       bool
+	percent         int
+}
+
+// CheckDmarc evaluates DMARC policy of From header domain (rfc7489 section 6.6) using SPF result
+// of envelope sender domain and DKIM signatures results.
+func CheckDmarc(resolver Resolver, fromDomain string, spfResult SpfResult, spfDomain string, dkimResults []DkimResult) DmarcResult {
+	fromDomain = normalizeDnsName(fromDomain)
+	result := DmarcResult{
+		Status:      DmarcNone,
+		Domain:      fromDomain,
+		Disposition: DmarcDispositionNone,
+	}
+
+	ctx, cancel := lookupContext()
+	defer cancel()
+
+	// Policy of organizational domain used when From domain does not publish own record.
+	record, err := lookupDmarcRecord(ctx, resolver, fromDomain)
+	organizationalDomain := OrganizationalDomain(fromDomain)
+	subdomain := false
+	if err == nil && record == nil && organizationalDomain != fromDomain {
+		record, err = lookupDmarcRecord(ctx, resolver, organizationalDomain)
+		subdomain = true
+	}
+	if err != nil {
+		result.Status = DmarcTempError
+		result.Reason = err.Error()
+		return result
+	}
+	if record == nil {
+		return result
+	}
+
+	result.Policy = record.policy
+	if subdomain && len(record.subdomainPolicy) > 0 {
+		result.Policy = record.subdomainPolicy
+	}
+
+	result.Status = DmarcPass
+	if spfResult == SpfPass && isDmarcAligned(spfDomain, fromDomain, record.strictSpf) {
+		return result
+	}
+	for _, dkimResult := range dkimResults {
+		if dkimResult.Status == DkimPass && isDmarcAligned(dkimResult.Domain, fromDomain, record.strictDkim) {
+			return result
+		}
+	}
+
+	result.Status = DmarcFail
+	result.Disposition = result.Policy
+	// Messages not selected by pct= tag get less strict policy (rfc7489 section 6.6.4).
+	if record.percent < 100 && randomPercent() >= record.percent {
+		switch result.Policy {
+		case DmarcDispositionReject:
+			result.Disposition = DmarcDispositionQuarantine
+		case DmarcDispositionQuarantine:
+			result.Disposition = DmarcDispositionNone
+		}
+	}
+
+	return result
+}
+
+// randomPercent returns random number in range [0, 100) used for pct= sampling, crypto/rand used
+// as global math/rand generator is not seeded in go 1.19, so sampling would be predictable.
+func randomPercent() int {
+	value, err := rand.Int(rand.Reader, big.NewInt(100))
+	if err != nil {
+		return 0
+	}
+	return int(value.Int64())
+}
+
+// lookupDmarcRecord returns nil when domain has no valid DMARC record.
+func lookupDmarcRecord(ctx context.Context, resolver Resolver, domain string) (*dmarcRecord, error) {
+	txts, err := resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.New("policy unavailable for " + domain)
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=DMARC1") {
+			records = append(records, txt)
+		}
+	}
+	if len(records) != 1 {
+		return nil, nil
+	}
+
+	tags, err := parseDkimTags(records[0])
+	if err != nil || tags["v"] != "DMARC1" {
+		return nil, nil
+	}
+
+	record := &dmarcRecord{
+		policy:          strings.ToLower(tags["p"]),
+		subdomainPolicy: strings.ToLower(tags["sp"]),
+		strictDkim:      strings.EqualFold(tags["adkim"], "s"),
+		strictSpf:       strings.EqualFold(tags["aspf"], "s"),
+		percent:         100,
+	}
+	if !isDmarcDisposition(record.policy) {
+		// Record with reporting address still requests reports (rfc7489 section 6.6.3).
+		if len(tags["rua"]) == 0 {
+			return nil, nil
+		}
+		record.policy = DmarcDispositionNone
+	}
+	if !isDmarcDisposition(record.subdomainPolicy) {
+		record.subdomainPolicy = ""
+	}
+	if percent, err := strconv.Atoi(tags["pct"]); err == nil && percent >= 0 && percent <= 100 {
+		record.percent = percent
+	}
+
+	return record, nil
+}
+
+// isDmarcAligned checks identifier alignment (rfc7489 section 3.1), in relaxed
+// mode domains with same organizational domain are aligned.
+func isDmarcAligned(domain string, fromDomain string, strict bool) bool {
+	domain = normalizeDnsName(domain)
+	if len(domain) == 0 {
+		return false
+	}
+	if strict {
+		return domain == fromDomain
+	}
+	return OrganizationalDomain(domain) == OrganizationalDomain(fromDomain)
+}
+
+func isDmarcDisposition(disposition string) bool {
+	return disposition == DmarcDispositionNone ||
+		disposition == DmarcDispositionQuarantine ||
+		disposition == DmarcDispositionReject
+}
+
+// messageFromDomain returns domain of single author from From header.
+func messageFromDomain(headers []headerField) (string, error) {
+	domain := ""
+	fromFields := 0
+	for _, field := range headers {
+		if !strings.EqualFold(field.fieldName(), "From") {
+			continue
+		}
+		fromFields++
+
+		addresses, err := mail.ParseAddressList(strings.ReplaceAll(field.value, CommandEndSymbol, ""))
+		if err != nil {
+			return "", errors.New("malformed From field")
+		}
+		for _, address := range addresses {
+			addressDomain := normalizeDnsName(address.Address[strings.LastIndex(address.Address, "@")+1:])
+			if len(domain) > 0 && addressDomain != domain {
+				return "", errors.New("multiple From domains")
+			}
+			domain = addressDomain
+		}
+	}
+
+	if fromFields != 1 || len(domain) == 0 {
+		return "", errors.New("message must contain single From field")
+	}
+
+	return domain, nil
+}
+
+// DmarcPolicy evaluates DMARC of received message, result stored in Session.DmarcResult
+// and added to Authentication-Results header. SPF and DKIM checked by policy itself,
+// when SpfPolicy and DkimPolicy were not added before, DkimPolicy added after does not
+// verify message again.
+type DmarcPolicy struct {
+	Resolver Resolver
+	// Enforce rejects or quarantines message when it failed DMARC and domain policy requests it.
+	Enforce bool
+}
+
+// CreateDmarcPolicy creates policy what uses DefaultResolver.
+func CreateDmarcPolicy(enforce bool) *DmarcPolicy {
+	return &DmarcPolicy{
+		Resolver: DefaultResolver,
+		Enforce:  enforce,
+	}
+}
+
+func (policy *DmarcPolicy) CheckData(protocol *Protocol, origin string) *Reply {
+	session := protocol.Session()
+
+	if !protocol.hasAuthenticationResult("spf") {
+		(&SpfPolicy{Resolver: policy.Resolver}).check(protocol, protocol.message.From)
+	}
+	if !protocol.hasAuthenticationResult("dkim") {
+		(&DkimPolicy{Resolver: policy.Resolver}).CheckData(protocol, origin)
+	}
+
+	headers, _ := splitMessage(origin)
+	fromDomain, err := messageFromDomain(headers)
+	if err != nil {
+		session.DmarcResult = DmarcResult{Status: DmarcPermError, Disposition: DmarcDispositionNone, Reason: err.Error()}
+	} else {
+		session.DmarcResult = CheckDmarc(policy.Resolver, fromDomain, session.SpfResult, session.SpfDomain, session.DkimResults)
+	}
+	protocol.AddAuthenticationResult(session.DmarcResult.authenticationResult())
+
+	if policy.Enforce && session.DmarcResult.Disposition == DmarcDispositionReject {
+		return ReplyMailbox404(fmt.Sprintf("5.7.1 Rejected by DMARC policy for %s", session.DmarcResult.Domain))
+	}
+	if policy.Enforce && session.DmarcResult.Disposition == DmarcDispositionQuarantine {
+		protocol.Quarantine(fmt.Sprintf("Quarantined by DMARC policy for %s", session.DmarcResult.Domain))
+	}
+
+	return nil
+}
+
+// authenticationResult formats result as "resinfo" of Authentication-Results header.
+func (result DmarcResult) authenticationResult() string {
+	resinfo := "dmarc=" + string(result.Status)
+	if len(result.Reason) > 0 {
+		resinfo += fmt.Sprintf(" reason=%q", result.Reason)
+	}
+	if len(result.Policy) > 0 {
+		resinfo += fmt.Sprintf(" (p=%s dis=%s)", result.Policy, result.Disposition)
+	}
+	if len(result.Domain) > 0 {
+		resinfo += " header.from=" + result.Domain
+	}
+
+	return resinfo
+}
@@ -0,0 +1,185 @@
+package smtpServerProtocol
+
+import (
+	"github.com/mailhedgehog/gounit"
+	"github.com/mailhedgehog/smtpMessage"
+	"net"
+	"strings"
+	"testing"
+)
+
+func createDmarcResolver() *MemoryResolver {
+	resolver := createDkimResolver()
+	resolver.TXT["example.org"] = []string{"v=spf1 ip4:192.0.2.0/24 -all"}
+	resolver.TXT["_dmarc.example.org"] = []string{"v=DMARC1; p=reject; sp=quarantine; adkim=s; rua=mailto:dmarc@example.org"}
+	resolver.TXT["_dmarc.example.net"] = []string{"v=DMARC1; p=unknown; rua=mailto:dmarc@example.net"}
+	resolver.TXT["_dmarc.example.com"] = []string{"v=DMARC1; p=reject; pct=0"}
+	resolver.TXT["_dmarc.invalid.example"] = []string{"v=DMARC1; p=unknown"}
+	resolver.TXT["_dmarc.multiple.example"] = []string{"v=DMARC1; p=reject", "v=DMARC1; p=none"}
+	resolver.Failing["_dmarc.broken.example"] = true
+
+	return resolver
+}
+
+func TestCheckDmarc(t *testing.T) {
+	resolver := createDmarcResolver()
+	dkimPass := []DkimResult{{Status: DkimPass, Domain: "example.org"}}
+	dkimNotAligned := []DkimResult{{Status: DkimPass, Domain: "mail.example.org"}, {Status: DkimFail, Domain: "example.org"}}
+
+	result := CheckDmarc(resolver, "example.org", SpfPass, "bounce.example.org", nil)
+	(*gounit.T)(t).AssertEqualsString(string(DmarcPass), string(result.Status))
+	(*gounit.T)(t).AssertEqualsString(DmarcDispositionReject, result.Policy)
+	(*gounit.T)(t).AssertEqualsString(DmarcDispositionNone, result.Disposition)
+
+	result = CheckDmarc(resolver, "example.org", SpfPass, "example.net", dkimPass)
+	(*gounit.T)(t).AssertEqualsString(string(DmarcPass), string(result.Status))
+
+	result = CheckDmarc(resolver, "Example.org", SpfFail, "example.org", dkimNotAligned)
+	(*gounit.T)(t).AssertEqualsString(string(DmarcFail), string(result.Status))
+	(*gounit.T)(t).AssertEqualsString("example.org", result.Domain)
+	(*gounit.T)(t).AssertEqualsString(DmarcDispositionReject, result.Disposition)
+
+	result = CheckDmarc(resolver, "news.example.org", SpfNone, "", nil)
+	(*gounit.T)(t).AssertEqualsString(string(DmarcFail), string(result.Status))
+	(*gounit.T)(t).AssertEqualsString(DmarcDispositionQuarantine, result.Policy)
+
+	result = CheckDmarc(resolver, "example.net", SpfNone, "", nil)
+	(*gounit.T)(t).AssertEqualsString(string(DmarcFail), string(result.Status))
+	(*gounit.T)(t).AssertEqualsString(DmarcDispositionNone, result.Disposition)
+
+	result = CheckDmarc(resolver, "example.com", SpfNone, "", nil)
+	(*gounit.T)(t).AssertEqualsString(string(DmarcFail), string(result.Status))
+	(*gounit.T)(t).AssertEqualsString(DmarcDispositionReject, result.Policy)
+	(*gounit.T)(t).AssertEqualsString(DmarcDispositionQuarantine, result.Disposition)
+
+	for _, domain := range []string{"none.example", "invalid.example", "multiple.example"} {
+		(*gounit.T)(t).AssertEqualsString(string(DmarcNone), string(CheckDmarc(resolver, domain, SpfNone, "", nil).Status))
+	}
+	(*gounit.T)(t).AssertEqualsString(string(DmarcTempError), string(CheckDmarc(resolver, "broken.example", SpfPass, "broken.example", nil).Status))
+}
+
+func TestMessageFromDomain(t *testing.T) {
+	domains := map[string]string{
+		"From: Joe <joe@Example.org>\r\n\r\n":                    "example.org",
+		"From: joe@example.org,\r\n\tjane@example.org\r\n\r\n":   "example.org",
+		"From: =?utf-8?q?J=C3=B6e?= <joe@example.org>\r\n\r\n":   "example.org",
+		"From: joe@example.org, jane@example.net\r\n\r\n":        "",
+		"From: joe@example.org\r\nFrom: joe@example.org\r\n\r\n": "",
+		"From: not an address\r\n\r\n":                           "",
+		"Subject: test\r\n\r\n":                                  "",
+	}
+
+	for origin, expected := range domains {
+		headers, _ := splitMessage(origin)
+		domain, err := messageFromDomain(headers)
+		(*gounit.T)(t).AssertEqualsString(expected, domain)
+		if len(expected) == 0 {
+			(*gounit.T)(t).ExpectError(err)
+		}
+	}
+}
+
+func TestDmarcPolicy(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, nil)
+	protocol.AddPolicy(&DmarcPolicy{Resolver: createDmarcResolver()})
+
+	message := sendTestMessage(protocol, "EHLO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>",
+		"DATA", "From: Joe <joe@example.org>", "", "body", ".")
+
+	(*gounit.T)(t).AssertEqualsString("Authentication-Results: mx.example.com;\r\n"+
+		"\tspf=pass smtp.mailfrom=example.org;\r\n"+
+		"\tdkim=none;\r\n"+
+		"\tdmarc=pass (p=reject dis=none) header.from=example.org\r\n"+
+		"From: Joe <joe@example.org>\r\n\r\nbody", message.GetOrigin())
+	(*gounit.T)(t).AssertEqualsString(string(DmarcPass), string(protocol.Session().DmarcResult.Status))
+
+	message = sendTestMessage(protocol, "MAIL FROM:<>", "RCPT TO:<admin@example.com>",
+		"DATA", "Subject: test", "", "body", ".")
+	(*gounit.T)(t).AssertEqualsString("Authentication-Results: mx.example.com;\r\n"+
+		"\tspf=none smtp.helo=client.example.org;\r\n"+
+		"\tdkim=none;\r\n"+
+		"\tdmarc=permerror reason=\"message must contain single From field\"\r\n"+
+		"Subject: test\r\n\r\nbody", message.GetOrigin())
+}
+
+func TestDmarcPolicyEnforce(t *testing.T) {
+	resolver := createDmarcResolver()
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("198.51.100.1")}, nil)
+	protocol.AddPolicy(&SpfPolicy{Resolver: resolver})
+	protocol.AddPolicy(&DkimPolicy{Resolver: resolver})
+	protocol.AddPolicy(&DmarcPolicy{Resolver: resolver, Enforce: true})
+
+	var replies []*Reply
+	protocol.OnMessageReceived(func(message *smtpMessage.SmtpMessage) (string, error) {
+		t.Error("Message failed DMARC should not be received")
+		return "", nil
+	})
+	for _, line := range []string{"EHLO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>", "DATA", "From: joe@example.org", "", "body", "."} {
+		replies = append(replies, protocol.HandleReceivedLine(line))
+	}
+
+	reply := replies[len(replies)-1]
+	(*gounit.T)(t).AssertEqualsInt(CODE_MAILBOX_404, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("5.7.1 Rejected by DMARC policy for example.org", reply.lines[0])
+	(*gounit.T)(t).AssertEqualsString(string(SpfFail), string(protocol.Session().SpfResult))
+	(*gounit.T)(t).AssertEqualsString(string(DmarcFail), string(protocol.Session().DmarcResult.Status))
+
+	// DKIM signature aligned with From domain passes DMARC even if SPF failed.
+	signed := signTestDkim("From: joe@example.org\r\n\r\nbody\r\n", "rsa", "relaxed/relaxed", -1, "")
+	var received *smtpMessage.SmtpMessage
+	protocol.OnMessageReceived(func(message *smtpMessage.SmtpMessage) (string, error) {
+		received = message
+		return "id", nil
+	})
+	for _, line := range append([]string{"MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>", "DATA"}, strings.Split(signed, "\r\n")...) {
+		protocol.HandleReceivedLine(line)
+	}
+	reply = protocol.HandleReceivedLine(".")
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, reply.Status)
+	(*gounit.T)(t).AssertEqualsInt(1, strings.Count(received.GetOrigin(), "spf="))
+	(*gounit.T)(t).AssertTrue(strings.Contains(received.GetOrigin(), "\tdmarc=pass (p=reject dis=none) header.from=example.org\r\n"))
+}
+
+func TestDmarcPolicyBeforeDkimPolicy(t *testing.T) {
+	resolver := createDmarcResolver()
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, nil)
+	protocol.AddPolicy(&DmarcPolicy{Resolver: resolver})
+	protocol.AddPolicy(&DkimPolicy{Resolver: resolver})
+
+	signed := signTestDkim("From: joe@example.org\r\n\r\nbody\r\n", "rsa", "relaxed/relaxed", -1, "")
+	lines := append([]string{"EHLO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>", "DATA"}, strings.Split(signed, "\r\n")...)
+	message := sendTestMessage(protocol, append(lines, ".")...)
+
+	(*gounit.T)(t).AssertEqualsInt(1, strings.Count(message.GetOrigin(), "dkim="))
+	(*gounit.T)(t).AssertEqualsInt(1, len(protocol.Session().DkimResults))
+	(*gounit.T)(t).AssertEqualsString(string(DkimPass), string(protocol.Session().DkimResults[0].Status))
+}
+
+func TestDmarcPolicyEnforceQuarantine(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("198.51.100.1")}, nil)
+	protocol.AddPolicy(&DmarcPolicy{Resolver: createDmarcResolver(), Enforce: true})
+
+	quarantineReason := ""
+	protocol.OnMessageReceived(func(message *smtpMessage.SmtpMessage) (string, error) {
+		quarantineReason = protocol.QuarantineReason()
+		return "id", nil
+	})
+	var reply *Reply
+	for _, line := range []string{"EHLO client.example.org", "MAIL FROM:<joe@news.example.org>", "RCPT TO:<admin@example.com>", "DATA", "From: joe@news.example.org", "", "body", "."} {
+		reply = protocol.HandleReceivedLine(line)
+	}
+
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, reply.Status)
+	(*gounit.T)(t).AssertEqualsString(DmarcDispositionQuarantine, protocol.Session().DmarcResult.Disposition)
+	(*gounit.T)(t).AssertEqualsString("Quarantined by DMARC policy for news.example.org", quarantineReason)
+}
+
+func TestRandomPercent(t *testing.T) {
+	values := map[int]bool{}
+	for i := 0; i < 100; i++ {
+		value := randomPercent()
+		(*gounit.T)(t).AssertTrue(value >= 0 && value < 100)
+		values[value] = true
+	}
+	(*gounit.T)(t).AssertTrue(len(values) > 1)
+}
@@ -0,0 +1,150 @@
+package smtpServerProtocol
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/mailhedgehog/smtpMessage"
+	"golang.org/x/exp/slices"
+	"net"
+	"strings"
+)
+
+// DnsblAction configures what DnsblPolicy does with listed client.
+type DnsblAction string
+
+const (
+	// DnsblActionRejectConnect rejects listed client instead of greeting.
+	DnsblActionRejectConnect = DnsblAction("reject_connect")
+	// DnsblActionRejectRcpt rejects every recipient of listed client.
+	DnsblActionRejectRcpt = DnsblAction("reject_rcpt")
+	// DnsblActionTag only stores listings in Session.DnsblListings.
+	DnsblActionTag = DnsblAction("tag")
+)
+
+// DnsblZone is a DNS block list zone, for example "zen.spamhaus.org".
+type DnsblZone struct {
+	Zone string
+	// Codes limits return codes treated as listing, empty means any 127.0.0.0/8 address.
+	Codes []string
+}
+
+// DnsblListing represents client listing found in zone.
+type DnsblListing struct {
+	Zone string
+	Code string
+}
+
+// DnsblPolicy checks client Ip against DNS block lists on connect.
+type DnsblPolicy struct {
+	Resolver Resolver
+	Zones    []DnsblZone
+	Action   DnsblAction
+}
+
+// CreateDnsblPolicy creates policy what uses DefaultResolver.
+func CreateDnsblPolicy(action DnsblAction, zones ...DnsblZone) *DnsblPolicy {
+	return &DnsblPolicy{
+		Resolver: DefaultResolver,
+		Zones:    zones,
+		Action:   action,
+	}
+}
+
+func (policy *DnsblPolicy) CheckConnect(protocol *Protocol) *Reply {
+	if protocol.Ip == nil {
+		return nil
+	}
+
+	// Several policies can share session, so listings appended instead of replacing listings of other policies.
+	protocol.Session().DnsblListings = append(protocol.Session().DnsblListings, policy.Lookup(protocol.Ip.IP)...)
+	if policy.Action == DnsblActionRejectConnect {
+		return policy.rejection(protocol)
+	}
+
+	return nil
+}
+
+func (policy *DnsblPolicy) CheckRcpt(protocol *Protocol, path *smtpMessage.MessagePath) *Reply {
+	if policy.Action == DnsblActionRejectRcpt {
+		return policy.rejection(protocol)
+	}
+
+	return nil
+}
+
+// Lookup returns listings of ip in all configured zones.
+func (policy *DnsblPolicy) Lookup(ip net.IP) []DnsblListing {
+	ctx, cancel := lookupContext()
+	defer cancel()
+
+	var listings []DnsblListing
+	for _, zone := range policy.Zones {
+		addresses, err := policy.Resolver.LookupIPAddr(ctx, DnsblQueryName(ip, zone.Zone))
+		if err != nil {
+			if !isNotFound(err) {
+				logManager().Debug(fmt.Sprintf("DNSBL lookup in %s failed: %s", zone.Zone, err.Error()))
+			}
+			continue
+		}
+
+		for _, address := range addresses {
+			code := address.IP.String()
+			if isDnsblListingCode(address.IP) && (len(zone.Codes) == 0 || slices.Contains(zone.Codes, code)) {
+				listings = append(listings, DnsblListing{Zone: zone.Zone, Code: code})
+				break
+			}
+		}
+	}
+
+	return listings
+}
+
+func (policy *DnsblPolicy) rejection(protocol *Protocol) *Reply {
+	for _, listing := range protocol.Session().DnsblListings {
+		if policy.hasZone(listing.Zone) {
+			return ReplyTransactionFailed(fmt.Sprintf(
+				"5.7.1 Service unavailable; client %s blocked using %s",
+				addressLiteral(protocol.Ip.IP),
+				listing.Zone,
+			))
+		}
+	}
+
+	return nil
+}
+
+// hasZone checks is zone configured in policy, only own listings can reject client.
+func (policy *DnsblPolicy) hasZone(name string) bool {
+	for _, zone := range policy.Zones {
+		if zone.Zone == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DnsblQueryName returns name what need to be resolved to check ip in zone, IPv4 address
+// octets and IPv6 address nibbles are used in reversed order.
+func DnsblQueryName(ip net.IP, zone string) string {
+	var parts []string
+
+	if ipv4 := ip.To4(); ipv4 != nil {
+		for i := len(ipv4) - 1; i >= 0; i-- {
+			parts = append(parts, fmt.Sprintf("%d", ipv4[i]))
+		}
+	} else {
+		nibbles := hex.EncodeToString(ip.To16())
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			parts = append(parts, string(nibbles[i]))
+		}
+	}
+
+	return strings.Join(parts, ".") + "." + normalizeDnsName(zone)
+}
+
+// isDnsblListingCode checks is answer means listing, 127.255.255.0/24 used by lists to report query errors.
+func isDnsblListingCode(ip net.IP) bool {
+	ipv4 := ip.To4()
+	return ipv4 != nil && ipv4[0] == 127 && !(ipv4[1] == 255 && ipv4[2] == 255)
+}
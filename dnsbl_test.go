@@ -0,0 +1,92 @@
+package smtpServerProtocol
+
+import (
+	"github.com/mailhedgehog/gounit"
+	"net"
+	"testing"
+)
+
+func createDnsblResolver() *MemoryResolver {
+	resolver := CreateMemoryResolver()
+	resolver.IP["1.2.0.192.zen.example.org"] = []net.IP{net.ParseIP("127.0.0.2")}
+	resolver.IP["1.2.0.192.bl.example.net"] = []net.IP{net.ParseIP("127.0.0.10")}
+	resolver.IP["2.2.0.192.zen.example.org"] = []net.IP{net.ParseIP("127.255.255.254")}
+	resolver.IP["1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.zen.example.org"] = []net.IP{net.ParseIP("127.0.0.4")}
+
+	return resolver
+}
+
+func TestDnsblQueryName(t *testing.T) {
+	(*gounit.T)(t).AssertEqualsString("1.2.0.192.zen.example.org", DnsblQueryName(net.ParseIP("192.0.2.1"), "zen.example.org."))
+	(*gounit.T)(t).AssertEqualsString(
+		"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.zen.example.org",
+		DnsblQueryName(net.ParseIP("4321:0:1:2:3:4:567:89ab"), "zen.example.org"),
+	)
+}
+
+func TestDnsblLookup(t *testing.T) {
+	policy := &DnsblPolicy{
+		Resolver: createDnsblResolver(),
+		Zones: []DnsblZone{
+			{Zone: "zen.example.org"},
+			{Zone: "bl.example.net", Codes: []string{"127.0.0.2"}},
+		},
+	}
+
+	listings := policy.Lookup(net.ParseIP("192.0.2.1"))
+	(*gounit.T)(t).AssertEqualsInt(1, len(listings))
+	(*gounit.T)(t).AssertEqualsString("zen.example.org", listings[0].Zone)
+	(*gounit.T)(t).AssertEqualsString("127.0.0.2", listings[0].Code)
+
+	(*gounit.T)(t).AssertEqualsInt(0, len(policy.Lookup(net.ParseIP("192.0.2.2"))))
+	(*gounit.T)(t).AssertEqualsInt(0, len(policy.Lookup(net.ParseIP("192.0.2.3"))))
+	(*gounit.T)(t).AssertEqualsInt(1, len(policy.Lookup(net.ParseIP("2001:db8::1"))))
+}
+
+func TestDnsblPolicyActions(t *testing.T) {
+	policy := &DnsblPolicy{Resolver: createDnsblResolver(), Zones: []DnsblZone{{Zone: "zen.example.org"}}}
+	ip := &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}
+
+	policy.Action = DnsblActionRejectConnect
+	protocol := CreateProtocol("", ip, nil)
+	protocol.AddPolicy(policy)
+	reply := protocol.SayWelcome("")
+	(*gounit.T)(t).AssertEqualsInt(CODE_TRANSACTION_FAILED, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("5.7.1 Service unavailable; client [192.0.2.1] blocked using zen.example.org", reply.lines[0])
+
+	policy.Action = DnsblActionRejectRcpt
+	protocol = CreateProtocol("", ip, nil)
+	protocol.AddPolicy(policy)
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_READY, protocol.SayWelcome("").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_TRANSACTION_FAILED, protocol.HandleReceivedLine("RCPT TO:<foo@example.com>").Status)
+	(*gounit.T)(t).AssertEqualsInt(0, len(protocol.message.To))
+
+	policy.Action = DnsblActionTag
+	protocol = CreateProtocol("", ip, nil)
+	protocol.AddPolicy(policy)
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_READY, protocol.SayWelcome("").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("RCPT TO:<foo@example.com>").Status)
+	(*gounit.T)(t).AssertEqualsInt(1, len(protocol.Session().DnsblListings))
+}
+
+func TestDnsblPoliciesKeepOwnListings(t *testing.T) {
+	ip := &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}
+	reject := &DnsblPolicy{Resolver: createDnsblResolver(), Zones: []DnsblZone{{Zone: "zen.example.org"}}, Action: DnsblActionRejectRcpt}
+	tag := &DnsblPolicy{Resolver: createDnsblResolver(), Zones: []DnsblZone{{Zone: "none.example.org"}}, Action: DnsblActionTag}
+
+	protocol := CreateProtocol("", ip, nil)
+	protocol.AddPolicy(reject)
+	protocol.AddPolicy(tag)
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_READY, protocol.SayWelcome("").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_TRANSACTION_FAILED, protocol.HandleReceivedLine("RCPT TO:<foo@example.com>").Status)
+	(*gounit.T)(t).AssertEqualsInt(1, len(protocol.Session().DnsblListings))
+
+	reject.Zones = []DnsblZone{{Zone: "none.example.org"}}
+	tag.Zones = []DnsblZone{{Zone: "zen.example.org"}}
+	protocol = CreateProtocol("", ip, nil)
+	protocol.AddPolicy(reject)
+	protocol.AddPolicy(tag)
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_READY, protocol.SayWelcome("").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("RCPT TO:<foo@example.com>").Status)
+	(*gounit.T)(t).AssertEqualsInt(1, len(protocol.Session().DnsblListings))
+}
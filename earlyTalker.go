@@ -0,0 +1,92 @@
+package smtpServerProtocol
+
+import (
+	"fmt"
+	"golang.org/x/exp/slices"
+	"strings"
+	"time"
+)
+
+// EarlyTalkerViolation represents kind of protocol synchronization violation made by client.
+type EarlyTalkerViolation string
+
+const (
+	// ViolationPreGreeting means client sent data before greeting.
+	ViolationPreGreeting = EarlyTalkerViolation("pre_greeting")
+	// ViolationPipelining means client sent data after command what must be last in pipelined group.
+	ViolationPipelining = EarlyTalkerViolation("pipelining")
+)
+
+// pipeliningSyncCommands can appear only as last command in pipelined group (rfc2920 section 3.1),
+// STARTTLS and AUTH also require reply before client continues.
+var pipeliningSyncCommands = []CommandName{
+	CommandHelo,
+	CommandEhlo,
+	CommandData,
+	CommandQuit,
+	CommandStartTls,
+	CommandAuth,
+	CommandName("VRFY"),
+	CommandName("EXPN"),
+	CommandName("TURN"),
+	CommandName("NOOP"),
+}
+
+// EarlyTalkerDetection configures detection of clients what do not wait for server replies,
+// what is typical behaviour of spam bots.
+type EarlyTalkerDetection struct {
+	// GreetingDelay is time what connection driver waits for unexpected data before greeting.
+	GreetingDelay time.Duration
+	// LogOnly reports violation to callback without rejecting session.
+	LogOnly bool
+}
+
+// SetEarlyTalkerDetection enables early talker detection in HandleReceivedData.
+func (protocol *Protocol) SetEarlyTalkerDetection(detection EarlyTalkerDetection) {
+	protocol.earlyTalkerDetection = &detection
+}
+
+// OnEarlyTalker allows to provide callback to log or score client violations.
+func (protocol *Protocol) OnEarlyTalker(callback func(violation EarlyTalkerViolation)) {
+	protocol.earlyTalkerCallback = callback
+}
+
+// GreetingDelay returns time what connection driver should wait before greeting.
+func (protocol *Protocol) GreetingDelay() time.Duration {
+	if protocol.earlyTalkerDetection == nil {
+		return 0
+	}
+	return protocol.earlyTalkerDetection.GreetingDelay
+}
+
+// isPipeliningViolation checks is client sent data without waiting reply to command from line.
+func (protocol *Protocol) isPipeliningViolation(line []byte, wasCommand bool) bool {
+	if protocol.earlyTalkerDetection == nil || !wasCommand || !protocol.HasPendingInput() {
+		return false
+	}
+	// Pipelining allowed only for clients used EHLO
+	if !protocol.isExtended() {
+		return true
+	}
+
+	command := CommandFromLine(strings.TrimRight(string(line), "\r\n"))
+
+	return slices.Contains(pipeliningSyncCommands, command.verb)
+}
+
+// reportEarlyTalker notifies callback and returns rejection reply when session should be closed.
+func (protocol *Protocol) reportEarlyTalker(violation EarlyTalkerViolation) *Reply {
+	logManager().Debug(fmt.Sprintf("Early talker detected: %s", violation))
+
+	if protocol.earlyTalkerCallback != nil {
+		protocol.earlyTalkerCallback(violation)
+	}
+	if protocol.earlyTalkerDetection.LogOnly {
+		return nil
+	}
+
+	protocol.inputBuffer = nil
+	protocol.state = StateClosed
+
+	return ReplyProtocolViolation()
+}
@@ -0,0 +1,103 @@
+package smtpServerProtocol
+
+import (
+	"bufio"
+	"github.com/mailhedgehog/gounit"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPreGreetingViolation(t *testing.T) {
+	protocol := CreateProtocol("", nil, nil)
+	protocol.SetEarlyTalkerDetection(EarlyTalkerDetection{})
+	var violations []EarlyTalkerViolation
+	protocol.OnEarlyTalker(func(violation EarlyTalkerViolation) {
+		violations = append(violations, violation)
+	})
+
+	replies := protocol.HandleReceivedData([]byte("EHLO foo\r\n"))
+	(*gounit.T)(t).AssertEqualsInt(1, len(replies))
+	(*gounit.T)(t).AssertEqualsInt(CODE_TRANSACTION_FAILED, replies[0].Status)
+	(*gounit.T)(t).AssertTrue(replies[0].ShouldClose())
+	(*gounit.T)(t).AssertEqualsInt(1, len(violations))
+	(*gounit.T)(t).AssertEqualsString(string(ViolationPreGreeting), string(violations[0]))
+}
+
+func TestPreGreetingLogOnly(t *testing.T) {
+	protocol := CreateProtocol("", nil, nil)
+	protocol.SetEarlyTalkerDetection(EarlyTalkerDetection{LogOnly: true})
+	violations := 0
+	protocol.OnEarlyTalker(func(violation EarlyTalkerViolation) {
+		violations++
+	})
+
+	(*gounit.T)(t).AssertEqualsInt(0, len(protocol.HandleReceivedData([]byte("EHLO foo\r\n"))))
+	(*gounit.T)(t).AssertEqualsInt(1, violations)
+
+	protocol.SayWelcome("")
+	replies := protocol.HandleReceivedData(nil)
+	(*gounit.T)(t).AssertEqualsInt(1, len(replies))
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, replies[0].Status)
+}
+
+func TestPipeliningViolation(t *testing.T) {
+	protocol := CreateProtocol("", nil, nil)
+	protocol.SetEarlyTalkerDetection(EarlyTalkerDetection{})
+	protocol.SayWelcome("")
+
+	replies := protocol.HandleReceivedData([]byte("EHLO foo\r\n"))
+	(*gounit.T)(t).AssertEqualsInt(1, len(replies))
+
+	replies = protocol.HandleReceivedData([]byte("MAIL FROM:<foo@bar.com>\r\nRCPT TO:<baz@example.com>\r\nDATA\r\n"))
+	(*gounit.T)(t).AssertEqualsInt(3, len(replies))
+
+	replies = protocol.HandleReceivedData([]byte("Subject: test\r\n\r\nbody\r\n.\r\nNOOP\r\nRSET\r\n"))
+	(*gounit.T)(t).AssertEqualsInt(3, len(replies))
+	(*gounit.T)(t).AssertEqualsInt(CODE_TRANSACTION_FAILED, replies[2].Status)
+	(*gounit.T)(t).AssertEqualsString(string(StateClosed), string(protocol.state))
+}
+
+func TestPipeliningViolationAfterHelo(t *testing.T) {
+	protocol := CreateProtocol("", nil, nil)
+	protocol.SetEarlyTalkerDetection(EarlyTalkerDetection{})
+	protocol.SayWelcome("")
+
+	replies := protocol.HandleReceivedData([]byte("HELO foo\r\nMAIL FROM:<foo@bar.com>\r\n"))
+	(*gounit.T)(t).AssertEqualsInt(2, len(replies))
+	(*gounit.T)(t).AssertEqualsInt(CODE_TRANSACTION_FAILED, replies[1].Status)
+}
+
+func TestConnectionGreetingDelay(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.SetEarlyTalkerDetection(EarlyTalkerDetection{GreetingDelay: 50 * time.Millisecond})
+	server, client := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- CreateConnection(server, protocol).Serve("")
+	}()
+
+	writeClientData(t, client, "EHLO spam.bot\r\n")
+	line, err := bufio.NewReader(client).ReadString('\n')
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertEqualsString("554 5.5.1 Protocol error, talking too early\r\n", line)
+	(*gounit.T)(t).AssertNotError(<-done)
+}
+
+func TestConnectionGreetingDelayNotShortenedByData(t *testing.T) {
+	delay := 100 * time.Millisecond
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.SetEarlyTalkerDetection(EarlyTalkerDetection{GreetingDelay: delay, LogOnly: true})
+	client, reader, done := startTestConnection(protocol)
+
+	start := time.Now()
+	writeClientData(t, client, "EHLO client.example.org\r\n")
+	(*gounit.T)(t).AssertEqualsString("220 mx.example.com Service ready\r\n", readReplyLine(t, reader))
+	(*gounit.T)(t).AssertTrue(time.Since(start) >= delay)
+	(*gounit.T)(t).AssertEqualsString("250-Hello client.example.org\r\n", readReplyLine(t, reader))
+	readReplyLine(t, reader)
+
+	writeClientData(t, client, "QUIT\r\n")
+	(*gounit.T)(t).AssertEqualsString("221 Bye\r\n", readReplyLine(t, reader))
+	(*gounit.T)(t).AssertNotError(<-done)
+}
@@ -0,0 +1,320 @@
+package smtpServerProtocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mailhedgehog/smtpMessage"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GreylistEntry is state of greylisting triplet or client network.
+type GreylistEntry struct {
+	// FirstSeen is time of first delivery attempt.
+	FirstSeen time.Time
+	// Passed is true when client retried after delay.
+	Passed bool
+	// Deliveries is number of messages delivered by client network.
+	Deliveries int
+	// Expires is time when entry can be removed.
+	Expires time.Time
+}
+
+// GreylistStore keeps greylisting entries, expired entries should not be returned.
+type GreylistStore interface {
+	// Get returns nil when entry is not known or expired.
+	Get(key string, now time.Time) (*GreylistEntry, error)
+	Set(key string, entry GreylistEntry) error
+}
+
+// GreylistPolicy temporarily rejects first delivery attempt of (client network, sender, recipient)
+// triplet, legitimate servers retry delivery, while most of spam bots do not.
+// Authenticated sessions are not greylisted. Policy can be shared between protocols.
+type GreylistPolicy struct {
+	Store GreylistStore
+	// Delay is time before retry accepted.
+	Delay time.Duration
+	// Window is time during which retry accepted, after it triplet greylisted again.
+	Window time.Duration
+	// Expire is time during which passed triplets and deliveries counters kept.
+	Expire time.Duration
+	// AutoWhitelist is number of delivered messages after which client network is not greylisted, 0 disables it.
+	AutoWhitelist int
+	// IPv4Prefix and IPv6Prefix are lengths of client network, servers often retry from other address of pool.
+	IPv4Prefix int
+	IPv6Prefix int
+}
+
+// CreateGreylistPolicy creates policy with usual delays, retry accepted in 5 minutes during 24 hours
+// and remembered for 36 days.
+func CreateGreylistPolicy(store GreylistStore) *GreylistPolicy {
+	return &GreylistPolicy{
+		Store:         store,
+		Delay:         5 * time.Minute,
+		Window:        24 * time.Hour,
+		Expire:        36 * 24 * time.Hour,
+		AutoWhitelist: 5,
+		IPv4Prefix:    24,
+		IPv6Prefix:    64,
+	}
+}
+
+func (policy *GreylistPolicy) CheckRcpt(protocol *Protocol, path *smtpMessage.MessagePath) *Reply {
+	if protocol.Ip == nil || len(protocol.authIdentity) > 0 {
+		return nil
+	}
+	now := protocol.now()
+
+	if policy.AutoWhitelist > 0 {
+		client, err := policy.Store.Get(policy.clientKey(protocol), now)
+		if err != nil {
+			return policy.failure(err)
+		}
+		if client != nil && client.Deliveries >= policy.AutoWhitelist {
+			return nil
+		}
+	}
+
+	key := policy.tripletKey(protocol, path)
+	entry, err := policy.Store.Get(key, now)
+	if err != nil {
+		return policy.failure(err)
+	}
+
+	switch {
+	case entry == nil:
+		entry = &GreylistEntry{FirstSeen: now, Expires: now.Add(policy.Window)}
+	case !entry.Passed && now.Sub(entry.FirstSeen) >= policy.Delay:
+		entry.Passed = true
+	}
+	if entry.Passed {
+		entry.Expires = now.Add(policy.Expire)
+	}
+	if err = policy.Store.Set(key, *entry); err != nil {
+		return policy.failure(err)
+	}
+
+	if !entry.Passed {
+		logManager().Debug(fmt.Sprintf("Greylisted %s", key))
+		return ReplyLocalError("4.7.1 Greylisted, please try again later")
+	}
+
+	return nil
+}
+
+// CheckData counts messages delivered by client network for automatic whitelisting.
+func (policy *GreylistPolicy) CheckData(protocol *Protocol, origin string) *Reply {
+	if policy.AutoWhitelist <= 0 || protocol.Ip == nil || len(protocol.authIdentity) > 0 {
+		return nil
+	}
+	now := protocol.now()
+
+	key := policy.clientKey(protocol)
+	client, err := policy.Store.Get(key, now)
+	if err == nil {
+		if client == nil {
+			client = &GreylistEntry{FirstSeen: now}
+		}
+		client.Deliveries++
+		client.Expires = now.Add(policy.Expire)
+		err = policy.Store.Set(key, *client)
+	}
+	if err != nil {
+		logManager().Error(fmt.Sprintf("Greylist store failed: %s", err.Error()))
+	}
+
+	return nil
+}
+
+// failure accepts recipient when store is broken, greylisting should not stop mail flow.
+func (policy *GreylistPolicy) failure(err error) *Reply {
+	logManager().Error(fmt.Sprintf("Greylist store failed: %s", err.Error()))
+	return nil
+}
+
+func (policy *GreylistPolicy) clientKey(protocol *Protocol) string {
+	return "client:" + policy.clientNetwork(protocol)
+}
+
+func (policy *GreylistPolicy) tripletKey(protocol *Protocol, path *smtpMessage.MessagePath) string {
+	sender := "<>"
+	if protocol.message.From != nil {
+		sender = strings.ToLower(protocol.message.From.Address())
+	}
+	return "triplet:" + policy.clientNetwork(protocol) + "/" + sender + "/" + strings.ToLower(path.Address())
+}
+
+func (policy *GreylistPolicy) clientNetwork(protocol *Protocol) string {
+	return clientNetwork(protocol.Ip.IP, policy.IPv4Prefix, policy.IPv6Prefix)
+}
+
+// greylistStoreSweep is number of operations between removing of expired entries.
+const greylistStoreSweep = 1000
+
+// MemoryGreylistStore is in-memory GreylistStore implementation, entries lost on restart.
+type MemoryGreylistStore struct {
+	mutex      sync.Mutex
+	entries    map[string]GreylistEntry
+	operations int
+}
+
+// CreateMemoryGreylistStore creates empty store.
+func CreateMemoryGreylistStore() *MemoryGreylistStore {
+	return &MemoryGreylistStore{entries: map[string]GreylistEntry{}}
+}
+
+func (store *MemoryGreylistStore) Get(key string, now time.Time) (*GreylistEntry, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.operations++
+	if store.operations%greylistStoreSweep == 0 {
+		for key, entry := range store.entries {
+			if !now.Before(entry.Expires) {
+				delete(store.entries, key)
+			}
+		}
+	}
+
+	entry, ok := store.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	if !now.Before(entry.Expires) {
+		delete(store.entries, key)
+		return nil, nil
+	}
+
+	return &entry, nil
+}
+
+func (store *MemoryGreylistStore) Set(key string, entry GreylistEntry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.entries[key] = entry
+	return nil
+}
+
+// greylistFileSaveInterval is period of saving changed entries of FileGreylistStore.
+const greylistFileSaveInterval = time.Minute
+
+// FileGreylistStore keeps entries in memory and periodically saves changed entries to JSON file,
+// so greylisting state survives restart. Close should be called on shutdown to save last changes.
+type FileGreylistStore struct {
+	MemoryGreylistStore
+	path    string
+	changed bool
+	// saveMutex serializes file writes, entries are not locked while file is written.
+	saveMutex sync.Mutex
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// CreateFileGreylistStore creates store and loads entries saved to file, missing file is not an error.
+func CreateFileGreylistStore(path string) (*FileGreylistStore, error) {
+	store := &FileGreylistStore{path: path, stop: make(chan struct{})}
+	store.entries = map[string]GreylistEntry{}
+
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(content, &store.entries); err != nil {
+			return nil, fmt.Errorf("malformed greylist file %s: %w", path, err)
+		}
+	}
+
+	go store.saveLoop(greylistFileSaveInterval)
+
+	return store, nil
+}
+
+func (store *FileGreylistStore) Set(key string, entry GreylistEntry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.entries[key] = entry
+	store.changed = true
+	return nil
+}
+
+// Save removes entries expired at now and writes file, if entries changed since last save.
+func (store *FileGreylistStore) Save(now time.Time) error {
+	store.saveMutex.Lock()
+	defer store.saveMutex.Unlock()
+
+	store.mutex.Lock()
+	if !store.changed {
+		store.mutex.Unlock()
+		return nil
+	}
+	for key, entry := range store.entries {
+		if !now.Before(entry.Expires) {
+			delete(store.entries, key)
+		}
+	}
+	content, err := json.Marshal(store.entries)
+	store.changed = err != nil
+	store.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err = store.writeFile(content); err != nil {
+		store.mutex.Lock()
+		store.changed = true
+		store.mutex.Unlock()
+	}
+
+	return err
+}
+
+// Close stops periodic saving and saves not saved changes.
+func (store *FileGreylistStore) Close() error {
+	store.stopOnce.Do(func() {
+		close(store.stop)
+	})
+
+	return store.Save(time.Now())
+}
+
+func (store *FileGreylistStore) saveLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-store.stop:
+			return
+		case now := <-ticker.C:
+			if err := store.Save(now); err != nil {
+				logManager().Error(fmt.Sprintf("Greylist store failed: %s", err.Error()))
+			}
+		}
+	}
+}
+
+func (store *FileGreylistStore) writeFile(content []byte) error {
+	// File replaced atomically, so crash does not leave broken file.
+	temporary, err := os.CreateTemp(filepath.Dir(store.path), filepath.Base(store.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = temporary.Write(content); err != nil {
+		temporary.Close()
+		os.Remove(temporary.Name())
+		return err
+	}
+	if err = temporary.Close(); err != nil {
+		os.Remove(temporary.Name())
+		return err
+	}
+
+	return os.Rename(temporary.Name(), store.path)
+}
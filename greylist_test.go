@@ -0,0 +1,111 @@
+package smtpServerProtocol
+
+import (
+	"errors"
+	"github.com/mailhedgehog/gounit"
+	"github.com/mailhedgehog/smtpMessage"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func greylistAttempt(policy *GreylistPolicy, ip string, now time.Time, lines ...string) *Reply {
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP(ip)}, nil)
+	protocol.SetClock(func() time.Time { return now })
+	protocol.AddPolicy(policy)
+	protocol.OnMessageReceived(func(message *smtpMessage.SmtpMessage) (string, error) {
+		return "id", nil
+	})
+
+	var reply *Reply
+	for _, line := range append([]string{"EHLO client.example.org"}, lines...) {
+		reply = protocol.HandleReceivedLine(line)
+	}
+	return reply
+}
+
+func TestGreylistPolicy(t *testing.T) {
+	policy := CreateGreylistPolicy(CreateMemoryGreylistStore())
+	policy.AutoWhitelist = 0
+	now := fixedClock()
+	rcpt := []string{"MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>"}
+
+	reply := greylistAttempt(policy, "192.0.2.1", now, rcpt...)
+	(*gounit.T)(t).AssertEqualsInt(CODE_LOCAL_ERROR, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("4.7.1 Greylisted, please try again later", reply.lines[0])
+
+	// Retry before delay still greylisted, retry from same network after delay accepted.
+	(*gounit.T)(t).AssertEqualsInt(CODE_LOCAL_ERROR, greylistAttempt(policy, "192.0.2.1", now.Add(time.Minute), rcpt...).Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, greylistAttempt(policy, "192.0.2.2", now.Add(5*time.Minute), rcpt...).Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, greylistAttempt(policy, "192.0.2.1", now.Add(10*24*time.Hour), rcpt...).Status)
+
+	// Other triplets greylisted separately.
+	(*gounit.T)(t).AssertEqualsInt(CODE_LOCAL_ERROR, greylistAttempt(policy, "198.51.100.1", now, rcpt...).Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_LOCAL_ERROR, greylistAttempt(policy, "192.0.2.1", now, "MAIL FROM:<>", "RCPT TO:<admin@example.com>").Status)
+
+	// Retry after window greylisted as new triplet.
+	other := []string{"MAIL FROM:<jane@example.org>", "RCPT TO:<admin@example.com>"}
+	greylistAttempt(policy, "192.0.2.1", now, other...)
+	(*gounit.T)(t).AssertEqualsInt(CODE_LOCAL_ERROR, greylistAttempt(policy, "192.0.2.1", now.Add(25*time.Hour), other...).Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, greylistAttempt(policy, "192.0.2.1", now.Add(26*time.Hour), other...).Status)
+
+	// Passed triplet expires when not used.
+	(*gounit.T)(t).AssertEqualsInt(CODE_LOCAL_ERROR, greylistAttempt(policy, "192.0.2.1", now.Add(50*24*time.Hour), rcpt...).Status)
+}
+
+func TestGreylistPolicyAutoWhitelist(t *testing.T) {
+	policy := CreateGreylistPolicy(CreateMemoryGreylistStore())
+	policy.AutoWhitelist = 2
+	now := fixedClock()
+	message := []string{"MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>", "DATA", "Subject: test", "", "body", "."}
+
+	greylistAttempt(policy, "192.0.2.1", now, message...)
+	for i := 0; i < 2; i++ {
+		(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, greylistAttempt(policy, "192.0.2.1", now.Add(time.Hour), message...).Status)
+	}
+
+	// New sender from whitelisted network is not greylisted.
+	reply := greylistAttempt(policy, "192.0.2.1", now.Add(time.Hour), "MAIL FROM:<jane@example.net>", "RCPT TO:<admin@example.com>")
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, reply.Status)
+	reply = greylistAttempt(policy, "198.51.100.1", now.Add(time.Hour), "MAIL FROM:<jane@example.net>", "RCPT TO:<admin@example.com>")
+	(*gounit.T)(t).AssertEqualsInt(CODE_LOCAL_ERROR, reply.Status)
+}
+
+func TestFileGreylistStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greylist.json")
+	store, err := CreateFileGreylistStore(path)
+	(*gounit.T)(t).AssertNotError(err)
+
+	now := fixedClock()
+	(*gounit.T)(t).AssertNotError(store.Set("key", GreylistEntry{FirstSeen: now, Passed: true, Expires: now.Add(time.Hour)}))
+	(*gounit.T)(t).AssertNotError(store.Set("expired", GreylistEntry{FirstSeen: now, Expires: now}))
+	_, err = os.Stat(path)
+	(*gounit.T)(t).AssertTrue(errors.Is(err, os.ErrNotExist))
+
+	(*gounit.T)(t).AssertNotError(store.Save(now))
+	(*gounit.T)(t).AssertNotError(store.Close())
+	content, err := os.ReadFile(path)
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertTrue(strings.Contains(string(content), "\"key\""))
+	(*gounit.T)(t).AssertFalse(strings.Contains(string(content), "\"expired\""))
+
+	store, err = CreateFileGreylistStore(path)
+	defer store.Close()
+	(*gounit.T)(t).AssertNotError(err)
+	entry, err := store.Get("key", now)
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertTrue(entry.Passed)
+	(*gounit.T)(t).AssertTrue(entry.FirstSeen.Equal(now))
+
+	entry, _ = store.Get("expired", now)
+	(*gounit.T)(t).AssertNil(entry)
+	entry, _ = store.Get("key", now.Add(time.Hour))
+	(*gounit.T)(t).AssertNil(entry)
+
+	(*gounit.T)(t).AssertNotError(os.WriteFile(path, []byte("broken"), 0600))
+	_, err = CreateFileGreylistStore(path)
+	(*gounit.T)(t).ExpectError(err)
+}
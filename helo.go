@@ -0,0 +1,154 @@
+package smtpServerProtocol
+
+import (
+	"fmt"
+	"golang.org/x/exp/slices"
+	"net"
+	"strings"
+)
+
+// HeloValidation configures checks of HELO and EHLO argument, each check enabled separately.
+type HeloValidation struct {
+	// RequireArgument rejects greeting without domain (rfc5321 section 4.1.1.1).
+	RequireArgument bool
+	// RequireValidDomain rejects argument what is not fully qualified domain name
+	// or address literal, for example "[192.0.2.1]" or "[IPv6:2001:db8::1]".
+	RequireValidDomain bool
+	// RequireMatchingLiteral rejects address literal what does not match client Ip.
+	RequireMatchingLiteral bool
+	// RejectOwnHostname rejects remote client what uses Hostname of server, loopback clients allowed.
+	RejectOwnHostname bool
+}
+
+// validateHelo returns rejection reply when HELO or EHLO argument fails enabled checks.
+func (protocol *Protocol) validateHelo(verb CommandName, helo string) *Reply {
+	validation := protocol.validation.Helo
+
+	if len(helo) == 0 {
+		if validation.RequireArgument || validation.RequireValidDomain {
+			return ReplySyntaxError(fmt.Sprintf("5.5.4 Syntax: %s hostname", verb))
+		}
+		return nil
+	}
+
+	ip, isLiteral := parseAddressLiteral(helo)
+	if validation.RequireValidDomain && !isLiteral && !isFullyQualifiedDomain(helo) {
+		return ReplySyntaxError("5.5.2 Invalid domain name")
+	}
+	if validation.RequireValidDomain && isLiteral && ip == nil {
+		return ReplySyntaxError("5.5.2 Invalid address literal")
+	}
+
+	if validation.RequireMatchingLiteral && ip != nil && protocol.Ip != nil && !ip.Equal(protocol.Ip.IP) {
+		return ReplyMailbox404("5.7.1 Address literal does not match client address")
+	}
+
+	if validation.RejectOwnHostname && len(protocol.Hostname) > 0 &&
+		normalizeDnsName(helo) == normalizeDnsName(protocol.Hostname) &&
+		(protocol.Ip == nil || !protocol.Ip.IP.IsLoopback()) {
+		return ReplyMailbox404("5.7.1 Own hostname used by remote client")
+	}
+
+	return nil
+}
+
+// parseAddressLiteral parses "[192.0.2.1]" or "[IPv6:2001:db8::1]" (rfc5321 section 4.1.3),
+// returns nil Ip when argument looks like literal, but is invalid.
+func parseAddressLiteral(value string) (net.IP, bool) {
+	if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+		return nil, false
+	}
+	value = value[1 : len(value)-1]
+
+	if len(value) > 5 && strings.EqualFold(value[:5], "IPv6:") {
+		ip := net.ParseIP(value[5:])
+		if ip == nil || ip.To4() != nil && !strings.Contains(value[5:], ":") {
+			return nil, true
+		}
+		return ip, true
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil || ip.To4() == nil || strings.Contains(value, ":") {
+		return nil, true
+	}
+	return ip, true
+}
+
+// isFullyQualifiedDomain checks domain syntax (rfc5321 section 4.1.2), domain should
+// contain at least two labels and top level label should not be numeric.
+func isFullyQualifiedDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if len(domain) == 0 || len(domain) > RfcMaximumDomainLength {
+		return false
+	}
+
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, char := range label {
+			if !(char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z' || char >= '0' && char <= '9' || char == '-') {
+				return false
+			}
+		}
+	}
+
+	topLevel := labels[len(labels)-1]
+	return strings.Trim(topLevel, "0123456789") != ""
+}
+
+// extendedCommands are service extension commands, they are not available in session
+// started with HELO (rfc5321 section 4.1.1.1).
+var extendedCommands = []CommandName{CommandAuth, CommandStartTls, CommandBdat}
+
+// Greeting returns command (HELO or EHLO) what client used to greet server, empty before greeting.
+func (protocol *Protocol) Greeting() CommandName {
+	return protocol.greeting
+}
+
+// isExtended checks if client greeted server using EHLO.
+func (protocol *Protocol) isExtended() bool {
+	return protocol.greeting == CommandEhlo
+}
+
+// transactionCommands start or continue mail transaction, they require authentication when
+// auth mechanisms configured.
+var transactionCommands = []CommandName{CommandMail, CommandRcpt, CommandData}
+
+// checkGreetingMode refuses service extension commands in session started with HELO. AUTH is not
+// available in such session, so transaction refused when authentication required, other commands
+// (RSET, QUIT, EHLO) still accepted and client is able to start again using EHLO.
+func (protocol *Protocol) checkGreetingMode(command *Command) *Reply {
+	if protocol.greeting != CommandHelo {
+		return nil
+	}
+	if slices.Contains(extendedCommands, command.verb) {
+		return ReplyBadSequence(fmt.Sprintf("5.5.1 %s not available in HELO session, use EHLO", command.verb))
+	}
+	if len(protocol.supportedAuthMechanisms) > 0 && slices.Contains(transactionCommands, command.verb) {
+		return ReplyAuthRequired("5.7.0 Authentication required, use EHLO")
+	}
+
+	return nil
+}
+
+// checkMailParameters refuses MAIL FROM and RCPT TO parameters in session started with HELO,
+// parameters are part of service extensions (rfc5321 section 4.1.1.11).
+func (protocol *Protocol) checkMailParameters(name string, path string) *Reply {
+	if protocol.isExtended() {
+		return nil
+	}
+
+	path = strings.TrimSpace(path)
+	end := strings.Index(path, ">")
+	if end < 0 || len(strings.TrimSpace(path[end+1:])) == 0 {
+		return nil
+	}
+
+	return ReplyParametersNotRecognized(fmt.Sprintf("5.5.4 %s parameters not recognized", name))
+}
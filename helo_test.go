@@ -0,0 +1,188 @@
+package smtpServerProtocol
+
+import (
+	"crypto/tls"
+	"github.com/mailhedgehog/gounit"
+	"net"
+	"testing"
+)
+
+func TestIsFullyQualifiedDomain(t *testing.T) {
+	domains := map[string]bool{
+		"mail.example.com":  true,
+		"Mail.Example.COM.": true,
+		"xn--bcher-kva.de":  true,
+		"a-b.example":       true,
+		"localhost":         false,
+		"example..com":      false,
+		"-mail.example.com": false,
+		"mail_1.example":    false,
+		"192.0.2.1":         false,
+		"mail.example.com ": false,
+	}
+
+	for domain, expected := range domains {
+		(*gounit.T)(t).AssertTrue(isFullyQualifiedDomain(domain) == expected)
+	}
+}
+
+func TestParseAddressLiteral(t *testing.T) {
+	literals := map[string]string{
+		"[192.0.2.1]":           "192.0.2.1",
+		"[IPv6:2001:db8::1]":    "2001:db8::1",
+		"[ipv6:::ffff:1.2.3.4]": "1.2.3.4",
+		"[2001:db8::1]":         "",
+		"[IPv6:192.0.2.1]":      "",
+		"[192.0.2.256]":         "",
+	}
+
+	for literal, expected := range literals {
+		ip, isLiteral := parseAddressLiteral(literal)
+		(*gounit.T)(t).AssertTrue(isLiteral)
+		if len(expected) == 0 {
+			(*gounit.T)(t).AssertTrue(ip == nil)
+			continue
+		}
+		(*gounit.T)(t).AssertEqualsString(expected, ip.String())
+	}
+
+	_, isLiteral := parseAddressLiteral("mail.example.com")
+	(*gounit.T)(t).AssertFalse(isLiteral)
+}
+
+func TestHeloValidation(t *testing.T) {
+	greet := func(ip string, helo HeloValidation, line string) *Reply {
+		protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP(ip)}, &Validation{Helo: helo})
+		return protocol.HandleReceivedLine(line)
+	}
+
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, greet("192.0.2.1", HeloValidation{}, "HELO").Status)
+	reply := greet("192.0.2.1", HeloValidation{RequireArgument: true}, "EHLO")
+	(*gounit.T)(t).AssertEqualsInt(CODE_PARAMETER_SYNTAX_ERROR, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("5.5.4 Syntax: EHLO hostname", reply.lines[0])
+
+	validDomain := HeloValidation{RequireValidDomain: true}
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, greet("192.0.2.1", validDomain, "EHLO client.example.org").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, greet("192.0.2.1", validDomain, "EHLO [198.51.100.1]").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, greet("192.0.2.1", HeloValidation{}, "EHLO localhost").Status)
+	reply = greet("192.0.2.1", validDomain, "EHLO localhost")
+	(*gounit.T)(t).AssertEqualsInt(CODE_PARAMETER_SYNTAX_ERROR, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("5.5.2 Invalid domain name", reply.lines[0])
+	(*gounit.T)(t).AssertEqualsString("5.5.2 Invalid address literal", greet("192.0.2.1", validDomain, "EHLO [192.0.2.300]").lines[0])
+
+	matchingLiteral := HeloValidation{RequireMatchingLiteral: true}
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, greet("192.0.2.1", matchingLiteral, "HELO [192.0.2.1]").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, greet("2001:db8::1", matchingLiteral, "HELO [IPv6:2001:DB8:0::1]").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, greet("192.0.2.1", matchingLiteral, "HELO client.example.org").Status)
+	reply = greet("192.0.2.1", matchingLiteral, "HELO [198.51.100.1]")
+	(*gounit.T)(t).AssertEqualsInt(CODE_MAILBOX_404, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("5.7.1 Address literal does not match client address", reply.lines[0])
+
+	ownHostname := HeloValidation{RejectOwnHostname: true}
+	reply = greet("192.0.2.1", ownHostname, "EHLO MX.example.com.")
+	(*gounit.T)(t).AssertEqualsInt(CODE_MAILBOX_404, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("5.7.1 Own hostname used by remote client", reply.lines[0])
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, greet("127.0.0.1", ownHostname, "EHLO mx.example.com").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, greet("192.0.2.1", ownHostname, "EHLO client.example.com").Status)
+}
+
+func TestHeloSessionMode(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.EnableStartTls()
+	protocol.SetTLS(&tls.ConnectionState{})
+	protocol.SetAuthenticated("joe")
+	(*gounit.T)(t).AssertEqualsString("", string(protocol.Greeting()))
+
+	reply := protocol.HandleReceivedLine("HELO client.example.org")
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, reply.Status)
+	(*gounit.T)(t).AssertEqualsInt(1, len(reply.lines))
+	(*gounit.T)(t).AssertEqualsString(string(CommandHelo), string(protocol.Greeting()))
+	(*gounit.T)(t).AssertEqualsString(KeywordSmtp, protocol.protocolKeyword())
+
+	reply = protocol.HandleReceivedLine("MAIL FROM:<joe@example.org> SIZE=1000")
+	(*gounit.T)(t).AssertEqualsInt(CODE_PARAMETERS_NOT_RECOGNIZED, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("5.5.4 MAIL FROM parameters not recognized", reply.lines[0])
+	(*gounit.T)(t).AssertEqualsInt(CODE_PARAMETERS_NOT_RECOGNIZED, protocol.HandleReceivedLine("MAIL FROM:<> BODY=8BITMIME").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("MAIL FROM:<joe@example.org>").Status)
+	reply = protocol.HandleReceivedLine("RCPT TO:<admin@example.com> NOTIFY=NEVER")
+	(*gounit.T)(t).AssertEqualsInt(CODE_PARAMETERS_NOT_RECOGNIZED, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("5.5.4 RCPT TO parameters not recognized", reply.lines[0])
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("RCPT TO:<admin@example.com>").Status)
+
+	for _, line := range []string{"AUTH PLAIN", "STARTTLS", "BDAT 10 LAST"} {
+		reply = protocol.HandleReceivedLine(line)
+		(*gounit.T)(t).AssertEqualsInt(CODE_COMMANDS_BAD_SEQUENCE, reply.Status)
+	}
+	(*gounit.T)(t).AssertEqualsString("5.5.1 BDAT not available in HELO session, use EHLO", reply.lines[0])
+
+	protocol.HandleReceivedLine("EHLO client.example.org")
+	(*gounit.T)(t).AssertEqualsString(string(CommandEhlo), string(protocol.Greeting()))
+	(*gounit.T)(t).AssertEqualsString(KeywordEsmtpSA, protocol.protocolKeyword())
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("MAIL FROM:<joe@example.org> SIZE=1000").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_COMMAND_SYNTAX_ERROR, protocol.HandleReceivedLine("BDAT 10 LAST").Status)
+}
+
+func TestHeloSessionModeWithAuth(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.SetAuthMechanisms([]string{"PLAIN"})
+
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("HELO client.example.org").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_COMMANDS_BAD_SEQUENCE, protocol.HandleReceivedLine("AUTH PLAIN").Status)
+	reply := protocol.HandleReceivedLine("MAIL FROM:<joe@example.org>")
+	(*gounit.T)(t).AssertEqualsInt(CODE_AUTH_REQUIRED, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("5.7.0 Authentication required, use EHLO", reply.lines[0])
+	(*gounit.T)(t).AssertEqualsInt(CODE_AUTH_REQUIRED, protocol.HandleReceivedLine("RCPT TO:<admin@example.com>").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("RSET").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_CLOSING, protocol.HandleReceivedLine("QUIT").Status)
+
+	// Client still able to authenticate after switching to EHLO.
+	protocol = CreateProtocol("mx.example.com", nil, nil)
+	protocol.SetAuthMechanisms([]string{"PLAIN"})
+	protocol.HandleReceivedLine("HELO client.example.org")
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("EHLO client.example.org").Status)
+	(*gounit.T)(t).AssertEqualsString(string(StateWaitingAuth), string(protocol.state))
+}
+
+func TestRepeatedGreetingResetsTransaction(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.HandleReceivedLine("EHLO client.example.org")
+	protocol.HandleReceivedLine("MAIL FROM:<joe@example.org>")
+	protocol.HandleReceivedLine("RCPT TO:<admin@example.com>")
+	id := protocol.message.ID
+
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("EHLO other.example.org").Status)
+	(*gounit.T)(t).AssertTrue(protocol.message.From == nil)
+	(*gounit.T)(t).AssertEqualsInt(0, len(protocol.message.To))
+	(*gounit.T)(t).AssertTrue(id != protocol.message.ID)
+	(*gounit.T)(t).AssertEqualsString("other.example.org", protocol.message.Helo)
+
+	// Rejected greeting does not change session.
+	protocol.validation.Helo.RequireArgument = true
+	protocol.HandleReceivedLine("MAIL FROM:<joe@example.org>")
+	(*gounit.T)(t).AssertEqualsInt(CODE_PARAMETER_SYNTAX_ERROR, protocol.HandleReceivedLine("HELO").Status)
+	(*gounit.T)(t).AssertFalse(protocol.message.From == nil)
+	(*gounit.T)(t).AssertEqualsString(string(CommandEhlo), string(protocol.Greeting()))
+}
+
+func TestRepeatedGreetingWithAuth(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.SetAuthMechanisms([]string{"LOGIN"})
+	protocol.CreateCustomSceneUsing(func(sceneName string) Scene {
+		return &acceptingAuthScene{}
+	})
+
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("EHLO client.example.org").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("EHLO other.example.org").Status)
+	(*gounit.T)(t).AssertEqualsString("other.example.org", protocol.message.Helo)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("RSET").Status)
+	(*gounit.T)(t).AssertEqualsString(string(StateWaitingAuth), string(protocol.state))
+	(*gounit.T)(t).AssertEqualsInt(CODE_AUTH_FAILED, protocol.HandleReceivedLine("MAIL FROM:<joe@example.org>").Status)
+
+	protocol.HandleReceivedLine("AUTH LOGIN")
+	(*gounit.T)(t).AssertEqualsInt(CODE_AUTHENTICATION_SUCCESS, protocol.HandleReceivedLine("am9l").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("MAIL FROM:<joe@example.org>").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("EHLO client.example.org").Status)
+	(*gounit.T)(t).AssertNil(protocol.message.From)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("MAIL FROM:<joe@example.org>").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_CLOSING, protocol.HandleReceivedLine("QUIT").Status)
+}
@@ -0,0 +1,67 @@
+package smtpServerProtocol
+
+import (
+	"github.com/mailhedgehog/smtpMessage"
+	"strings"
+)
+
+// Size limits described in rfc5321 section 4.5.3.1, line lengths include <CRLF>.
+const (
+	RfcMaximumLocalPartLength   = 64
+	RfcMaximumDomainLength      = 255
+	RfcMaximumPathLength        = 256
+	RfcMaximumCommandLineLength = 512
+	RfcMaximumTextLineLength    = 1000
+)
+
+// maximumPendingLineLength limits incomplete line buffered by HandleReceivedData when validation
+// does not limit line length, so client what never sends line ending can't exhaust memory.
+const maximumPendingLineLength = 1024 * 1024
+
+// CreateRfcValidation returns validation what enforces all rfc5321 size limits and requires HELO argument.
+func CreateRfcValidation() *Validation {
+	return &Validation{
+		MaximumCommandLineLength: RfcMaximumCommandLineLength - len(CommandEndSymbol),
+		MaximumTextLineLength:    RfcMaximumTextLineLength - len(CommandEndSymbol),
+		MaximumLocalPartLength:   RfcMaximumLocalPartLength,
+		MaximumDomainLength:      RfcMaximumDomainLength,
+		MaximumPathLength:        RfcMaximumPathLength,
+		Helo:                     HeloValidation{RequireArgument: true},
+	}
+}
+
+// maximumLineLength returns line length limit for current conversation state, 0 means no limit.
+func (protocol *Protocol) maximumLineLength() int {
+	maximumLength := 0
+	switch protocol.state {
+	case StateData:
+		maximumLength = protocol.validation.MaximumTextLineLength
+	case StateCommandsExchange, StateWaitingAuth:
+		maximumLength = protocol.validation.MaximumCommandLineLength
+	}
+	if maximumLength > 0 {
+		return maximumLength
+	}
+
+	return protocol.validation.MaximumLineLength
+}
+
+// validatePathLength checks size limits of path received in MAIL or RCPT command.
+func (protocol *Protocol) validatePathLength(path *smtpMessage.MessagePath) *Reply {
+	if protocol.validation.MaximumLocalPartLength > 0 && len(path.Mailbox) > protocol.validation.MaximumLocalPartLength {
+		return ReplyMailboxNameIncorrect("5.1.3 Local part too long")
+	}
+	if protocol.validation.MaximumDomainLength > 0 && len(path.Domain) > protocol.validation.MaximumDomainLength {
+		return ReplyMailboxNameIncorrect("5.1.2 Domain too long")
+	}
+
+	pathLength := len("<" + path.Address() + ">")
+	if len(path.Relays) > 0 {
+		pathLength += len(strings.Join(path.Relays, ",") + ":")
+	}
+	if protocol.validation.MaximumPathLength > 0 && pathLength > protocol.validation.MaximumPathLength {
+		return ReplyPathTooLong()
+	}
+
+	return nil
+}
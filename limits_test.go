@@ -0,0 +1,66 @@
+package smtpServerProtocol
+
+import (
+	"github.com/mailhedgehog/gounit"
+	"github.com/mailhedgehog/smtpMessage"
+	"strings"
+	"testing"
+)
+
+func TestCommandLineLength(t *testing.T) {
+	protocol := CreateProtocol("", nil, CreateRfcValidation())
+
+	reply := protocol.HandleReceivedLine("HELO " + strings.Repeat("a", 505))
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, reply.Status)
+
+	reply = protocol.HandleReceivedLine("HELO " + strings.Repeat("a", 506))
+	(*gounit.T)(t).AssertEqualsInt(CODE_COMMAND_SYNTAX_ERROR, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("Line too long.", reply.lines[0])
+}
+
+func TestTextLineLength(t *testing.T) {
+	protocol := CreateProtocol("", nil, CreateRfcValidation())
+	protocol.OnMessageReceived(func(message *smtpMessage.SmtpMessage) (string, error) {
+		return "id", nil
+	})
+
+	protocol.HandleReceivedLine("DATA")
+	(*gounit.T)(t).AssertNil(protocol.HandleReceivedLine("Subject: " + strings.Repeat("a", 989)))
+	reply := protocol.HandleReceivedLine(".")
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, reply.Status)
+
+	protocol.HandleReceivedLine("DATA")
+	(*gounit.T)(t).AssertNil(protocol.HandleReceivedLine("Subject: " + strings.Repeat("a", 990)))
+	reply = protocol.HandleReceivedLine(".")
+	(*gounit.T)(t).AssertEqualsInt(CODE_COMMAND_SYNTAX_ERROR, reply.Status)
+}
+
+func TestLegacyLineLengthFallback(t *testing.T) {
+	protocol := CreateProtocol("", nil, &Validation{MaximumLineLength: 10, MaximumTextLineLength: 20})
+
+	reply := protocol.HandleReceivedLine("HELO foo.bar")
+	(*gounit.T)(t).AssertEqualsInt(CODE_COMMAND_SYNTAX_ERROR, reply.Status)
+
+	protocol.HandleReceivedLine("DATA")
+	(*gounit.T)(t).AssertNil(protocol.HandleReceivedLine("Subject: foo bar"))
+	(*gounit.T)(t).AssertNil(protocol.dataRejection)
+}
+
+func TestPathLength(t *testing.T) {
+	protocol := CreateProtocol("", nil, CreateRfcValidation())
+
+	reply := protocol.HandleReceivedLine("MAIL FROM:<" + strings.Repeat("a", 65) + "@example.com>")
+	(*gounit.T)(t).AssertEqualsInt(CODE__MAILBOX_NAME_INCORRECT, reply.Status)
+	(*gounit.T)(t).AssertNil(protocol.message.From)
+
+	reply = protocol.HandleReceivedLine("MAIL FROM:<" + strings.Repeat("a", 64) + "@example.com>")
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, reply.Status)
+
+	reply = protocol.HandleReceivedLine("RCPT TO:<foo@" + strings.Repeat("a", 256) + ">")
+	(*gounit.T)(t).AssertEqualsInt(CODE__MAILBOX_NAME_INCORRECT, reply.Status)
+
+	relays := "@" + strings.Repeat("a", 200) + ",@" + strings.Repeat("b", 50)
+	reply = protocol.HandleReceivedLine("RCPT TO:<" + relays + ":foo@example.com>")
+	(*gounit.T)(t).AssertEqualsInt(CODE_PARAMETER_SYNTAX_ERROR, reply.Status)
+	(*gounit.T)(t).AssertEqualsInt(0, len(protocol.message.To))
+}
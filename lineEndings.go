@@ -0,0 +1,87 @@
+package smtpServerProtocol
+
+import (
+	"strings"
+)
+
+// LineEndings represents how protocol handles bare <CR> and <LF> what are not part of <CRLF>.
+// Different handling of bare line endings between servers is a base of "SMTP smuggling" attacks.
+type LineEndings string
+
+const (
+	// LineEndingsLenient strips any line ending, legacy behaviour.
+	LineEndingsLenient = LineEndings("")
+	// LineEndingsStrict rejects commands and messages what contain bare <CR> or <LF>.
+	LineEndingsStrict = LineEndings("strict")
+	// LineEndingsNormalize converts bare <CR> and <LF> in message data to <CRLF>,
+	// but only <CRLF>.<CRLF> still is treated as end of data.
+	LineEndingsNormalize = LineEndings("normalize")
+)
+
+// HandleReceivedRawLine handles line exactly as it was read from connection, including
+// line ending, for example result of bufio.Reader.ReadBytes('\n').
+func (protocol *Protocol) HandleReceivedRawLine(rawLine []byte) *Reply {
+	line := string(rawLine)
+	content := strings.TrimSuffix(line, CommandEndSymbol)
+
+	if protocol.validation.LineEndings == LineEndingsLenient {
+		return protocol.HandleReceivedLine(strings.TrimRight(line, "\r\n"))
+	}
+
+	if protocol.state == StateData {
+		return protocol.handleRawMailContent(content)
+	}
+
+	if !strings.ContainsAny(content, "\r\n") {
+		return protocol.HandleReceivedLine(content)
+	}
+
+	logManager().Debug("Received command with bare <CR> or <LF>")
+
+	if protocol.validation.LineEndings == LineEndingsNormalize {
+		command := strings.TrimSuffix(content, "\n")
+		if !strings.ContainsAny(command, "\r\n") {
+			return protocol.HandleReceivedLine(command)
+		}
+	}
+
+	return ReplyBareLineEnding()
+}
+
+// handleRawMailContent handles data line without trailing <CRLF>. Dot line is treated as
+// end of data only if it is surrounded by <CRLF> from both sides.
+func (protocol *Protocol) handleRawMailContent(content string) *Reply {
+	previousLineBare := protocol.dataBareLineEnding
+	protocol.dataBareLineEnding = strings.HasSuffix(content, "\n")
+
+	if !previousLineBare && !strings.ContainsAny(content, "\r\n") {
+		return protocol.HandleReceivedLine(content)
+	}
+
+	logManager().Debug("Received data with bare <CR> or <LF>")
+
+	if protocol.validation.LineEndings == LineEndingsNormalize {
+		for _, normalizedLine := range strings.Split(strings.TrimSuffix(content, "\n"), "\r") {
+			protocol.appendRawMailContent(normalizedLine)
+		}
+		return nil
+	}
+
+	if protocol.appendRawMailContent(content) {
+		protocol.dataRejection = ReplyBareLineEndingInData()
+	}
+
+	return nil
+}
+
+// appendRawMailContent appends data line what bypasses handleReceivedLine, so line length is checked
+// here. Too long line is not appended and message will be rejected at end of data.
+func (protocol *Protocol) appendRawMailContent(line string) bool {
+	if maximumLength := protocol.maximumLineLength(); maximumLength > 0 && len(line) > maximumLength {
+		protocol.dataRejection = ReplyLineTooLong()
+		return false
+	}
+	protocol.appendMailContent(line)
+
+	return true
+}
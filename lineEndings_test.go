@@ -0,0 +1,133 @@
+package smtpServerProtocol
+
+import (
+	"github.com/mailhedgehog/gounit"
+	"github.com/mailhedgehog/smtpMessage"
+	"strings"
+	"testing"
+)
+
+// Payloads used in "SMTP smuggling" attacks, each one tries to finish data
+// using non-standard end of data sequence and start new transaction.
+var smugglingPayloads = []string{
+	"\n.\n",
+	"\n.\r\n",
+	"\r\n.\n",
+	"\r.\r\n",
+	"\r\n.\r",
+	"\r.\r",
+}
+
+// feedRawData splits data as bufio.Reader.ReadBytes('\n') does and returns not empty replies.
+func feedRawData(protocol *Protocol, data string) []*Reply {
+	var replies []*Reply
+	for len(data) > 0 {
+		index := strings.Index(data, "\n")
+		line := data
+		if index >= 0 {
+			line = data[:index+1]
+		}
+		data = data[len(line):]
+
+		reply := protocol.HandleReceivedRawLine([]byte(line))
+		if reply != nil {
+			replies = append(replies, reply)
+		}
+	}
+
+	return replies
+}
+
+func smugglingConversation(payload string) string {
+	return "EHLO client.example.org\r\n" +
+		"MAIL FROM:<user@example.org>\r\n" +
+		"RCPT TO:<admin@example.com>\r\n" +
+		"DATA\r\n" +
+		"Subject: first\r\n\r\nfirst body" + payload +
+		"MAIL FROM:<spoofed@example.com>\r\n" +
+		"RCPT TO:<admin@example.com>\r\n" +
+		"DATA\r\n" +
+		"Subject: smuggled\r\n\r\nsmuggled body\r\n.\r\n"
+}
+
+func TestSmugglingStrict(t *testing.T) {
+	for _, payload := range smugglingPayloads {
+		protocol := CreateProtocol("", nil, &Validation{LineEndings: LineEndingsStrict})
+		var messages []*smtpMessage.SmtpMessage
+		protocol.OnMessageReceived(func(message *smtpMessage.SmtpMessage) (string, error) {
+			messages = append(messages, message)
+			return "id", nil
+		})
+
+		replies := feedRawData(protocol, smugglingConversation(payload))
+
+		(*gounit.T)(t).AssertEqualsInt(0, len(messages))
+		(*gounit.T)(t).AssertEqualsInt(5, len(replies))
+		(*gounit.T)(t).AssertEqualsInt(CODE_MAIL_DATA, replies[3].Status)
+		(*gounit.T)(t).AssertEqualsInt(CODE_MAILBOX_404, replies[4].Status)
+	}
+}
+
+func TestSmugglingNormalize(t *testing.T) {
+	for _, payload := range smugglingPayloads {
+		protocol := CreateProtocol("", nil, &Validation{LineEndings: LineEndingsNormalize})
+		var messages []*smtpMessage.SmtpMessage
+		protocol.OnMessageReceived(func(message *smtpMessage.SmtpMessage) (string, error) {
+			messages = append(messages, message)
+			return "id", nil
+		})
+
+		replies := feedRawData(protocol, smugglingConversation(payload))
+
+		(*gounit.T)(t).AssertEqualsInt(1, len(messages))
+		(*gounit.T)(t).AssertEqualsInt(5, len(replies))
+		(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, replies[4].Status)
+		(*gounit.T)(t).AssertEqualsString("user@example.org", messages[0].From.Address())
+		(*gounit.T)(t).AssertTrue(strings.Contains(messages[0].GetOrigin(), "MAIL FROM:<spoofed@example.com>\r\n"))
+		(*gounit.T)(t).AssertFalse(strings.Contains(messages[0].GetOrigin(), "\r\n.\r\n"))
+	}
+}
+
+func TestBareLineEndingDataLineLength(t *testing.T) {
+	for _, lineEndings := range []LineEndings{LineEndingsStrict, LineEndingsNormalize} {
+		protocol := CreateProtocol("", nil, &Validation{LineEndings: lineEndings, MaximumTextLineLength: 10})
+		var messages []*smtpMessage.SmtpMessage
+		protocol.OnMessageReceived(func(message *smtpMessage.SmtpMessage) (string, error) {
+			messages = append(messages, message)
+			return "id", nil
+		})
+
+		replies := feedRawData(protocol, "EHLO client.example.org\r\n"+
+			"MAIL FROM:<user@example.org>\r\n"+
+			"RCPT TO:<admin@example.com>\r\n"+
+			"DATA\r\n"+
+			"Subject: test\r\n\r\nshort\n"+strings.Repeat("x", 100)+"\r\n.\r\n")
+
+		(*gounit.T)(t).AssertEqualsInt(0, len(messages))
+		(*gounit.T)(t).AssertEqualsInt(5, len(replies))
+		(*gounit.T)(t).AssertEqualsString("Line too long.", replies[4].lines[0])
+	}
+}
+
+func TestBareLineEndingInCommand(t *testing.T) {
+	protocol := CreateProtocol("", nil, &Validation{LineEndings: LineEndingsStrict})
+	reply := protocol.HandleReceivedRawLine([]byte("QUIT\n"))
+	(*gounit.T)(t).AssertEqualsInt(CODE_COMMAND_SYNTAX_ERROR, reply.Status)
+
+	reply = protocol.HandleReceivedRawLine([]byte("QUIT\r\n"))
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_CLOSING, reply.Status)
+
+	protocol = CreateProtocol("", nil, &Validation{LineEndings: LineEndingsNormalize})
+	reply = protocol.HandleReceivedRawLine([]byte("QUIT\n"))
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_CLOSING, reply.Status)
+
+	reply = protocol.HandleReceivedRawLine([]byte("QU\rIT\r\n"))
+	(*gounit.T)(t).AssertEqualsInt(CODE_COMMAND_SYNTAX_ERROR, reply.Status)
+}
+
+func TestDotStuffing(t *testing.T) {
+	protocol := CreateProtocol("", nil, nil)
+	message := sendTestMessage(protocol, "DATA", "Subject: test", "", "..", "..foo", ".")
+
+	(*gounit.T)(t).AssertEqualsString("Subject: test\r\n\r\n.\r\n.foo", message.GetOrigin())
+}
@@ -0,0 +1,741 @@
+package smtpServerProtocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mailhedgehog/smtpMessage"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// milterVersion is version of milter protocol implemented by Sendmail libmilter 8.14+ and Postfix.
+const milterVersion = 6
+
+// List of commands sent to milter (SMFIC_*).
+const (
+	milterOptionNegotiation = 'O'
+	milterConnect           = 'C'
+	milterHelo              = 'H'
+	milterMail              = 'M'
+	milterRcpt              = 'R'
+	milterData              = 'T'
+	milterHeader            = 'L'
+	milterEndOfHeaders      = 'N'
+	milterBody              = 'B'
+	milterEndOfBody         = 'E'
+	milterAbort             = 'A'
+	milterQuit              = 'Q'
+	milterMacro             = 'D'
+)
+
+// List of responses and modification actions received from milter (SMFIR_*).
+const (
+	milterAccept       = 'a'
+	milterContinue     = 'c'
+	milterDiscard      = 'd'
+	milterReject       = 'r'
+	milterTempFail     = 't'
+	milterReplyCode    = 'y'
+	milterSkip         = 's'
+	milterProgress     = 'p'
+	milterAddHeader    = 'h'
+	milterInsertHeader = 'i'
+	milterChangeHeader = 'm'
+	milterReplaceBody  = 'b'
+	milterAddRcpt      = '+'
+	milterAddRcptPar   = '2'
+	milterDeleteRcpt   = '-'
+	milterChangeFrom   = 'e'
+	milterQuarantine   = 'q'
+)
+
+// List of modifications what milter allowed to do (SMFIF_*).
+const (
+	milterActionAddHeaders    = 0x01
+	milterActionChangeBody    = 0x02
+	milterActionAddRcpt       = 0x04
+	milterActionDeleteRcpt    = 0x08
+	milterActionChangeHeaders = 0x10
+	milterActionQuarantine    = 0x20
+	milterActionChangeFrom    = 0x40
+	milterActionAddRcptPar    = 0x80
+	milterActions             = 0xff
+)
+
+// List of protocol steps what milter can skip or leave without reply (SMFIP_*).
+const (
+	milterNoConnect           = 0x01
+	milterNoHelo              = 0x02
+	milterNoMail              = 0x04
+	milterNoRcpt              = 0x08
+	milterNoBody              = 0x10
+	milterNoHeaders           = 0x20
+	milterNoEndOfHeaders      = 0x40
+	milterNoReplyHeader       = 0x80
+	milterNoUnknown           = 0x100
+	milterNoData              = 0x200
+	milterSkipBody            = 0x400
+	milterNoReplyConnect      = 0x1000
+	milterNoReplyHelo         = 0x2000
+	milterNoReplyMail         = 0x4000
+	milterNoReplyRcpt         = 0x8000
+	milterNoReplyData         = 0x10000
+	milterNoReplyEndOfHeaders = 0x40000
+	milterNoReplyBody         = 0x80000
+	milterHeaderLeadingSpace  = 0x100000
+	milterProtocolSteps       = 0x7ff | 0xdf000 | milterHeaderLeadingSpace
+)
+
+// milterSteps maps command to flags what allow milter to skip it and to not reply to it.
+var milterSteps = map[byte][2]uint32{
+	milterConnect:      {milterNoConnect, milterNoReplyConnect},
+	milterHelo:         {milterNoHelo, milterNoReplyHelo},
+	milterMail:         {milterNoMail, milterNoReplyMail},
+	milterRcpt:         {milterNoRcpt, milterNoReplyRcpt},
+	milterData:         {milterNoData, milterNoReplyData},
+	milterHeader:       {milterNoHeaders, milterNoReplyHeader},
+	milterEndOfHeaders: {milterNoEndOfHeaders, milterNoReplyEndOfHeaders},
+	milterBody:         {milterNoBody, milterNoReplyBody},
+}
+
+const (
+	// milterBodyChunkSize is maximal size of body chunk (MILTER_CHUNK_SIZE).
+	milterBodyChunkSize = 65535
+	// milterMaximumPacketSize protects from reading broken packets.
+	milterMaximumPacketSize = 1 << 20
+	// milterDefaultTimeout limits each milter operation.
+	milterDefaultTimeout = 30 * time.Second
+)
+
+// milterPacket is command or response of milter protocol.
+type milterPacket struct {
+	command byte
+	data    []byte
+}
+
+// MilterPolicy streams session events to Sendmail/Postfix compatible content filter (milter protocol v6)
+// and applies returned actions before message passed to OnMessageReceived callback.
+// Policy keeps connection to milter, so new policy should be created for each protocol.
+type MilterPolicy struct {
+	// Network is "tcp" or "unix".
+	Network string
+	Address string
+	// Timeout limits each milter operation.
+	Timeout time.Duration
+	// FailOpen accepts messages when milter is unavailable, by default they are temporarily rejected.
+	FailOpen bool
+
+	conn    net.Conn
+	reader  *bufio.Reader
+	actions uint32
+	steps   uint32
+	// failed is true when milter is unavailable for rest of session.
+	failed bool
+	// skipSession and skipTransaction are set when milter accepted session or message.
+	skipSession     bool
+	skipTransaction bool
+	// transaction is true when MAIL sent, but message was not finished.
+	transaction bool
+}
+
+// CreateMilterPolicy creates policy what connects to milter, for example ("unix", "/var/run/opendkim.sock").
+func CreateMilterPolicy(network string, address string) *MilterPolicy {
+	return &MilterPolicy{
+		Network: network,
+		Address: address,
+		Timeout: milterDefaultTimeout,
+	}
+}
+
+func (policy *MilterPolicy) CheckConnect(protocol *Protocol) *Reply {
+	reply := policy.open(protocol)
+	if reply == nil || policy.failed {
+		// Unavailable milter does not refuse greeting, next commands are temporarily rejected.
+		return nil
+	}
+	if reply.Status >= 500 {
+		return ReplyTransactionFailed(reply.lines[0])
+	}
+
+	return ReplyServiceNotAvailable(reply.lines[0])
+}
+
+func (policy *MilterPolicy) CheckHelo(protocol *Protocol, helo string) *Reply {
+	if reply := policy.open(protocol); reply != nil {
+		return reply
+	}
+
+	macros := map[string]string{}
+	if protocol.tlsState != nil {
+		macros["{tls_version}"] = tlsVersionName(protocol.tlsState.Version)
+	}
+	policy.sendMacros(milterHelo, macros)
+
+	return policy.exchange(protocol, milterHelo, milterStrings(helo), true)
+}
+
+func (policy *MilterPolicy) CheckMail(protocol *Protocol, path *smtpMessage.MessagePath) *Reply {
+	if reply := policy.open(protocol); reply != nil {
+		return reply
+	}
+
+	if policy.transaction && !policy.skipSession && !policy.failed {
+		if err := policy.write(milterAbort, nil); err != nil {
+			return policy.failure(err)
+		}
+	}
+	policy.transaction = true
+	policy.skipTransaction = false
+
+	sender := "<>"
+	if path != nil {
+		sender = "<" + path.Address() + ">"
+	}
+	macros := map[string]string{"{mail_addr}": strings.Trim(sender, "<>")}
+	if len(protocol.authIdentity) > 0 {
+		macros["{auth_authen}"] = protocol.authIdentity
+	}
+	policy.sendMacros(milterMail, macros)
+
+	return policy.exchange(protocol, milterMail, milterStrings(sender), false)
+}
+
+func (policy *MilterPolicy) CheckRcpt(protocol *Protocol, path *smtpMessage.MessagePath) *Reply {
+	if reply := policy.open(protocol); reply != nil {
+		return reply
+	}
+
+	policy.sendMacros(milterRcpt, map[string]string{"{rcpt_addr}": path.Address()})
+
+	return policy.exchange(protocol, milterRcpt, milterStrings("<"+path.Address()+">"), false)
+}
+
+func (policy *MilterPolicy) CheckData(protocol *Protocol, origin string) *Reply {
+	if reply := policy.open(protocol); reply != nil {
+		return reply
+	}
+	policy.sendMacros(milterData, map[string]string{"i": string(protocol.message.ID)})
+
+	headers, body := splitMessage(origin)
+	if reply := policy.exchange(protocol, milterData, nil, false); reply != nil || policy.skipped() {
+		return reply
+	}
+	for _, field := range headers {
+		value := strings.ReplaceAll(field.value, CommandEndSymbol, "\n")
+		if policy.steps&milterHeaderLeadingSpace == 0 {
+			value = strings.TrimPrefix(value, " ")
+		}
+		if reply := policy.exchange(protocol, milterHeader, milterStrings(field.fieldName(), value), false); reply != nil || policy.skipped() {
+			return reply
+		}
+	}
+	if reply := policy.exchange(protocol, milterEndOfHeaders, nil, false); reply != nil || policy.skipped() {
+		return reply
+	}
+
+	if len(body) > 0 {
+		body += CommandEndSymbol
+	}
+	for len(body) > 0 && policy.steps&milterNoBody == 0 {
+		size := len(body)
+		if size > milterBodyChunkSize {
+			size = milterBodyChunkSize
+		}
+		response, err := policy.send(milterBody, []byte(body[:size]))
+		if err != nil {
+			return policy.failure(err)
+		}
+		body = body[size:]
+		if response.command == milterSkip {
+			break
+		}
+		if reply := policy.reply(protocol, response, false); reply != nil || policy.skipped() {
+			return reply
+		}
+	}
+
+	return policy.endOfBody(protocol, origin)
+}
+
+// endOfBody finishes message and applies modifications received before final response.
+func (policy *MilterPolicy) endOfBody(protocol *Protocol, origin string) *Reply {
+	policy.sendMacros(milterEndOfBody, map[string]string{"i": string(protocol.message.ID)})
+	if err := policy.write(milterEndOfBody, nil); err != nil {
+		return policy.failure(err)
+	}
+	policy.transaction = false
+
+	var modifications []*milterPacket
+	for {
+		response, err := policy.readResponse()
+		if err != nil {
+			return policy.failure(err)
+		}
+		if !isMilterModification(response.command) {
+			if reply := policy.reply(protocol, response, false); reply != nil || protocol.discardMessage {
+				return reply
+			}
+			break
+		}
+		modifications = append(modifications, response)
+	}
+
+	if len(modifications) > 0 {
+		if err := policy.applyModifications(protocol, origin, modifications); err != nil {
+			return policy.failure(err)
+		}
+	}
+
+	return nil
+}
+
+func (policy *MilterPolicy) Close(protocol *Protocol) {
+	if policy.conn == nil {
+		return
+	}
+
+	if err := policy.write(milterQuit, nil); err != nil {
+		logManager().Debug(fmt.Sprintf("Unable to send quit to milter: %s", err.Error()))
+	}
+	policy.conn.Close()
+	policy.conn = nil
+}
+
+// open connects to milter, negotiates options and sends connect information.
+func (policy *MilterPolicy) open(protocol *Protocol) *Reply {
+	if policy.failed {
+		return policy.failureReply()
+	}
+	if policy.conn != nil || policy.skipSession {
+		return nil
+	}
+
+	conn, err := net.DialTimeout(policy.Network, policy.Address, policy.timeout())
+	if err != nil {
+		return policy.failure(err)
+	}
+	policy.conn = conn
+	policy.reader = bufio.NewReader(conn)
+
+	if err = policy.negotiate(); err != nil {
+		return policy.failure(err)
+	}
+
+	hostname := "[unknown]"
+	data := []byte{}
+	if protocol.Ip != nil {
+		hostname = addressLiteral(protocol.Ip.IP)
+		if len(protocol.session.ReverseHostname) > 0 {
+			hostname = protocol.session.ReverseHostname
+		}
+
+		family := byte('6')
+		if protocol.Ip.IP.To4() != nil {
+			family = '4'
+		}
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, uint16(protocol.Ip.Port))
+		data = append(milterStrings(hostname), family)
+		data = append(data, port...)
+		data = append(data, milterStrings(protocol.Ip.IP.String())...)
+	} else {
+		data = append(milterStrings(hostname), 'U')
+	}
+
+	macros := map[string]string{"j": protocol.authServId(), "{daemon_name}": protocol.authServId()}
+	if protocol.Ip != nil {
+		macros["{client_addr}"] = protocol.Ip.IP.String()
+		macros["{client_name}"] = hostname
+	}
+	policy.sendMacros(milterConnect, macros)
+
+	return policy.exchange(protocol, milterConnect, data, true)
+}
+
+// negotiate exchanges supported protocol version, actions and steps (SMFIC_OPTNEG).
+func (policy *MilterPolicy) negotiate() error {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[0:], milterVersion)
+	binary.BigEndian.PutUint32(data[4:], milterActions)
+	binary.BigEndian.PutUint32(data[8:], milterProtocolSteps)
+	if err := policy.write(milterOptionNegotiation, data); err != nil {
+		return err
+	}
+
+	response, err := policy.readPacket()
+	if err != nil {
+		return err
+	}
+	if response.command != milterOptionNegotiation || len(response.data) < 12 {
+		return errors.New("unexpected milter negotiation response")
+	}
+	version := binary.BigEndian.Uint32(response.data[0:])
+	if version < 2 || version > milterVersion {
+		return fmt.Errorf("unsupported milter version %d", version)
+	}
+	policy.actions = binary.BigEndian.Uint32(response.data[4:]) & milterActions
+	policy.steps = binary.BigEndian.Uint32(response.data[8:]) & milterProtocolSteps
+
+	return nil
+}
+
+// exchange sends command and converts milter response to reply, nil means continue.
+func (policy *MilterPolicy) exchange(protocol *Protocol, command byte, data []byte, sessionStage bool) *Reply {
+	if policy.skipped() {
+		return nil
+	}
+
+	response, err := policy.send(command, data)
+	if err != nil {
+		return policy.failure(err)
+	}
+
+	return policy.reply(protocol, response, sessionStage)
+}
+
+// send writes command and reads response, skipped and not replied steps treated as continue.
+func (policy *MilterPolicy) send(command byte, data []byte) (*milterPacket, error) {
+	flags := milterSteps[command]
+	if policy.steps&flags[0] != 0 {
+		return &milterPacket{command: milterContinue}, nil
+	}
+	if err := policy.write(command, data); err != nil {
+		return nil, err
+	}
+	if policy.steps&flags[1] != 0 {
+		return &milterPacket{command: milterContinue}, nil
+	}
+
+	return policy.readResponse()
+}
+
+// reply converts final response to reply, sessionStage is true for connect and helo stages.
+func (policy *MilterPolicy) reply(protocol *Protocol, response *milterPacket, sessionStage bool) *Reply {
+	switch response.command {
+	case milterContinue, milterSkip:
+		return nil
+	case milterAccept:
+		if sessionStage {
+			policy.skipSession = true
+		}
+		policy.skipTransaction = true
+		return nil
+	case milterDiscard:
+		protocol.Discard()
+		policy.skipTransaction = true
+		return nil
+	case milterReject:
+		return ReplyMailbox404("5.7.1 Command rejected")
+	case milterTempFail:
+		return ReplyLocalError("4.7.1 Service unavailable - try again later")
+	case milterReplyCode:
+		if reply := parseMilterReplyCode(string(response.data)); reply != nil {
+			return reply
+		}
+		return ReplyLocalError("4.7.1 Service unavailable - try again later")
+	}
+
+	return policy.failure(fmt.Errorf("unexpected milter response %q", response.command))
+}
+
+// skipped is true when rest of events should not be sent to milter.
+func (policy *MilterPolicy) skipped() bool {
+	return policy.failed || policy.skipSession || policy.skipTransaction
+}
+
+// applyModifications changes current message using actions received at end of body.
+func (policy *MilterPolicy) applyModifications(protocol *Protocol, origin string, modifications []*milterPacket) error {
+	headers, body := splitMessage(origin)
+	bodyReplaced := false
+
+	for _, modification := range modifications {
+		if !policy.isAllowed(modification.command) {
+			logManager().Warning(fmt.Sprintf("Milter modification %q was not negotiated", modification.command))
+			continue
+		}
+
+		data := modification.data
+		index := 0
+		if modification.command == milterInsertHeader || modification.command == milterChangeHeader {
+			if len(data) < 4 {
+				return errors.New("malformed milter header modification")
+			}
+			index = int(binary.BigEndian.Uint32(data))
+			data = data[4:]
+		}
+		values := splitMilterStrings(data)
+
+		switch modification.command {
+		case milterAddHeader, milterInsertHeader:
+			if len(values) < 2 {
+				return errors.New("malformed milter header modification")
+			}
+			field := headerField{name: values[0], value: policy.headerValue(values[1])}
+			if modification.command == milterAddHeader || index > len(headers) {
+				index = len(headers)
+			}
+			headers = append(headers[:index], append([]headerField{field}, headers[index:]...)...)
+		case milterChangeHeader:
+			if len(values) < 2 {
+				return errors.New("malformed milter header modification")
+			}
+			headers = policy.changeHeader(headers, index, values[0], values[1])
+		case milterReplaceBody:
+			if !bodyReplaced {
+				body = ""
+				bodyReplaced = true
+			}
+			body += string(modification.data)
+		case milterAddRcpt, milterAddRcptPar:
+			if len(values) < 1 {
+				return errors.New("malformed milter recipient modification")
+			}
+			path, err := smtpMessage.MessagePathFromString(values[0])
+			if err != nil {
+				return err
+			}
+			protocol.message.To = append(protocol.message.To, path)
+		case milterDeleteRcpt:
+			if len(values) < 1 {
+				return errors.New("malformed milter recipient modification")
+			}
+			address := strings.Trim(values[0], "<>")
+			for i := len(protocol.message.To) - 1; i >= 0; i-- {
+				if strings.EqualFold(protocol.message.To[i].Address(), address) {
+					protocol.message.To = append(protocol.message.To[:i], protocol.message.To[i+1:]...)
+				}
+			}
+		case milterChangeFrom:
+			if len(values) < 1 {
+				return errors.New("malformed milter sender modification")
+			}
+			protocol.message.From = nil
+			if strings.Trim(values[0], "<>") != "" {
+				path, err := smtpMessage.MessagePathFromString(values[0])
+				if err != nil {
+					return err
+				}
+				protocol.message.From = path
+			}
+		case milterQuarantine:
+			reason := ""
+			if len(values) > 0 {
+				reason = values[0]
+			}
+			protocol.Quarantine(reason)
+		}
+	}
+
+	content := ""
+	for _, field := range headers {
+		content += field.name + ":" + field.value + CommandEndSymbol
+	}
+	protocol.ReplaceMessageContent(content + CommandEndSymbol + body)
+
+	return nil
+}
+
+// changeHeader changes index occurrence (starting from 1) of header, empty value removes header.
+func (policy *MilterPolicy) changeHeader(headers []headerField, index int, name string, value string) []headerField {
+	occurrence := 0
+	for i, field := range headers {
+		if !strings.EqualFold(field.fieldName(), name) {
+			continue
+		}
+		occurrence++
+		if occurrence != index && index > 0 {
+			continue
+		}
+		if len(value) == 0 {
+			return append(headers[:i], headers[i+1:]...)
+		}
+		headers[i].value = policy.headerValue(value)
+		return headers
+	}
+
+	if len(value) == 0 {
+		return headers
+	}
+	return append(headers, headerField{name: name, value: policy.headerValue(value)})
+}
+
+// headerValue converts value received from milter to header field value.
+func (policy *MilterPolicy) headerValue(value string) string {
+	value = strings.ReplaceAll(strings.ReplaceAll(value, CommandEndSymbol, "\n"), "\n", CommandEndSymbol)
+	if policy.steps&milterHeaderLeadingSpace == 0 {
+		value = " " + value
+	}
+	return value
+}
+
+func (policy *MilterPolicy) isAllowed(command byte) bool {
+	switch command {
+	case milterAddHeader, milterInsertHeader:
+		return policy.actions&milterActionAddHeaders != 0
+	case milterChangeHeader:
+		return policy.actions&milterActionChangeHeaders != 0
+	case milterReplaceBody:
+		return policy.actions&milterActionChangeBody != 0
+	case milterAddRcpt:
+		return policy.actions&milterActionAddRcpt != 0
+	case milterAddRcptPar:
+		return policy.actions&milterActionAddRcptPar != 0
+	case milterDeleteRcpt:
+		return policy.actions&milterActionDeleteRcpt != 0
+	case milterChangeFrom:
+		return policy.actions&milterActionChangeFrom != 0
+	case milterQuarantine:
+		return policy.actions&milterActionQuarantine != 0
+	}
+	return false
+}
+
+// sendMacros sends macro values what will be available to milter for next command, macros have no reply.
+func (policy *MilterPolicy) sendMacros(command byte, macros map[string]string) {
+	if policy.conn == nil || policy.skipped() || len(macros) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(macros))
+	for name := range macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	data := []byte{command}
+	for _, name := range names {
+		data = append(data, milterStrings(name, macros[name])...)
+	}
+	if err := policy.write(milterMacro, data); err != nil {
+		logManager().Debug(fmt.Sprintf("Unable to send macros to milter: %s", err.Error()))
+	}
+}
+
+// failure closes broken milter connection and returns reply according to FailOpen option.
+func (policy *MilterPolicy) failure(err error) *Reply {
+	logManager().Error(fmt.Sprintf("Milter %s %s failed: %s", policy.Network, policy.Address, err.Error()))
+
+	policy.failed = true
+	if policy.conn != nil {
+		policy.conn.Close()
+		policy.conn = nil
+	}
+
+	return policy.failureReply()
+}
+
+func (policy *MilterPolicy) failureReply() *Reply {
+	if policy.FailOpen {
+		return nil
+	}
+	return ReplyLocalError("4.7.1 Service unavailable - try again later")
+}
+
+func (policy *MilterPolicy) write(command byte, data []byte) error {
+	if policy.conn == nil {
+		return errors.New("milter connection closed")
+	}
+	if err := policy.conn.SetDeadline(time.Now().Add(policy.timeout())); err != nil {
+		return err
+	}
+
+	packet := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(len(data)+1))
+	packet[4] = command
+	_, err := policy.conn.Write(append(packet, data...))
+
+	return err
+}
+
+// readResponse reads response, progress notifications only extend timeout.
+func (policy *MilterPolicy) readResponse() (*milterPacket, error) {
+	for {
+		packet, err := policy.readPacket()
+		if err != nil || packet.command != milterProgress {
+			return packet, err
+		}
+	}
+}
+
+func (policy *MilterPolicy) readPacket() (*milterPacket, error) {
+	if err := policy.conn.SetDeadline(time.Now().Add(policy.timeout())); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(policy.reader, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size < 1 || size > milterMaximumPacketSize {
+		return nil, fmt.Errorf("invalid milter packet size %d", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(policy.reader, data); err != nil {
+		return nil, err
+	}
+
+	return &milterPacket{command: data[0], data: data[1:]}, nil
+}
+
+func (policy *MilterPolicy) timeout() time.Duration {
+	if policy.Timeout > 0 {
+		return policy.Timeout
+	}
+	return milterDefaultTimeout
+}
+
+func isMilterModification(command byte) bool {
+	switch command {
+	case milterAddHeader, milterInsertHeader, milterChangeHeader, milterReplaceBody,
+		milterAddRcpt, milterAddRcptPar, milterDeleteRcpt, milterChangeFrom, milterQuarantine:
+		return true
+	}
+	return false
+}
+
+// parseMilterReplyCode parses custom reply, for example "550 5.7.1 Message rejected", nil when reply is invalid.
+func parseMilterReplyCode(text string) *Reply {
+	lines := strings.Split(strings.TrimRight(text, "\x00\r\n"), CommandEndSymbol)
+	if len(lines[0]) < 3 {
+		return nil
+	}
+	status, err := strconv.Atoi(lines[0][:3])
+	if err != nil || status < 400 || status > 599 {
+		return nil
+	}
+
+	for i, line := range lines {
+		if len(line) > 4 {
+			lines[i] = line[4:]
+		} else {
+			lines[i] = ""
+		}
+	}
+
+	return &Reply{Status: status, lines: lines}
+}
+
+// milterStrings encodes values as null terminated strings.
+func milterStrings(values ...string) []byte {
+	var data []byte
+	for _, value := range values {
+		data = append(data, value...)
+		data = append(data, 0)
+	}
+	return data
+}
+
+func splitMilterStrings(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+}
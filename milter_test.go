@@ -0,0 +1,329 @@
+package smtpServerProtocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/mailhedgehog/gounit"
+	"github.com/mailhedgehog/smtpMessage"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeMilter is in-process milter what records received events and returns scripted responses.
+type fakeMilter struct {
+	listener net.Listener
+	actions  uint32
+	steps    uint32
+	// responses contains packets sent as reply to command, by default milter continues.
+	responses map[byte][]*milterPacket
+
+	mutex  sync.Mutex
+	events []string
+	macros map[string]string
+	closed chan struct{}
+}
+
+func startFakeMilter(t *testing.T, actions uint32, steps uint32) *fakeMilter {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	(*gounit.T)(t).AssertNotError(err)
+
+	milter := &fakeMilter{
+		listener:  listener,
+		actions:   actions,
+		steps:     steps,
+		responses: map[byte][]*milterPacket{},
+		macros:    map[string]string{},
+		closed:    make(chan struct{}),
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer close(milter.closed)
+		defer conn.Close()
+		milter.serve(conn)
+	}()
+
+	return milter
+}
+
+func (milter *fakeMilter) policy() *MilterPolicy {
+	return CreateMilterPolicy("tcp", milter.listener.Addr().String())
+}
+
+func (milter *fakeMilter) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return
+		}
+		command := data[0]
+		data = data[1:]
+
+		switch command {
+		case milterOptionNegotiation:
+			response := make([]byte, 12)
+			binary.BigEndian.PutUint32(response[0:], milterVersion)
+			binary.BigEndian.PutUint32(response[4:], milter.actions)
+			binary.BigEndian.PutUint32(response[8:], milter.steps)
+			milter.write(conn, &milterPacket{command: milterOptionNegotiation, data: response})
+			continue
+		case milterMacro:
+			values := splitMilterStrings(data[1:])
+			milter.mutex.Lock()
+			for i := 0; i+1 < len(values); i += 2 {
+				milter.macros[values[i]] = values[i+1]
+			}
+			milter.mutex.Unlock()
+			continue
+		}
+
+		event := string(command)
+		switch command {
+		case milterBody:
+			event += " " + string(data)
+		case milterConnect, milterHelo, milterMail, milterRcpt:
+			event += " " + splitMilterStrings(data)[0]
+		case milterHeader:
+			values := splitMilterStrings(data)
+			event += " " + values[0] + ":" + values[1]
+		}
+		milter.mutex.Lock()
+		milter.events = append(milter.events, event)
+		milter.mutex.Unlock()
+
+		if command == milterQuit {
+			return
+		}
+		if command == milterAbort || milter.steps&milterSteps[command][1] != 0 {
+			continue
+		}
+
+		responses, ok := milter.responses[command]
+		if !ok {
+			responses = []*milterPacket{{command: milterContinue}}
+		}
+		for _, response := range responses {
+			milter.write(conn, response)
+		}
+	}
+}
+
+func (milter *fakeMilter) write(conn net.Conn, packet *milterPacket) {
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header, uint32(len(packet.data)+1))
+	header[4] = packet.command
+	conn.Write(append(header, packet.data...))
+}
+
+func (milter *fakeMilter) receivedEvents() []string {
+	milter.mutex.Lock()
+	defer milter.mutex.Unlock()
+	return append([]string{}, milter.events...)
+}
+
+func (milter *fakeMilter) macro(name string) string {
+	milter.mutex.Lock()
+	defer milter.mutex.Unlock()
+	return milter.macros[name]
+}
+
+func headerModification(command byte, index uint32, values ...string) *milterPacket {
+	data := []byte{}
+	if command == milterInsertHeader || command == milterChangeHeader {
+		data = make([]byte, 4)
+		binary.BigEndian.PutUint32(data, index)
+	}
+	return &milterPacket{command: command, data: append(data, milterStrings(values...)...)}
+}
+
+func TestMilterPolicy(t *testing.T) {
+	milter := startFakeMilter(t, milterActions, 0)
+	milter.responses[milterEndOfBody] = []*milterPacket{
+		headerModification(milterAddHeader, 0, "X-Milter", "checked"),
+		headerModification(milterInsertHeader, 0, "X-First", "inserted"),
+		headerModification(milterChangeHeader, 1, "Subject", "[SPAM] test"),
+		headerModification(milterChangeHeader, 1, "X-Remove", ""),
+		{command: milterReplaceBody, data: []byte("new body\r\n")},
+		{command: milterAddRcpt, data: milterStrings("<copy@example.com>")},
+		{command: milterDeleteRcpt, data: milterStrings("<admin@example.com>")},
+		{command: milterChangeFrom, data: milterStrings("<bounce@example.org>")},
+		{command: milterQuarantine, data: milterStrings("suspicious")},
+		{command: milterProgress},
+		{command: milterAccept},
+	}
+
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2525}, nil)
+	protocol.AddPolicy(milter.policy())
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_READY, protocol.SayWelcome("").Status)
+
+	var message *smtpMessage.SmtpMessage
+	quarantineReason := ""
+	protocol.OnMessageReceived(func(received *smtpMessage.SmtpMessage) (string, error) {
+		message = received
+		quarantineReason = protocol.QuarantineReason()
+		return string(received.ID), nil
+	})
+	for _, line := range []string{"EHLO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>",
+		"DATA", "Subject: test", "X-Remove: value", "", "body", "."} {
+		protocol.HandleReceivedLine(line)
+	}
+
+	(*gounit.T)(t).AssertEqualsString("X-First: inserted\r\nSubject: [SPAM] test\r\nX-Milter: checked\r\n\r\nnew body", message.GetOrigin())
+	(*gounit.T)(t).AssertEqualsString("bounce@example.org", message.From.Address())
+	(*gounit.T)(t).AssertEqualsInt(1, len(message.To))
+	(*gounit.T)(t).AssertEqualsString("copy@example.com", message.To[0].Address())
+	(*gounit.T)(t).AssertEqualsString("suspicious", quarantineReason)
+
+	protocol.Close()
+	<-milter.closed
+	(*gounit.T)(t).AssertEqualsString(strings.Join([]string{
+		"C [192.0.2.1]", "H client.example.org", "M <joe@example.org>", "R <admin@example.com>", "T",
+		"L Subject:test", "L X-Remove:value", "N", "B body\r\n", "E", "Q",
+	}, ","), strings.Join(milter.receivedEvents(), ","))
+	(*gounit.T)(t).AssertEqualsString("192.0.2.1", milter.macro("{client_addr}"))
+	(*gounit.T)(t).AssertEqualsString("joe@example.org", milter.macro("{mail_addr}"))
+	(*gounit.T)(t).AssertEqualsString("admin@example.com", milter.macro("{rcpt_addr}"))
+	(*gounit.T)(t).AssertEqualsString(string(message.ID), milter.macro("i"))
+}
+
+func TestMilterPolicyReject(t *testing.T) {
+	milter := startFakeMilter(t, milterActions, 0)
+	milter.responses[milterRcpt] = []*milterPacket{{command: milterReject}}
+	milter.responses[milterEndOfBody] = []*milterPacket{{command: milterReplyCode, data: milterStrings("554 5.7.1 Message contains virus")}}
+
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.AddPolicy(milter.policy())
+
+	var replies []*Reply
+	for _, line := range []string{"HELO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>"} {
+		replies = append(replies, protocol.HandleReceivedLine(line))
+	}
+	(*gounit.T)(t).AssertEqualsInt(CODE_MAILBOX_404, replies[2].Status)
+	(*gounit.T)(t).AssertEqualsString("5.7.1 Command rejected", replies[2].lines[0])
+
+	message := sendTestMessage(protocol, "RSET", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>", "DATA", "Subject: test", "", "body")
+	reply := protocol.HandleReceivedLine(".")
+	(*gounit.T)(t).AssertNil(message)
+	(*gounit.T)(t).AssertEqualsInt(CODE_TRANSACTION_FAILED, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("5.7.1 Message contains virus", reply.lines[0])
+
+	protocol.Close()
+	<-milter.closed
+	(*gounit.T)(t).AssertEqualsString("C [unknown],H client.example.org,M <joe@example.org>,R <admin@example.com>,A,M <joe@example.org>",
+		strings.Join(milter.receivedEvents()[:6], ","))
+}
+
+func TestMilterPolicyDiscard(t *testing.T) {
+	milter := startFakeMilter(t, milterActions, 0)
+	milter.responses[milterHeader] = []*milterPacket{{command: milterDiscard}}
+
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.AddPolicy(milter.policy())
+
+	message := sendTestMessage(protocol, "HELO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>",
+		"DATA", "Subject: test", "", "body")
+	reply := protocol.HandleReceivedLine(".")
+
+	(*gounit.T)(t).AssertNil(message)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, reply.Status)
+}
+
+func TestMilterPolicyAcceptSession(t *testing.T) {
+	milter := startFakeMilter(t, milterActions, milterNoHeaders|milterNoReplyRcpt)
+	milter.responses[milterConnect] = []*milterPacket{{command: milterAccept}}
+
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.AddPolicy(milter.policy())
+	protocol.SayWelcome("")
+
+	message := sendTestMessage(protocol, "HELO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>",
+		"DATA", "Subject: test", "", "body", ".")
+	(*gounit.T)(t).AssertEqualsString("Subject: test\r\n\r\nbody", message.GetOrigin())
+
+	protocol.Close()
+	<-milter.closed
+	(*gounit.T)(t).AssertEqualsString("C [unknown],Q", strings.Join(milter.receivedEvents(), ","))
+}
+
+func TestMilterPolicyAcceptHelo(t *testing.T) {
+	milter := startFakeMilter(t, milterActions, milterNoHeaders|milterNoReplyRcpt)
+	milter.responses[milterHelo] = []*milterPacket{{command: milterAccept}}
+
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.AddPolicy(milter.policy())
+	protocol.SayWelcome("")
+
+	sendTestMessage(protocol, "HELO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>",
+		"DATA", "Subject: test", "", "body", ".")
+	message := sendTestMessage(protocol, "MAIL FROM:<jane@example.org>", "RCPT TO:<admin@example.com>",
+		"DATA", "Subject: second", "", "body", ".")
+	(*gounit.T)(t).AssertEqualsString("Subject: second\r\n\r\nbody", message.GetOrigin())
+
+	protocol.Close()
+	<-milter.closed
+	(*gounit.T)(t).AssertEqualsString("C [unknown],H client.example.org,Q", strings.Join(milter.receivedEvents(), ","))
+}
+
+func TestMilterPolicySkippedSteps(t *testing.T) {
+	milter := startFakeMilter(t, 0, milterNoHeaders|milterNoReplyRcpt|milterNoBody)
+	milter.responses[milterEndOfBody] = []*milterPacket{headerModification(milterAddHeader, 0, "X-Milter", "checked"), {command: milterContinue}}
+
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.AddPolicy(milter.policy())
+
+	message := sendTestMessage(protocol, "HELO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>",
+		"DATA", "Subject: test", "", "body", ".")
+	// Modification was not negotiated.
+	(*gounit.T)(t).AssertEqualsString("Subject: test\r\n\r\nbody", message.GetOrigin())
+
+	protocol.Close()
+	<-milter.closed
+	(*gounit.T)(t).AssertEqualsString("C [unknown],H client.example.org,M <joe@example.org>,R <admin@example.com>,T,N,E,Q",
+		strings.Join(milter.receivedEvents(), ","))
+}
+
+func TestMilterPolicyUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	(*gounit.T)(t).AssertNotError(err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.AddPolicy(CreateMilterPolicy("tcp", address))
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_READY, protocol.SayWelcome("").Status)
+
+	reply := protocol.HandleReceivedLine("HELO client.example.org")
+	(*gounit.T)(t).AssertEqualsInt(CODE_LOCAL_ERROR, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("4.7.1 Service unavailable - try again later", reply.lines[0])
+
+	policy := CreateMilterPolicy("tcp", address)
+	policy.FailOpen = true
+	protocol = CreateProtocol("mx.example.com", nil, nil)
+	protocol.AddPolicy(policy)
+
+	message := sendTestMessage(protocol, "HELO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>",
+		"DATA", "Subject: test", "", "body", ".")
+	(*gounit.T)(t).AssertEqualsString("Subject: test\r\n\r\nbody", message.GetOrigin())
+}
+
+func TestParseMilterReplyCode(t *testing.T) {
+	reply := parseMilterReplyCode("452 4.3.1 Insufficient\r\n452 4.3.1 storage\x00")
+	(*gounit.T)(t).AssertEqualsInt(452, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("4.3.1 Insufficient", reply.lines[0])
+	(*gounit.T)(t).AssertEqualsString("4.3.1 storage", reply.lines[1])
+
+	(*gounit.T)(t).AssertNil(parseMilterReplyCode("250 Ok"))
+	(*gounit.T)(t).AssertNil(parseMilterReplyCode("xx"))
+}
@@ -0,0 +1,92 @@
+package smtpServerProtocol
+
+import (
+	"bytes"
+)
+
+// HandleReceivedData handles chunk of bytes exactly as it was read from connection. Chunk can
+// contain several pipelined commands (rfc2920), message data and incomplete line, what is buffered
+// till next call. Returned replies should be written to client in one flush.
+// Processing stops after reply what requires action from connection driver, for example STARTTLS.
+func (protocol *Protocol) HandleReceivedData(chunk []byte) []*Reply {
+	protocol.inputBuffer = append(protocol.inputBuffer, chunk...)
+
+	// Data received before greeting is kept in buffer till greeting sent.
+	if !protocol.greeted && protocol.earlyTalkerDetection != nil {
+		if len(chunk) > 0 {
+			if reply := protocol.reportEarlyTalker(ViolationPreGreeting); reply != nil {
+				return []*Reply{reply}
+			}
+		}
+		if len(protocol.inputBuffer) > maximumPendingLineLength {
+			protocol.inputBuffer = nil
+			protocol.state = StateClosed
+			return []*Reply{ReplyServiceNotAvailable("4.7.0 Too much data before greeting")}
+		}
+		return nil
+	}
+
+	var replies []*Reply
+	for {
+		index := bytes.IndexByte(protocol.inputBuffer, '\n')
+		if index < 0 {
+			break
+		}
+		line := protocol.inputBuffer[:index+1]
+		protocol.inputBuffer = protocol.inputBuffer[index+1:]
+
+		if protocol.discardInputLine {
+			protocol.discardInputLine = false
+			continue
+		}
+
+		wasCommand := protocol.state == StateCommandsExchange || protocol.state == StateWaitingAuth
+		reply := protocol.HandleReceivedRawLine(line)
+		if reply != nil {
+			replies = append(replies, reply)
+			if reply.Action != ActionContinue {
+				return replies
+			}
+		}
+
+		if protocol.isPipeliningViolation(line, wasCommand) {
+			if reply = protocol.reportEarlyTalker(ViolationPipelining); reply != nil {
+				return append(replies, reply)
+			}
+		}
+	}
+
+	if reply := protocol.checkPendingInputLength(); reply != nil {
+		replies = append(replies, reply)
+	}
+
+	return replies
+}
+
+// HasPendingInput returns true when received data contains not processed bytes.
+func (protocol *Protocol) HasPendingInput() bool {
+	return len(protocol.inputBuffer) > 0
+}
+
+// checkPendingInputLength drops incomplete line what already exceeds line length limit,
+// rest of this line will be ignored, so buffer can't grow without limit. Buffer limited
+// even when validation does not limit line length.
+func (protocol *Protocol) checkPendingInputLength() *Reply {
+	maximumLength := protocol.maximumLineLength()
+	if maximumLength <= 0 {
+		maximumLength = maximumPendingLineLength
+	}
+	if len(protocol.inputBuffer) <= maximumLength+len(CommandEndSymbol) {
+		return nil
+	}
+
+	protocol.inputBuffer = nil
+	protocol.discardInputLine = true
+
+	if protocol.state == StateData {
+		protocol.dataRejection = ReplyLineTooLong()
+		return nil
+	}
+
+	return ReplyLineTooLong()
+}
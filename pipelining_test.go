@@ -0,0 +1,90 @@
+package smtpServerProtocol
+
+import (
+	"github.com/mailhedgehog/gounit"
+	"github.com/mailhedgehog/smtpMessage"
+	"strings"
+	"testing"
+)
+
+func TestHandleReceivedDataPipelined(t *testing.T) {
+	protocol := CreateProtocol("", nil, nil)
+	var received *smtpMessage.SmtpMessage
+	protocol.OnMessageReceived(func(message *smtpMessage.SmtpMessage) (string, error) {
+		received = message
+		return "id", nil
+	})
+
+	replies := protocol.HandleReceivedData([]byte("EHLO foo\r\n"))
+	(*gounit.T)(t).AssertEqualsInt(1, len(replies))
+
+	replies = protocol.HandleReceivedData([]byte("MAIL FROM:<foo@bar.com>\r\nRCPT TO:<a@example.com>\r\nRCPT TO:<b@exa"))
+	(*gounit.T)(t).AssertEqualsInt(2, len(replies))
+	(*gounit.T)(t).AssertTrue(protocol.HasPendingInput())
+
+	replies = protocol.HandleReceivedData([]byte("mple.com>\r\nDATA\r\nSubject: test\r\n\r\nbody\r\n.\r\nQU"))
+	(*gounit.T)(t).AssertEqualsInt(3, len(replies))
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, replies[0].Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_MAIL_DATA, replies[1].Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, replies[2].Status)
+	(*gounit.T)(t).AssertEqualsString("Subject: test\r\n\r\nbody", received.GetOrigin())
+	(*gounit.T)(t).AssertEqualsInt(2, len(received.To))
+
+	replies = protocol.HandleReceivedData([]byte("IT\r\n"))
+	(*gounit.T)(t).AssertEqualsInt(1, len(replies))
+	(*gounit.T)(t).AssertTrue(replies[0].ShouldClose())
+	(*gounit.T)(t).AssertFalse(protocol.HasPendingInput())
+}
+
+func TestHandleReceivedDataStopsOnAction(t *testing.T) {
+	protocol := CreateProtocol("", nil, nil)
+	protocol.EnableStartTls()
+
+	replies := protocol.HandleReceivedData([]byte("STARTTLS\r\nMAIL FROM:<foo@bar.com>\r\n"))
+	(*gounit.T)(t).AssertEqualsInt(1, len(replies))
+	(*gounit.T)(t).AssertTrue(replies[0].Action == ActionStartTls)
+	(*gounit.T)(t).AssertTrue(protocol.HasPendingInput())
+}
+
+func TestHandleReceivedDataLongLine(t *testing.T) {
+	protocol := CreateProtocol("", nil, &Validation{MaximumLineLength: 20})
+
+	replies := protocol.HandleReceivedData([]byte("HELO " + strings.Repeat("a", 30)))
+	(*gounit.T)(t).AssertEqualsInt(1, len(replies))
+	(*gounit.T)(t).AssertEqualsInt(CODE_COMMAND_SYNTAX_ERROR, replies[0].Status)
+	(*gounit.T)(t).AssertFalse(protocol.HasPendingInput())
+
+	replies = protocol.HandleReceivedData([]byte(strings.Repeat("a", 10) + "\r\nQUIT\r\n"))
+	(*gounit.T)(t).AssertEqualsInt(1, len(replies))
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_CLOSING, replies[0].Status)
+}
+
+func TestHandleReceivedDataLongLineWithoutLimit(t *testing.T) {
+	protocol := CreateProtocol("", nil, nil)
+	chunk := []byte(strings.Repeat("a", readBufferSize))
+
+	var replies []*Reply
+	for i := 0; len(replies) == 0 && i <= maximumPendingLineLength/readBufferSize+1; i++ {
+		replies = protocol.HandleReceivedData(chunk)
+		(*gounit.T)(t).AssertTrue(len(protocol.inputBuffer) <= maximumPendingLineLength+readBufferSize)
+	}
+	(*gounit.T)(t).AssertEqualsInt(1, len(replies))
+	(*gounit.T)(t).AssertEqualsInt(CODE_COMMAND_SYNTAX_ERROR, replies[0].Status)
+	(*gounit.T)(t).AssertFalse(protocol.HasPendingInput())
+
+	replies = protocol.HandleReceivedData([]byte("aaa\r\nQUIT\r\n"))
+	(*gounit.T)(t).AssertEqualsInt(1, len(replies))
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_CLOSING, replies[0].Status)
+}
+
+func TestHandleReceivedDataPreGreetingLimit(t *testing.T) {
+	protocol := CreateProtocol("", nil, nil)
+	protocol.SetEarlyTalkerDetection(EarlyTalkerDetection{LogOnly: true})
+
+	(*gounit.T)(t).AssertEqualsInt(0, len(protocol.HandleReceivedData([]byte(strings.Repeat("NOOP\r\n", 1000)))))
+	replies := protocol.HandleReceivedData([]byte(strings.Repeat("a", maximumPendingLineLength)))
+	(*gounit.T)(t).AssertEqualsInt(1, len(replies))
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_NOT_AVAILABLE, replies[0].Status)
+	(*gounit.T)(t).AssertTrue(replies[0].ShouldClose())
+	(*gounit.T)(t).AssertFalse(protocol.HasPendingInput())
+}
@@ -1,6 +1,7 @@
 package smtpServerProtocol
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/mailhedgehog/smtpMessage"
@@ -9,6 +10,7 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+	"time"
 )
 
 // ConversationState represents on what stage now current Client<->Server conversation.
@@ -19,12 +21,42 @@ const (
 	StateWaitingAuth      = ConversationState("waiting_auth")
 	StateData             = ConversationState("data")
 	StateCustomScene      = ConversationState("custom_scene")
+	StateClosed           = ConversationState("closed")
 )
 
 // Validation allows to send to package custom validation parameters what accepts server
 type Validation struct {
+	// MaximumLineLength applies to command and data lines what have no own limit.
 	MaximumLineLength int
 	MaximumReceivers  int
+	// MaximumCommandLineLength limits command line length without <CRLF>.
+	MaximumCommandLineLength int
+	// MaximumTextLineLength limits DATA line length without <CRLF>.
+	MaximumTextLineLength int
+	// MaximumLocalPartLength limits length of user name part of mailbox.
+	MaximumLocalPartLength int
+	// MaximumDomainLength limits length of domain part of mailbox.
+	MaximumDomainLength int
+	// MaximumPathLength limits length of reverse-path and forward-path including punctuation.
+	MaximumPathLength int
+	// MaximumCommands limits count of commands in one session.
+	MaximumCommands int
+	// MaximumErrors limits count of permanent negative replies in one session.
+	MaximumErrors int
+	// MaximumTransactions limits count of MAIL transactions in one session.
+	MaximumTransactions int
+	// MaximumAuthFailures limits count of failed authentication attempts in one session.
+	MaximumAuthFailures int
+	// MaximumInvalidRecipients limits count of RCPT commands rejected with 550 or 553 in one session.
+	MaximumInvalidRecipients int
+	// MaximumHops rejects messages with more "Received" headers (rfc5321 section 6.3), 0 to disable.
+	MaximumHops int
+	// CountDeliveredTo also counts "Delivered-To" headers as hops.
+	CountDeliveredTo bool
+	// LineEndings configures handling of bare <CR> and <LF> in HandleReceivedRawLine.
+	LineEndings LineEndings
+	// Helo configures checks of HELO and EHLO argument.
+	Helo HeloValidation
 }
 
 // Protocol represents rfc5321 described protocol conversation
@@ -36,6 +68,20 @@ type Protocol struct {
 	state      ConversationState
 	message    *smtpMessage.SmtpMessage
 	tempOrigin string
+	// dataInHeaders is true while DATA lines belong to message header section.
+	dataInHeaders bool
+	dataHops      int
+	// dataRejection is reply what will be sent after end of data, when message content is invalid.
+	dataRejection *Reply
+	// dataBareLineEnding is true when previous data line ended with bare <LF>.
+	dataBareLineEnding bool
+	// authenticationResults contains results added by data policies for Authentication-Results header.
+	authenticationResults []string
+	// addedHeaders contains header fields added by data policies.
+	addedHeaders []string
+	// discardMessage is true when message should be accepted, but not passed to callback.
+	discardMessage   bool
+	quarantineReason string
 
 	// supportedAuthMechanisms can be empty, if empty client will not go through auth flow
 	supportedAuthMechanisms []string
@@ -43,6 +89,38 @@ type Protocol struct {
 
 	createCustomSceneCallback func(sceneName string) Scene
 	currentScene              Scene
+
+	// greeting is command (HELO or EHLO) what client used to greet server, empty before greeting.
+	greeting CommandName
+	tlsState *tls.ConnectionState
+	// startTlsEnabled is true when connection driver able to upgrade connection.
+	startTlsEnabled bool
+	authIdentity    string
+	traceHeaders    TraceHeaders
+	now             func() time.Time
+
+	counters sessionCounters
+	session  *Session
+	policies []Policy
+	// policiesClosed is true when close policies were executed.
+	policiesClosed bool
+
+	// inputBuffer contains incomplete line received by HandleReceivedData.
+	inputBuffer      []byte
+	discardInputLine bool
+
+	// greeted is true when greeting reply was sent to client.
+	greeted              bool
+	earlyTalkerDetection *EarlyTalkerDetection
+	earlyTalkerCallback  func(violation EarlyTalkerViolation)
+
+	timeouts      Timeouts
+	startedAt     time.Time
+	dataStartedAt time.Time
+	// lineStartedAt is time when client could start current line, stage timeouts are counted from it,
+	// so partial line does not extend timeout.
+	lineStartedAt time.Time
+	lastCommand   CommandName
 }
 
 func CreateProtocol(hostname string, ip *net.TCPAddr, validation *Validation) *Protocol {
@@ -57,7 +135,12 @@ func CreateProtocol(hostname string, ip *net.TCPAddr, validation *Validation) *P
 		Hostname:   hostname,
 		Ip:         ip,
 		validation: validation,
+		now:        time.Now,
+		timeouts:   CreateRfcTimeouts(),
+		session:    &Session{},
 	}
+	protocol.startedAt = protocol.now()
+	protocol.lineStartedAt = protocol.startedAt
 	protocol.resetState()
 
 	return protocol
@@ -90,19 +173,40 @@ func (protocol *Protocol) SayWelcome(identification string) *Reply {
 		hostname = hostname + " "
 	}
 	protocol.state = StateCommandsExchange
+	protocol.greeted = true
+	protocol.lineStartedAt = protocol.now()
+
+	if reply := protocol.checkConnectPolicies(); reply != nil {
+		protocol.state = StateClosed
+		reply.Action = ActionClose
+		return reply
+	}
+
 	return ReplyServiceReady(hostname + identification + "Service ready")
 }
 
 func (protocol *Protocol) HandleReceivedLine(receivedLine string) *Reply {
-	if protocol.validation.MaximumLineLength > 0 && len(receivedLine) > 0 {
-		if len(receivedLine) > protocol.validation.MaximumLineLength {
-			return ReplyLineTooLong()
+	return protocol.checkReplyPolicies(protocol.handleReceivedLine(receivedLine))
+}
+
+func (protocol *Protocol) handleReceivedLine(receivedLine string) *Reply {
+	if protocol.state == StateClosed {
+		return protocol.closeSession("4.7.0", "Session closed")
+	}
+	protocol.lineStartedAt = protocol.now()
+
+	if maximumLength := protocol.maximumLineLength(); maximumLength > 0 && len(receivedLine) > maximumLength {
+		// Reply can't be sent in the middle of data, so it is postponed to end of data.
+		if protocol.state == StateData {
+			protocol.dataRejection = ReplyLineTooLong()
+			return nil
 		}
+		return ReplyLineTooLong()
 	}
 
 	if protocol.state == StateCustomScene {
 		if protocol.currentScene != nil {
-			return protocol.currentScene.ReadAndWriteReply(receivedLine)
+			return protocol.countSessionErrors(nil, protocol.currentScene.ReadAndWriteReply(receivedLine))
 		}
 		return ReplyCommandNotImplemented()
 	}
@@ -115,51 +219,115 @@ func (protocol *Protocol) HandleReceivedLine(receivedLine string) *Reply {
 }
 
 func (protocol *Protocol) resetState() {
+	// Greeting is part of session, so it is kept between transactions.
+	helo := ""
+	if protocol.message != nil {
+		helo = protocol.message.Helo
+	}
 	protocol.message = &smtpMessage.SmtpMessage{
-		ID: smtpMessage.NewMessageID(),
+		ID:   smtpMessage.NewMessageID(),
+		Helo: helo,
 	}
 	protocol.tempOrigin = ""
+	protocol.dataInHeaders = false
+	protocol.dataHops = 0
+	protocol.dataRejection = nil
+	protocol.dataBareLineEnding = false
+	protocol.authenticationResults = nil
+	protocol.addedHeaders = nil
+	protocol.discardMessage = false
+	protocol.quarantineReason = ""
 	protocol.SetStateCommandsExchange()
 }
 
 func (protocol *Protocol) handleMailContent(receivedLine string) *Reply {
+	// Check is this is end
+	if receivedLine == "." {
+		return protocol.finishMailContent()
+	}
+
+	protocol.appendMailContent(receivedLine)
+
+	return nil
+}
+
+// appendMailContent adds line to message origin, line never can be treated as end of data.
+func (protocol *Protocol) appendMailContent(receivedLine string) {
+	protocol.countHops(receivedLine)
+
+	// Transparency procedure described in rfc5321 section 4.5.2
+	if strings.HasPrefix(receivedLine, ".") {
+		receivedLine = receivedLine[1:]
+	}
+
 	protocol.tempOrigin += receivedLine + "\r\n"
+}
 
-	// Check is this is end
-	if strings.HasSuffix(protocol.tempOrigin, "\r\n.\r\n") {
-		protocol.tempOrigin = strings.ReplaceAll(protocol.tempOrigin, "\r\n..", "\r\n.")
+func (protocol *Protocol) finishMailContent() *Reply {
+	logManager().Debug("Got EOF, storing message and reset state.")
+	protocol.tempOrigin = strings.TrimSuffix(protocol.tempOrigin, "\r\n")
+	protocol.state = StateCommandsExchange
 
-		logManager().Debug("Got EOF, storing message and reset state.")
-		protocol.tempOrigin = strings.TrimSuffix(protocol.tempOrigin, "\r\n.\r\n")
-		protocol.state = StateCommandsExchange
+	defer protocol.resetState()
 
-		defer protocol.resetState()
+	if protocol.dataRejection != nil {
+		return protocol.dataRejection
+	}
 
-		if protocol.messageReceivedCallback == nil {
-			logManager().Error("No receive callback processed")
-			return ReplyExceededStorage("No storage backend")
-		}
+	if protocol.validation.MaximumHops > 0 && protocol.dataHops > protocol.validation.MaximumHops {
+		logManager().Debug(fmt.Sprintf("Message rejected, hops count %d", protocol.dataHops))
+		return ReplyTooManyHops()
+	}
 
-		var err error
-		var messageId string
+	protocol.tempOrigin = removeAuthenticationResults(protocol.tempOrigin, protocol.authServId())
 
-		err = protocol.message.SetOrigin(protocol.tempOrigin)
-		if err != nil {
-			logManager().Error(fmt.Sprintf("Error storing message origin: %s", err.Error()))
-			return ReplyExceededStorage("Unable to store message")
-		}
+	if reply := protocol.checkDataPolicies(); reply != nil {
+		return reply
+	}
 
-		messageId, err = protocol.messageReceivedCallback(protocol.message)
-		if err != nil {
-			logManager().Error(fmt.Sprintf("Error storing message: %s", err.Error()))
-			return ReplyExceededStorage("Unable to store message")
-		}
+	if protocol.discardMessage {
+		logManager().Debug("Message discarded by policy")
+		return ReplyOk("Ok: queued as " + string(protocol.message.ID))
+	}
 
-		logManager().Debug("Message processed and returns success.")
-		return ReplyOk("Ok: queued as " + messageId)
+	if protocol.messageReceivedCallback == nil {
+		logManager().Error("No receive callback processed")
+		return ReplyExceededStorage("No storage backend")
 	}
 
-	return nil
+	var err error
+	var messageId string
+
+	err = protocol.message.SetOrigin(protocol.traceHeadersBlock() + protocol.tempOrigin)
+	if err != nil {
+		logManager().Error(fmt.Sprintf("Error storing message origin: %s", err.Error()))
+		return ReplyExceededStorage("Unable to store message")
+	}
+
+	messageId, err = protocol.messageReceivedCallback(protocol.message)
+	if err != nil {
+		logManager().Error(fmt.Sprintf("Error storing message: %s", err.Error()))
+		return ReplyExceededStorage("Unable to store message")
+	}
+
+	logManager().Debug("Message processed and returns success.")
+	return ReplyOk("Ok: queued as " + messageId)
+}
+
+// countHops counts trace headers while message header section is read, to detect mail loops.
+func (protocol *Protocol) countHops(receivedLine string) {
+	if !protocol.dataInHeaders {
+		return
+	}
+	if len(receivedLine) == 0 {
+		protocol.dataInHeaders = false
+		return
+	}
+
+	name := strings.ToLower(strings.SplitN(receivedLine, ":", 2)[0])
+	if name == "received" || (protocol.validation.CountDeliveredTo && name == "delivered-to") {
+		protocol.dataHops++
+	}
 }
 
 func (protocol *Protocol) handleCommand(receivedLine string) *Reply {
@@ -168,7 +336,23 @@ func (protocol *Protocol) handleCommand(receivedLine string) *Reply {
 
 	logManager().Debug(fmt.Sprintf("Handle command: '%s', with args: '%s'", command.verb, command.args))
 
-	if protocol.state == StateWaitingAuth && command.verb != CommandAuth {
+	protocol.lastCommand = command.verb
+
+	if reply := protocol.checkSessionLimits(command); reply != nil {
+		return reply
+	}
+
+	return protocol.countSessionErrors(command, protocol.executeCommand(command, receivedLine))
+}
+
+// waitingAuthCommands are allowed before client authenticated, greeting can be repeated at any time.
+var waitingAuthCommands = []CommandName{CommandAuth, CommandStartTls, CommandHelo, CommandEhlo, CommandRset, CommandQuit}
+
+func (protocol *Protocol) executeCommand(command *Command, receivedLine string) *Reply {
+	if reply := protocol.checkGreetingMode(command); reply != nil {
+		return reply
+	}
+	if protocol.state == StateWaitingAuth && !slices.Contains(waitingAuthCommands, command.verb) {
 		return ReplyAuthFailed("")
 	}
 
@@ -202,7 +386,11 @@ func (protocol *Protocol) handleCommand(receivedLine string) *Reply {
 		return protocol.RCPT(command)
 	case CommandData:
 		protocol.state = StateData
+		protocol.dataInHeaders = true
+		protocol.dataStartedAt = protocol.now()
 		return ReplyMailData()
+	case CommandStartTls:
+		return protocol.STARTTLS(command)
 	case CommandQuit:
 		return ReplyBye()
 	default:
@@ -221,30 +409,57 @@ func (protocol *Protocol) startCustomScene(customSceneName string, receivedLine
 }
 
 func (protocol *Protocol) HELO(command *Command) *Reply {
-	protocol.message.Helo = command.args
-
-	if len(protocol.supportedAuthMechanisms) > 0 {
-		protocol.state = StateWaitingAuth
+	if reply := protocol.validateHelo(command.verb, command.args); reply != nil {
+		return reply
+	}
+	if reply := protocol.checkHeloPolicies(command.args); reply != nil {
+		return reply
+	}
+	// Repeated greeting clears transaction as RSET does (rfc5321 section 4.1.4).
+	if len(protocol.greeting) > 0 {
+		protocol.resetState()
 	}
+	protocol.message.Helo = command.args
+	protocol.greeting = command.verb
 
 	return ReplyOk("Hello " + command.args)
 }
 
 func (protocol *Protocol) EHLO(command *Command) *Reply {
+	if reply := protocol.validateHelo(command.verb, command.args); reply != nil {
+		return reply
+	}
+	if reply := protocol.checkHeloPolicies(command.args); reply != nil {
+		return reply
+	}
+	// Repeated greeting clears transaction as RSET does (rfc5321 section 4.1.4).
+	if len(protocol.greeting) > 0 {
+		protocol.resetState()
+	}
 	protocol.message.Helo = command.args
+	protocol.greeting = command.verb
 	replyArgs := []string{"Hello " + command.args, "PIPELINING"}
 
-	logManager().Warning("TODO: add tls support") // TODO
+	if protocol.startTlsEnabled && protocol.tlsState == nil {
+		replyArgs = append(replyArgs, string(CommandStartTls))
+	}
 
 	if len(protocol.supportedAuthMechanisms) > 0 {
-		protocol.state = StateWaitingAuth
+		// Authenticated client keeps identity after repeated EHLO.
+		if len(protocol.authIdentity) == 0 {
+			protocol.state = StateWaitingAuth
+		}
 		replyArgs = append(replyArgs, string(CommandAuth)+" "+strings.Join(protocol.supportedAuthMechanisms, " "))
 	}
 	return ReplyOk(replyArgs...)
 }
 
 func (protocol *Protocol) RSET(command *Command) *Reply {
+	waitingAuth := protocol.state == StateWaitingAuth
 	protocol.resetState()
+	if waitingAuth {
+		protocol.state = StateWaitingAuth
+	}
 
 	return ReplyOk("")
 }
@@ -255,12 +470,33 @@ func (protocol *Protocol) MAIL(command *Command) *Reply {
 	if len(match) != 2 {
 		return ReplyMailbox404("Invalid syntax in MAIL command")
 	}
+	if reply := protocol.checkMailParameters("MAIL FROM", match[1]); reply != nil {
+		return reply
+	}
 
-	var err error
-	protocol.message.From, err = smtpMessage.MessagePathFromString(match[1])
+	// Authentication results of rejected sender do not belong to new transaction.
+	protocol.authenticationResults = nil
+
+	// Null reverse-path used for notification messages (rfc5321 section 4.5.5)
+	if strings.HasPrefix(strings.TrimSpace(match[1]), "<>") {
+		if reply := protocol.checkMailPolicies(nil); reply != nil {
+			return reply
+		}
+		protocol.message.From = nil
+		return ReplyOk("Sender <> ok")
+	}
+
+	mailPath, err := smtpMessage.MessagePathFromString(match[1])
 	if err != nil {
 		return ReplyMailbox404(err.Error())
 	}
+	if reply := protocol.validatePathLength(mailPath); reply != nil {
+		return reply
+	}
+	if reply := protocol.checkMailPolicies(mailPath); reply != nil {
+		return reply
+	}
+	protocol.message.From = mailPath
 
 	return ReplyOk("Sender " + protocol.message.From.Address() + " ok")
 }
@@ -274,11 +510,20 @@ func (protocol *Protocol) RCPT(command *Command) *Reply {
 	if len(match) != 2 {
 		return ReplyMailbox404("Invalid syntax in MAIL command")
 	}
+	if reply := protocol.checkMailParameters("RCPT TO", match[1]); reply != nil {
+		return reply
+	}
 
 	mailPath, err := smtpMessage.MessagePathFromString(match[1])
 	if err != nil {
 		return ReplyMailbox404(err.Error())
 	}
+	if reply := protocol.validatePathLength(mailPath); reply != nil {
+		return reply
+	}
+	if reply := protocol.checkRcptPolicies(mailPath); reply != nil {
+		return reply
+	}
 
 	protocol.message.To = append(protocol.message.To, mailPath)
 
@@ -153,3 +153,28 @@ func TestParseAuthMechanism(t *testing.T) {
 	(*gounit.T)(t).AssertEqualsString("BAR", protocol.parseAuthMechanism("BAR"))
 	(*gounit.T)(t).AssertEqualsString("foo", protocol.parseAuthMechanism("foo baz"))
 }
+
+func TestMaximumHops(t *testing.T) {
+	protocol := CreateProtocol("", nil, &Validation{MaximumHops: 2, CountDeliveredTo: true})
+	protocol.OnMessageReceived(func(message *smtpMessage.SmtpMessage) (string, error) {
+		return "id", nil
+	})
+
+	protocol.HandleReceivedLine("DATA")
+	protocol.HandleReceivedLine("Received: from a by b")
+	protocol.HandleReceivedLine("Delivered-To: foo@bar.com")
+	protocol.HandleReceivedLine("")
+	protocol.HandleReceivedLine("Received: in body is not counted")
+	reply := protocol.HandleReceivedLine(".")
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, reply.Status)
+
+	protocol.HandleReceivedLine("DATA")
+	protocol.HandleReceivedLine("Received: from a by b")
+	protocol.HandleReceivedLine("\tfor <foo@bar.com>")
+	protocol.HandleReceivedLine("RECEIVED: from c by d")
+	protocol.HandleReceivedLine("Delivered-To: foo@bar.com")
+	protocol.HandleReceivedLine("")
+	reply = protocol.HandleReceivedLine(".")
+	(*gounit.T)(t).AssertEqualsInt(CODE_TRANSACTION_FAILED, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("5.4.6 Too many hops", reply.lines[0])
+}
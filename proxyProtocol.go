@@ -0,0 +1,286 @@
+package smtpServerProtocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout is time given to upstream proxy to send PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV1MaximumLength is maximum length of text header including CRLF.
+const proxyV1MaximumLength = 107
+
+// proxyV2Signature starts binary header, see https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// List of PROXY protocol v2 TLV types used by parser.
+const (
+	proxyTlvAuthority     = 0x02
+	proxyTlvSsl           = 0x20
+	proxyTlvSslVersion    = 0x21
+	proxyTlvSslCommonName = 0x22
+	proxyTlvSslCipher     = 0x23
+	proxyTlvSslSigAlg     = 0x24
+	proxyTlvSslKeyAlg     = 0x25
+)
+
+// List of PROXY protocol v2 PP2_TYPE_SSL client flags.
+const (
+	proxySslClientSsl      = 0x01
+	proxySslClientCertConn = 0x02
+	proxySslClientCertSess = 0x04
+)
+
+// ProxyHeader contains client connection details received from upstream proxy.
+type ProxyHeader struct {
+	// Version is 1 for text header and 2 for binary header.
+	Version int
+	// Local is true when proxy connected on its own behalf (health check) or address family is
+	// not supported, addresses are empty then and address of proxy connection should be used.
+	Local       bool
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+	// Authority is host name sent by client to proxy (SNI), v2 only.
+	Authority string
+	// Ssl is set when client connected to proxy using TLS, v2 only.
+	Ssl *ProxySslInfo
+}
+
+// ProxySslInfo contains TLS details of client connection terminated by proxy.
+type ProxySslInfo struct {
+	// ClientCertificateConnection is true when client presented certificate over current connection.
+	ClientCertificateConnection bool
+	// ClientCertificateSession is true when client presented certificate at least once in TLS session.
+	ClientCertificateSession bool
+	// Verified is true when client certificate was presented and verified successfully.
+	Verified           bool
+	Version            string
+	CommonName         string
+	Cipher             string
+	SignatureAlgorithm string
+	KeyAlgorithm       string
+}
+
+// ReadProxyHeader reads PROXY protocol header (v1 or v2) from reader. Header is read byte by byte
+// where length is not known, so no data after header consumed.
+func ReadProxyHeader(reader io.Reader) (*ProxyHeader, error) {
+	start := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(reader, start); err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(start, proxyV2Signature) {
+		return readProxyHeaderV2(reader)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyHeaderV1(reader, start)
+	}
+
+	return nil, errors.New("proxy protocol signature not found")
+}
+
+func readProxyHeaderV1(reader io.Reader, line []byte) (*ProxyHeader, error) {
+	char := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte(CommandEndSymbol)) {
+		if len(line) >= proxyV1MaximumLength {
+			return nil, errors.New("proxy protocol v1 header too long")
+		}
+		if _, err := io.ReadFull(reader, char); err != nil {
+			return nil, err
+		}
+		line = append(line, char[0])
+	}
+
+	return parseProxyHeaderV1(strings.TrimSuffix(string(line), CommandEndSymbol))
+}
+
+// parseProxyHeaderV1 parses line like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25".
+func parseProxyHeaderV1(line string) (*ProxyHeader, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("invalid proxy protocol v1 header \"%s\"", line)
+	}
+
+	header := &ProxyHeader{Version: 1}
+	if fields[1] == "UNKNOWN" {
+		header.Local = true
+		return header, nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return nil, fmt.Errorf("invalid proxy protocol v1 header \"%s\"", line)
+	}
+
+	var err error
+	if header.Source, err = parseProxyAddress(fields[1], fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+	if header.Destination, err = parseProxyAddress(fields[1], fields[3], fields[5]); err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+// parseProxyAddress parses v1 address and port, address should belong to declared family.
+func parseProxyAddress(family string, address string, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(address)
+	if ip == nil || (family == "TCP4") == strings.Contains(address, ":") {
+		return nil, fmt.Errorf("invalid proxy protocol address \"%s\"", address)
+	}
+
+	// Leading zeros not allowed in port (proxy protocol section 2.1).
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("invalid proxy protocol port \"%s\"", port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(portNumber)}, nil
+}
+
+func readProxyHeaderV2(reader io.Reader) (*ProxyHeader, error) {
+	fixed := make([]byte, 4)
+	if _, err := io.ReadFull(reader, fixed); err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[2:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	return parseProxyHeaderV2(fixed[0], fixed[1], payload)
+}
+
+// parseProxyHeaderV2 parses binary header part after signature: version and command,
+// address family and transport, addresses and TLVs.
+func parseProxyHeaderV2(versionCommand byte, family byte, payload []byte) (*ProxyHeader, error) {
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported proxy protocol version %d", versionCommand>>4)
+	}
+
+	header := &ProxyHeader{Version: 2}
+	switch versionCommand & 0x0F {
+	case 0x00:
+		header.Local = true
+		return header, nil
+	case 0x01:
+	default:
+		return nil, fmt.Errorf("unsupported proxy protocol command %d", versionCommand&0x0F)
+	}
+
+	addressLength := 0
+	switch family {
+	case 0x11:
+		addressLength = 2*net.IPv4len + 4
+	case 0x21:
+		addressLength = 2*net.IPv6len + 4
+	default:
+		// UNSPEC, UDP and unix sockets are accepted, but real address is unknown.
+		header.Local = true
+	}
+	if len(payload) < addressLength {
+		return nil, errors.New("proxy protocol v2 address block truncated")
+	}
+
+	if addressLength > 0 {
+		ipLength := (addressLength - 4) / 2
+		header.Source = &net.TCPAddr{
+			IP:   net.IP(append([]byte{}, payload[:ipLength]...)),
+			Port: int(binary.BigEndian.Uint16(payload[2*ipLength:])),
+		}
+		header.Destination = &net.TCPAddr{
+			IP:   net.IP(append([]byte{}, payload[ipLength:2*ipLength]...)),
+			Port: int(binary.BigEndian.Uint16(payload[2*ipLength+2:])),
+		}
+	}
+
+	// Address block of unsupported family is skipped together with TLVs, its length unknown.
+	if header.Local {
+		return header, nil
+	}
+
+	err := parseProxyTlvs(payload[addressLength:], func(tlvType byte, value []byte) error {
+		switch tlvType {
+		case proxyTlvAuthority:
+			header.Authority = string(value)
+		case proxyTlvSsl:
+			ssl, err := parseProxySsl(value)
+			if err != nil {
+				return err
+			}
+			header.Ssl = ssl
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+// parseProxySsl parses value of PP2_TYPE_SSL: client flags, verify result and sub TLVs.
+func parseProxySsl(value []byte) (*ProxySslInfo, error) {
+	if len(value) < 5 {
+		return nil, errors.New("proxy protocol v2 ssl tlv truncated")
+	}
+
+	client := value[0]
+	if client&proxySslClientSsl == 0 {
+		return nil, nil
+	}
+	ssl := &ProxySslInfo{
+		ClientCertificateConnection: client&proxySslClientCertConn != 0,
+		ClientCertificateSession:    client&proxySslClientCertSess != 0,
+	}
+	ssl.Verified = (ssl.ClientCertificateConnection || ssl.ClientCertificateSession) &&
+		binary.BigEndian.Uint32(value[1:5]) == 0
+
+	err := parseProxyTlvs(value[5:], func(tlvType byte, value []byte) error {
+		switch tlvType {
+		case proxyTlvSslVersion:
+			ssl.Version = string(value)
+		case proxyTlvSslCommonName:
+			ssl.CommonName = string(value)
+		case proxyTlvSslCipher:
+			ssl.Cipher = string(value)
+		case proxyTlvSslSigAlg:
+			ssl.SignatureAlgorithm = string(value)
+		case proxyTlvSslKeyAlg:
+			ssl.KeyAlgorithm = string(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ssl, nil
+}
+
+// parseProxyTlvs calls callback for every type-length-value entry, unknown types should be ignored by callback.
+func parseProxyTlvs(data []byte, callback func(tlvType byte, value []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return errors.New("proxy protocol v2 tlv truncated")
+		}
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+length {
+			return errors.New("proxy protocol v2 tlv truncated")
+		}
+		if err := callback(data[0], data[3:3+length]); err != nil {
+			return err
+		}
+		data = data[3+length:]
+	}
+
+	return nil
+}
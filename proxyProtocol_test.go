@@ -0,0 +1,183 @@
+package smtpServerProtocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/mailhedgehog/gounit"
+	"net"
+	"testing"
+)
+
+func proxyTlv(tlvType byte, value []byte) []byte {
+	tlv := []byte{tlvType, 0, 0}
+	binary.BigEndian.PutUint16(tlv[1:], uint16(len(value)))
+	return append(tlv, value...)
+}
+
+func proxyHeaderV2(command byte, family byte, payload []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	reader := bytes.NewReader([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\nEHLO"))
+	header, err := ReadProxyHeader(reader)
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertEqualsInt(1, header.Version)
+	(*gounit.T)(t).AssertEqualsString("192.0.2.1:56324", header.Source.String())
+	(*gounit.T)(t).AssertEqualsString("198.51.100.1:25", header.Destination.String())
+	// Data after header is not consumed.
+	(*gounit.T)(t).AssertEqualsInt(4, reader.Len())
+
+	header, err = ReadProxyHeader(bytes.NewReader([]byte("PROXY TCP6 2001:db8::1 ::ffff:198.51.100.1 56324 25\r\n")))
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertEqualsString("[2001:db8::1]:56324", header.Source.String())
+
+	header, err = ReadProxyHeader(bytes.NewReader([]byte("PROXY UNKNOWN ffff:f...f:ffff 12345 25\r\n")))
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertTrue(header.Local)
+	(*gounit.T)(t).AssertTrue(header.Source == nil)
+
+	invalid := []string{
+		"EHLO client.example.org\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 56324 25\r\n",
+		"PROXY TCP6 192.0.2.1 2001:db8::2 56324 25\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 056324 25\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 65536 25\r\n",
+		"PROXY UDP4 192.0.2.1 198.51.100.1 56324 25\r\n",
+		"PROXY TCP4 192.0.2.1  198.51.100.1 56324 25\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 25",
+		"PROXY TCP4 " + string(bytes.Repeat([]byte("1"), 100)) + "\r\n",
+	}
+	for _, line := range invalid {
+		_, err = ReadProxyHeader(bytes.NewReader([]byte(line)))
+		(*gounit.T)(t).ExpectError(err)
+	}
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	ssl := append([]byte{proxySslClientSsl | proxySslClientCertConn, 0, 0, 0, 0}, proxyTlv(proxyTlvSslVersion, []byte("TLSv1.3"))...)
+	ssl = append(ssl, proxyTlv(proxyTlvSslCommonName, []byte("client.example.org"))...)
+	ssl = append(ssl, proxyTlv(proxyTlvSslCipher, []byte("TLS_AES_128_GCM_SHA256"))...)
+
+	payload := append(net.ParseIP("192.0.2.1").To4(), net.ParseIP("198.51.100.1").To4()...)
+	payload = append(payload, 0xDC, 0x04, 0, 25)
+	payload = append(payload, proxyTlv(0x01, []byte("smtp"))...)
+	payload = append(payload, proxyTlv(proxyTlvAuthority, []byte("mx.example.com"))...)
+	payload = append(payload, proxyTlv(proxyTlvSsl, ssl)...)
+	payload = append(payload, proxyTlv(0xEA, []byte{0x01, 'v', 'p', 'c', 'e'})...)
+
+	reader := bytes.NewReader(append(proxyHeaderV2(0x01, 0x11, payload), "EHLO"...))
+	header, err := ReadProxyHeader(reader)
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertEqualsInt(4, reader.Len())
+	(*gounit.T)(t).AssertEqualsInt(2, header.Version)
+	(*gounit.T)(t).AssertFalse(header.Local)
+	(*gounit.T)(t).AssertEqualsString("192.0.2.1:56324", header.Source.String())
+	(*gounit.T)(t).AssertEqualsString("198.51.100.1:25", header.Destination.String())
+	(*gounit.T)(t).AssertEqualsString("mx.example.com", header.Authority)
+	(*gounit.T)(t).AssertTrue(header.Ssl.Verified)
+	(*gounit.T)(t).AssertTrue(header.Ssl.ClientCertificateConnection)
+	(*gounit.T)(t).AssertEqualsString("TLSv1.3", header.Ssl.Version)
+	(*gounit.T)(t).AssertEqualsString("client.example.org", header.Ssl.CommonName)
+	(*gounit.T)(t).AssertEqualsString("TLS_AES_128_GCM_SHA256", header.Ssl.Cipher)
+
+	payload = append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...)
+	payload = append(payload, 0, 1, 0, 25)
+	header, err = ReadProxyHeader(bytes.NewReader(proxyHeaderV2(0x01, 0x21, payload)))
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertEqualsString("[2001:db8::1]:1", header.Source.String())
+	(*gounit.T)(t).AssertTrue(header.Ssl == nil)
+
+	header, err = ReadProxyHeader(bytes.NewReader(proxyHeaderV2(0x00, 0x00, nil)))
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertTrue(header.Local)
+
+	header, err = ReadProxyHeader(bytes.NewReader(proxyHeaderV2(0x01, 0x31, make([]byte, 216))))
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertTrue(header.Local)
+	(*gounit.T)(t).AssertTrue(header.Source == nil)
+
+	invalid := [][]byte{
+		proxyHeaderV2(0x01, 0x11, make([]byte, 11)),
+		proxyHeaderV2(0x02, 0x11, make([]byte, 12)),
+		proxyHeaderV2(0x01, 0x11, make([]byte, 12)),
+		proxyHeaderV2(0x01, 0x11, append(make([]byte, 12), proxyTlvAuthority, 0, 5, 'm')),
+		proxyHeaderV2(0x01, 0x11, append(make([]byte, 12), proxyTlv(proxyTlvSsl, []byte{proxySslClientSsl})...)),
+	}
+	// Version 1 in binary header.
+	invalid[2][12] = 0x11
+	for _, data := range invalid {
+		_, err = ReadProxyHeader(bytes.NewReader(data))
+		(*gounit.T)(t).ExpectError(err)
+	}
+}
+
+func startTestProxiedConnection(t *testing.T, protocol *Protocol, trustedUpstreams ...string) (net.Conn, *bufio.Reader, chan error) {
+	networks, err := ParseNetworks(trustedUpstreams...)
+	(*gounit.T)(t).AssertNotError(err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	(*gounit.T)(t).AssertNotError(err)
+
+	done := make(chan error, 1)
+	go func() {
+		defer listener.Close()
+		server, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		connection := CreateConnection(server, protocol)
+		connection.EnableProxyProtocol(networks)
+		done <- connection.Serve("")
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	(*gounit.T)(t).AssertNotError(err)
+
+	return client, bufio.NewReader(client), done
+}
+
+func TestConnectionProxyProtocol(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, nil)
+	client, reader, done := startTestProxiedConnection(t, protocol, "127.0.0.0/8")
+	defer client.Close()
+
+	_, err := client.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 25\r\n"))
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertEqualsString("220 mx.example.com Service ready\r\n", readReplyLine(t, reader))
+	_, err = client.Write([]byte("QUIT\r\n"))
+	(*gounit.T)(t).AssertNotError(err)
+	readReplyLine(t, reader)
+	(*gounit.T)(t).AssertNotError(<-done)
+	(*gounit.T)(t).AssertEqualsString("192.0.2.1:56324", protocol.Ip.String())
+}
+
+func TestConnectionProxyProtocolInvalidHeader(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, nil)
+	client, _, done := startTestProxiedConnection(t, protocol, "127.0.0.1")
+	defer client.Close()
+
+	_, err := client.Write([]byte("EHLO client.example.org\r\n"))
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).ExpectError(<-done)
+	(*gounit.T)(t).AssertEqualsString("127.0.0.1", protocol.Ip.IP.String())
+}
+
+func TestConnectionProxyProtocolUntrustedUpstream(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, nil)
+	client, reader, done := startTestProxiedConnection(t, protocol, "192.0.2.0/24")
+	defer client.Close()
+
+	(*gounit.T)(t).AssertEqualsString("220 mx.example.com Service ready\r\n", readReplyLine(t, reader))
+	_, err := client.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 25\r\nQUIT\r\n"))
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertEqualsString("500 Unrecognised command\r\n", readReplyLine(t, reader))
+	readReplyLine(t, reader)
+	(*gounit.T)(t).AssertNotError(<-done)
+	(*gounit.T)(t).AssertEqualsString("127.0.0.1", protocol.Ip.IP.String())
+}
@@ -0,0 +1,92 @@
+package smtpServerProtocol
+
+import (
+	"bufio"
+	_ "embed"
+	"strings"
+	"sync"
+)
+
+// publicSuffixListData is copy of https://publicsuffix.org/list/public_suffix_list.dat
+//
+//go:embed public_suffix_list.dat
+var publicSuffixListData string
+
+// publicSuffixList contains parsed rules, key is rule without "*." and "!" prefixes.
+type publicSuffixList struct {
+	rules      map[string]bool
+	wildcards  map[string]bool
+	exceptions map[string]bool
+}
+
+var publicSuffixes *publicSuffixList
+var publicSuffixesOnce sync.Once
+
+func loadPublicSuffixList() *publicSuffixList {
+	publicSuffixesOnce.Do(func() {
+		publicSuffixes = &publicSuffixList{
+			rules:      map[string]bool{},
+			wildcards:  map[string]bool{},
+			exceptions: map[string]bool{},
+		}
+
+		scanner := bufio.NewScanner(strings.NewReader(publicSuffixListData))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+				continue
+			}
+
+			rule := strings.ToLower(fields[0])
+			switch {
+			case strings.HasPrefix(rule, "!"):
+				publicSuffixes.exceptions[rule[1:]] = true
+			case strings.HasPrefix(rule, "*."):
+				publicSuffixes.wildcards[rule[2:]] = true
+			default:
+				publicSuffixes.rules[rule] = true
+			}
+		}
+	})
+
+	return publicSuffixes
+}
+
+// PublicSuffix returns public suffix of domain, for example "co.uk" for "mail.example.co.uk".
+// Domain what does not match any rule is treated as top level domain.
+func PublicSuffix(domain string) string {
+	labels := strings.Split(normalizeDnsName(domain), ".")
+	return strings.Join(labels[publicSuffixIndex(labels):], ".")
+}
+
+// OrganizationalDomain returns public suffix with one more label (rfc7489 section 3.2),
+// for example "example.co.uk" for "mail.example.co.uk".
+func OrganizationalDomain(domain string) string {
+	labels := strings.Split(normalizeDnsName(domain), ".")
+	index := publicSuffixIndex(labels)
+	if index > 0 {
+		index--
+	}
+
+	return strings.Join(labels[index:], ".")
+}
+
+// publicSuffixIndex returns index of first label of public suffix, longest matching rule wins.
+func publicSuffixIndex(labels []string) int {
+	list := loadPublicSuffixList()
+
+	for i := range labels {
+		name := strings.Join(labels[i:], ".")
+		if list.exceptions[name] {
+			return i + 1
+		}
+		if list.rules[name] {
+			return i
+		}
+		if i+1 < len(labels) && list.wildcards[strings.Join(labels[i+1:], ".")] {
+			return i
+		}
+	}
+
+	return len(labels) - 1
+}
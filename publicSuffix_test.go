@@ -0,0 +1,29 @@
+package smtpServerProtocol
+
+import (
+	"github.com/mailhedgehog/gounit"
+	"testing"
+)
+
+func TestOrganizationalDomain(t *testing.T) {
+	domains := map[string]string{
+		"example.com":              "example.com",
+		"mail.example.com":         "example.com",
+		"a.b.mail.example.com.":    "example.com",
+		"MAIL.Example.CO.UK":       "example.co.uk",
+		"co.uk":                    "co.uk",
+		"com":                      "com",
+		"foo.bar.ck":               "foo.bar.ck",
+		"mail.www.ck":              "www.ck",
+		"example.unknown-tld":      "example.unknown-tld",
+		"mail.example.unknown-tld": "example.unknown-tld",
+	}
+
+	for domain, expected := range domains {
+		(*gounit.T)(t).AssertEqualsString(expected, OrganizationalDomain(domain))
+	}
+
+	(*gounit.T)(t).AssertEqualsString("co.uk", PublicSuffix("mail.example.co.uk"))
+	(*gounit.T)(t).AssertEqualsString("bar.ck", PublicSuffix("foo.bar.ck"))
+	(*gounit.T)(t).AssertEqualsString("ck", PublicSuffix("www.ck"))
+}
@@ -0,0 +1,241 @@
+package smtpServerProtocol
+
+import (
+	"fmt"
+	"github.com/mailhedgehog/smtpMessage"
+	"golang.org/x/exp/slices"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitKey configures what value of session is limited.
+type RateLimitKey string
+
+const (
+	// RateLimitClientIp limits client Ip, addresses aggregated to IPv4Prefix or IPv6Prefix network.
+	RateLimitClientIp = RateLimitKey("client_ip")
+	// RateLimitSender limits MAIL FROM address, "<>" used for null sender.
+	RateLimitSender = RateLimitKey("sender")
+	// RateLimitRecipientDomain limits domain of each recipient.
+	RateLimitRecipientDomain = RateLimitKey("recipient_domain")
+	// RateLimitAuthIdentity limits authenticated user, not authenticated sessions are not limited.
+	RateLimitAuthIdentity = RateLimitKey("auth_identity")
+)
+
+// RateLimitStage configures on which conversation stage limit is counted.
+type RateLimitStage string
+
+const (
+	RateLimitStageConnect = RateLimitStage("connect")
+	RateLimitStageMail    = RateLimitStage("mail")
+	RateLimitStageRcpt    = RateLimitStage("rcpt")
+	RateLimitStageData    = RateLimitStage("data")
+)
+
+// RateLimit allows Limit events per Interval for each value of Key, events counted on Stage.
+// For example {RateLimitClientIp, RateLimitStageConnect, 10, time.Minute} allows 10 connections per minute.
+type RateLimit struct {
+	Key      RateLimitKey
+	Stage    RateLimitStage
+	Limit    int
+	Interval time.Duration
+}
+
+// RateLimitStore keeps token buckets, can be shared between servers, for example using Redis.
+type RateLimitStore interface {
+	// Take removes token from bucket what contains up to limit tokens refilled during interval,
+	// returns false when bucket is empty.
+	Take(key string, limit int, interval time.Duration, now time.Time) (bool, error)
+}
+
+// RateLimitPolicy limits clients using token buckets, returns 421 on connect
+// and 450 on other stages when limit exceeded. Policy can be shared between protocols.
+type RateLimitPolicy struct {
+	Store  RateLimitStore
+	Limits []RateLimit
+	// IPv4Prefix and IPv6Prefix are lengths of network prefix what shares client Ip limit.
+	IPv4Prefix int
+	IPv6Prefix int
+}
+
+// CreateRateLimitPolicy creates policy what uses in-memory store, IPv6 clients aggregated to /64 networks.
+func CreateRateLimitPolicy(limits ...RateLimit) *RateLimitPolicy {
+	return &RateLimitPolicy{
+		Store:      CreateMemoryRateLimitStore(),
+		Limits:     limits,
+		IPv4Prefix: 32,
+		IPv6Prefix: 64,
+	}
+}
+
+func (policy *RateLimitPolicy) CheckConnect(protocol *Protocol) *Reply {
+	if !policy.take(protocol, RateLimitStageConnect, nil, nil) {
+		return ReplyServiceNotAvailable("4.7.0 Too many connections, try again later")
+	}
+	return nil
+}
+
+func (policy *RateLimitPolicy) CheckMail(protocol *Protocol, path *smtpMessage.MessagePath) *Reply {
+	if !policy.take(protocol, RateLimitStageMail, path, nil) {
+		return ReplyMailboxUnavailable("4.7.0 Too many messages, try again later")
+	}
+	return nil
+}
+
+func (policy *RateLimitPolicy) CheckRcpt(protocol *Protocol, path *smtpMessage.MessagePath) *Reply {
+	if !policy.take(protocol, RateLimitStageRcpt, protocol.message.From, []*smtpMessage.MessagePath{path}) {
+		return ReplyMailboxUnavailable("4.7.0 Too many recipients, try again later")
+	}
+	return nil
+}
+
+func (policy *RateLimitPolicy) CheckData(protocol *Protocol, origin string) *Reply {
+	if !policy.take(protocol, RateLimitStageData, protocol.message.From, protocol.message.To) {
+		return ReplyMailboxUnavailable("4.7.0 Too many messages, try again later")
+	}
+	return nil
+}
+
+// take takes token for each limit of stage, returns false when any limit exceeded.
+func (policy *RateLimitPolicy) take(protocol *Protocol, stage RateLimitStage, sender *smtpMessage.MessagePath, recipients []*smtpMessage.MessagePath) bool {
+	allowed := true
+	for _, limit := range policy.Limits {
+		if limit.Stage != stage || limit.Limit <= 0 {
+			continue
+		}
+
+		for _, value := range policy.values(protocol, limit.Key, stage, sender, recipients) {
+			key := fmt.Sprintf("%s:%s:%d/%s:%s", limit.Stage, limit.Key, limit.Limit, limit.Interval, value)
+			ok, err := policy.Store.Take(key, limit.Limit, limit.Interval, protocol.now())
+			if err != nil {
+				// Broken store should not stop mail flow.
+				logManager().Error(fmt.Sprintf("Rate limit store failed: %s", err.Error()))
+				continue
+			}
+			if !ok {
+				logManager().Debug(fmt.Sprintf("Rate limit %s exceeded", key))
+				allowed = false
+			}
+		}
+	}
+
+	return allowed
+}
+
+// values returns values of session limited by key, empty when value not known on current stage.
+func (policy *RateLimitPolicy) values(protocol *Protocol, key RateLimitKey, stage RateLimitStage, sender *smtpMessage.MessagePath, recipients []*smtpMessage.MessagePath) []string {
+	switch key {
+	case RateLimitClientIp:
+		if protocol.Ip != nil {
+			return []string{clientNetwork(protocol.Ip.IP, policy.IPv4Prefix, policy.IPv6Prefix)}
+		}
+	case RateLimitSender:
+		if sender != nil {
+			return []string{strings.ToLower(sender.Address())}
+		}
+		if stage != RateLimitStageConnect {
+			return []string{"<>"}
+		}
+	case RateLimitRecipientDomain:
+		var domains []string
+		for _, recipient := range recipients {
+			domain := strings.ToLower(recipient.Domain)
+			if !slices.Contains(domains, domain) {
+				domains = append(domains, domain)
+			}
+		}
+		return domains
+	case RateLimitAuthIdentity:
+		if len(protocol.authIdentity) > 0 {
+			return []string{protocol.authIdentity}
+		}
+	}
+
+	return nil
+}
+
+// clientNetwork returns network of Ip, so clients with many addresses share same limit.
+func clientNetwork(ip net.IP, ipv4Prefix int, ipv6Prefix int) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		prefix := ipv4Prefix
+		if prefix <= 0 || prefix > 32 {
+			prefix = 32
+		}
+		return fmt.Sprintf("%s/%d", ip4.Mask(net.CIDRMask(prefix, 32)), prefix)
+	}
+
+	prefix := ipv6Prefix
+	if prefix <= 0 || prefix > 128 {
+		prefix = 128
+	}
+	return fmt.Sprintf("%s/%d", ip.Mask(net.CIDRMask(prefix, 128)), prefix)
+}
+
+// rateLimitBucket is token bucket, tokens refilled continuously.
+type rateLimitBucket struct {
+	tokens   float64
+	updated  time.Time
+	interval time.Duration
+}
+
+// memoryRateLimitStoreSweep is number of operations between removing of full buckets.
+const memoryRateLimitStoreSweep = 1000
+
+// MemoryRateLimitStore is in-memory RateLimitStore implementation, buckets shared between
+// protocols of single process.
+type MemoryRateLimitStore struct {
+	mutex      sync.Mutex
+	buckets    map[string]*rateLimitBucket
+	operations int
+}
+
+// CreateMemoryRateLimitStore creates empty store.
+func CreateMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*rateLimitBucket{}}
+}
+
+func (store *MemoryRateLimitStore) Take(key string, limit int, interval time.Duration, now time.Time) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.operations++
+	if store.operations%memoryRateLimitStoreSweep == 0 {
+		store.sweep(now)
+	}
+
+	bucket, ok := store.buckets[key]
+	if !ok {
+		bucket = &rateLimitBucket{tokens: float64(limit), updated: now, interval: interval}
+		store.buckets[key] = bucket
+	}
+
+	if elapsed := now.Sub(bucket.updated); elapsed > 0 {
+		if interval > 0 {
+			bucket.tokens += float64(limit) * float64(elapsed) / float64(interval)
+		} else {
+			bucket.tokens = float64(limit)
+		}
+		if bucket.tokens > float64(limit) {
+			bucket.tokens = float64(limit)
+		}
+		bucket.updated = now
+	}
+
+	if bucket.tokens < 1 {
+		return false, nil
+	}
+	bucket.tokens--
+
+	return true, nil
+}
+
+// sweep removes buckets what were refilled, they are same as new buckets.
+func (store *MemoryRateLimitStore) sweep(now time.Time) {
+	for key, bucket := range store.buckets {
+		if now.Sub(bucket.updated) >= bucket.interval {
+			delete(store.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package smtpServerProtocol
+
+import (
+	"errors"
+	"github.com/mailhedgehog/gounit"
+	"github.com/mailhedgehog/smtpMessage"
+	"net"
+	"testing"
+	"time"
+)
+
+type failingRateLimitStore struct{}
+
+func (store failingRateLimitStore) Take(key string, limit int, interval time.Duration, now time.Time) (bool, error) {
+	return false, errors.New("store unavailable")
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := CreateMemoryRateLimitStore()
+	now := fixedClock()
+
+	for i := 0; i < 3; i++ {
+		ok, err := store.Take("key", 3, time.Minute, now)
+		(*gounit.T)(t).AssertNotError(err)
+		(*gounit.T)(t).AssertTrue(ok)
+	}
+	ok, _ := store.Take("key", 3, time.Minute, now)
+	(*gounit.T)(t).AssertFalse(ok)
+	ok, _ = store.Take("other", 3, time.Minute, now)
+	(*gounit.T)(t).AssertTrue(ok)
+
+	// One token refilled every 20 seconds.
+	ok, _ = store.Take("key", 3, time.Minute, now.Add(10*time.Second))
+	(*gounit.T)(t).AssertFalse(ok)
+	ok, _ = store.Take("key", 3, time.Minute, now.Add(20*time.Second))
+	(*gounit.T)(t).AssertTrue(ok)
+	ok, _ = store.Take("key", 3, time.Minute, now.Add(20*time.Second))
+	(*gounit.T)(t).AssertFalse(ok)
+
+	// Full buckets removed.
+	store.sweep(now.Add(time.Hour))
+	(*gounit.T)(t).AssertEqualsInt(0, len(store.buckets))
+}
+
+func TestRateLimitPolicyConnect(t *testing.T) {
+	policy := CreateRateLimitPolicy(RateLimit{Key: RateLimitClientIp, Stage: RateLimitStageConnect, Limit: 2, Interval: time.Minute})
+
+	connect := func(ip string) *Reply {
+		protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP(ip)}, nil)
+		protocol.SetClock(fixedClock)
+		protocol.AddPolicy(policy)
+		return protocol.SayWelcome("")
+	}
+
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_READY, connect("192.0.2.1").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_READY, connect("192.0.2.1").Status)
+	reply := connect("192.0.2.1")
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_NOT_AVAILABLE, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("4.7.0 Too many connections, try again later", reply.lines[0])
+	(*gounit.T)(t).AssertTrue(reply.ShouldClose())
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_READY, connect("192.0.2.2").Status)
+
+	// Addresses of same IPv6 /64 network share limit.
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_READY, connect("2001:db8::1").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_READY, connect("2001:db8::2").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_NOT_AVAILABLE, connect("2001:db8::3").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_READY, connect("2001:db8:0:1::1").Status)
+}
+
+func TestRateLimitPolicyTransaction(t *testing.T) {
+	policy := CreateRateLimitPolicy(
+		RateLimit{Key: RateLimitSender, Stage: RateLimitStageMail, Limit: 2, Interval: time.Hour},
+		RateLimit{Key: RateLimitRecipientDomain, Stage: RateLimitStageRcpt, Limit: 3, Interval: time.Hour},
+		RateLimit{Key: RateLimitAuthIdentity, Stage: RateLimitStageData, Limit: 1, Interval: time.Hour},
+	)
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.SetClock(fixedClock)
+	protocol.AddPolicy(policy)
+	protocol.HandleReceivedLine("EHLO client.example.org")
+
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("MAIL FROM:<joe@example.org>").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("RCPT TO:<a@example.com>").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("RCPT TO:<b@Example.com>").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("RCPT TO:<c@example.com>").Status)
+	reply := protocol.HandleReceivedLine("RCPT TO:<d@example.com>")
+	(*gounit.T)(t).AssertEqualsInt(CODE_MAILBOX_UNAVAILABLE, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("4.7.0 Too many recipients, try again later", reply.lines[0])
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("RCPT TO:<a@example.net>").Status)
+
+	protocol.HandleReceivedLine("RSET")
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("MAIL FROM:<Joe@example.org>").Status)
+	protocol.HandleReceivedLine("RSET")
+	reply = protocol.HandleReceivedLine("MAIL FROM:<joe@example.org>")
+	(*gounit.T)(t).AssertEqualsInt(CODE_MAILBOX_UNAVAILABLE, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("4.7.0 Too many messages, try again later", reply.lines[0])
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("MAIL FROM:<>").Status)
+
+	// Authenticated user limited at end of data.
+	protocol.authIdentity = "joe"
+	protocol.OnMessageReceived(func(message *smtpMessage.SmtpMessage) (string, error) {
+		return "id", nil
+	})
+	for i, expected := range []int{CODE_ACTION_OK, CODE_MAILBOX_UNAVAILABLE} {
+		for _, line := range []string{"RSET", "MAIL FROM:" + []string{"<jane@example.org>", "<john@example.org>"}[i], "RCPT TO:<a@example.org>", "DATA", "Subject: test", "", "body"} {
+			protocol.HandleReceivedLine(line)
+		}
+		(*gounit.T)(t).AssertEqualsInt(expected, protocol.HandleReceivedLine(".").Status)
+	}
+}
+
+func TestRateLimitPolicyStoreFailure(t *testing.T) {
+	policy := CreateRateLimitPolicy(RateLimit{Key: RateLimitClientIp, Stage: RateLimitStageConnect, Limit: 1, Interval: time.Minute})
+	policy.Store = failingRateLimitStore{}
+
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, nil)
+	protocol.AddPolicy(policy)
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_READY, protocol.SayWelcome("").Status)
+}
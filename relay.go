@@ -0,0 +1,107 @@
+package smtpServerProtocol
+
+import (
+	"fmt"
+	"github.com/mailhedgehog/smtpMessage"
+	"net"
+	"strings"
+)
+
+// RelayPolicy prevents open relay: recipients of not local domains accepted only from trusted
+// networks or authenticated sessions.
+type RelayPolicy struct {
+	// LocalDomains are domains what server accepts mail for, "*.example.com" matches any subdomain
+	// of example.com, but not example.com itself.
+	LocalDomains []string
+	// RelayNetworks are client networks allowed to relay.
+	RelayNetworks []*net.IPNet
+	// AllowAuthenticated allows authenticated sessions to relay.
+	AllowAuthenticated bool
+}
+
+// CreateRelayPolicy creates policy what accepts mail for local domains and allows
+// authenticated sessions to relay.
+func CreateRelayPolicy(localDomains ...string) *RelayPolicy {
+	return &RelayPolicy{
+		LocalDomains:       localDomains,
+		AllowAuthenticated: true,
+	}
+}
+
+// ParseNetworks parses list of networks in CIDR notation, single address treated as network
+// of this address only, for example "192.0.2.0/24", "2001:db8::/32" or "127.0.0.1".
+func ParseNetworks(networks ...string) ([]*net.IPNet, error) {
+	var parsed []*net.IPNet
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network \"%s\"", network)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network \"%s\"", network)
+		}
+		parsed = append(parsed, ipNet)
+	}
+
+	return parsed, nil
+}
+
+// containsIp checks if any of networks contains Ip.
+func containsIp(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy *RelayPolicy) CheckRcpt(protocol *Protocol, path *smtpMessage.MessagePath) *Reply {
+	if policy.IsLocal(path) {
+		return nil
+	}
+	if protocol.Ip != nil && containsIp(policy.RelayNetworks, protocol.Ip.IP) {
+		return nil
+	}
+	if policy.AllowAuthenticated && len(protocol.authIdentity) > 0 {
+		return nil
+	}
+
+	logManager().Debug(fmt.Sprintf("Relay to %s denied", path.Address()))
+	return ReplyTransactionFailed("5.7.1 <" + path.Address() + ">: Relay access denied")
+}
+
+// IsLocal checks if recipient belongs to local domain. Local parts with routing characters
+// ("user%example.net@example.com" or "host!user@example.com") are not local, as some mail systems
+// still forward them to other host.
+func (policy *RelayPolicy) IsLocal(path *smtpMessage.MessagePath) bool {
+	if strings.ContainsAny(path.Mailbox, "%!@\"") {
+		return false
+	}
+
+	domain := normalizeDnsName(path.Domain)
+	for _, localDomain := range policy.LocalDomains {
+		localDomain = normalizeDnsName(localDomain)
+		if strings.HasPrefix(localDomain, "*.") {
+			if strings.HasSuffix(domain, localDomain[1:]) && len(domain) > len(localDomain)-1 {
+				return true
+			}
+			continue
+		}
+		if domain == localDomain {
+			return true
+		}
+	}
+
+	return false
+}
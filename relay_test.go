@@ -0,0 +1,88 @@
+package smtpServerProtocol
+
+import (
+	"github.com/mailhedgehog/gounit"
+	"net"
+	"testing"
+)
+
+func createTestRelayPolicy(t *testing.T) *RelayPolicy {
+	policy := CreateRelayPolicy("example.com", "*.example.org")
+	networks, err := ParseNetworks("192.0.2.0/24", "2001:db8::1")
+	(*gounit.T)(t).AssertNotError(err)
+	policy.RelayNetworks = networks
+
+	return policy
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := ParseNetworks("192.0.2.0/24", " 198.51.100.7 ", "2001:db8::/32", "2001:db8::1")
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertEqualsInt(4, len(networks))
+	(*gounit.T)(t).AssertEqualsString("198.51.100.7/32", networks[1].String())
+	(*gounit.T)(t).AssertEqualsString("2001:db8::1/128", networks[3].String())
+
+	for _, network := range []string{"example.com", "192.0.2.0/33", ""} {
+		_, err = ParseNetworks(network)
+		(*gounit.T)(t).ExpectError(err)
+	}
+}
+
+func TestRelayPolicyOpenRelayProbes(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("203.0.113.1")}, nil)
+	protocol.AddPolicy(createTestRelayPolicy(t))
+	protocol.HandleReceivedLine("EHLO probe.example.net")
+	protocol.HandleReceivedLine("MAIL FROM:<spammer@example.net>")
+
+	accepted := []string{
+		"<admin@example.com>",
+		"<Admin@EXAMPLE.COM.>",
+		"<admin@mail.example.org>",
+		"<admin@deep.mail.example.org>",
+		"<@relay.example.net:admin@example.com>",
+	}
+	for _, recipient := range accepted {
+		(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("RCPT TO:"+recipient).Status)
+	}
+
+	denied := []string{
+		"<victim@example.net>",
+		"<victim@example.org>",
+		"<victim@notexample.com>",
+		"<victim@example.com.example.net>",
+		"<victim%example.net@example.com>",
+		"<example.net!victim@example.com>",
+		"<victim@example.net@example.com>",
+		"<\"victim@example.net\"@example.com>",
+		"<@example.com:victim@example.net>",
+		"<victim@[192.0.2.1]>",
+	}
+	for _, recipient := range denied {
+		reply := protocol.HandleReceivedLine("RCPT TO:" + recipient)
+		(*gounit.T)(t).AssertEqualsInt(CODE_TRANSACTION_FAILED, reply.Status)
+	}
+	reply := protocol.HandleReceivedLine("RCPT TO:<victim@example.net>")
+	(*gounit.T)(t).AssertEqualsString("5.7.1 <victim@example.net>: Relay access denied", reply.lines[0])
+}
+
+func TestRelayPolicyTrustedClients(t *testing.T) {
+	policy := createTestRelayPolicy(t)
+
+	for ip, expected := range map[string]int{"192.0.2.10": CODE_ACTION_OK, "2001:db8::1": CODE_ACTION_OK, "2001:db8::2": CODE_TRANSACTION_FAILED} {
+		protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP(ip)}, nil)
+		protocol.AddPolicy(policy)
+		protocol.HandleReceivedLine("EHLO client.example.net")
+		protocol.HandleReceivedLine("MAIL FROM:<joe@example.com>")
+		(*gounit.T)(t).AssertEqualsInt(expected, protocol.HandleReceivedLine("RCPT TO:<friend@example.net>").Status)
+	}
+
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("203.0.113.1")}, nil)
+	protocol.AddPolicy(policy)
+	protocol.HandleReceivedLine("EHLO client.example.net")
+	protocol.HandleReceivedLine("MAIL FROM:<joe@example.com>")
+	protocol.authIdentity = "joe"
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("RCPT TO:<friend@example.net>").Status)
+
+	policy.AllowAuthenticated = false
+	(*gounit.T)(t).AssertEqualsInt(CODE_TRANSACTION_FAILED, protocol.HandleReceivedLine("RCPT TO:<friend@example.net>").Status)
+}
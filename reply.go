@@ -1,11 +1,31 @@
 package smtpServerProtocol
 
-import "strconv"
+import (
+	"strconv"
+	"time"
+)
+
+// ReplyAction tells connection driver what to do after reply was written.
+type ReplyAction int
+
+// List of actions what connection driver should support.
+const (
+	// ActionContinue means conversation continues, read next line.
+	ActionContinue ReplyAction = iota
+	// ActionClose means session is finished and connection should be closed.
+	ActionClose
+	// ActionStartTls means connection should be upgraded to TLS (rfc3207).
+	ActionStartTls
+)
 
 // Reply is a struct representing an SMTP reply (status code + lines)
 type Reply struct {
 	Status int
 	lines  []string
+	// Action what connection driver should do after reply sent.
+	Action ReplyAction
+	// Delay what connection driver should wait before reply sent, used to slow down abusive clients.
+	Delay time.Duration
 }
 
 // LIst of predefined by rfc5321 list of status codes.
@@ -29,12 +49,14 @@ const (
 	CODE_COMMAND_NOT_IMPLEMENTED   = 502
 	CODE_COMMANDS_BAD_SEQUENCE     = 503
 	CODE_PARAMETER_NOT_IMPLEMENTED = 504
+	CODE_AUTH_REQUIRED             = 530
 	CODE_AUTH_FAILED               = 535
 	CODE_MAILBOX_404               = 550
 	CODE_USER_NOT_LOCAL            = 551 // please try <forward-path>
 	CODE_EXCEEDED_STORAGE          = 552
 	CODE__MAILBOX_NAME_INCORRECT   = 553
 	CODE_TRANSACTION_FAILED        = 554
+	CODE_PARAMETERS_NOT_RECOGNIZED = 555
 )
 
 // FormattedLines returns the formatted SMTP reply lines.
@@ -62,15 +84,17 @@ func (r Reply) FormattedLines() []string {
 
 // ReplyServiceReady creates a welcome reply.
 func ReplyServiceReady(identification string) *Reply {
-	return &Reply{CODE_SERVICE_READY, []string{identification}}
+	return &Reply{Status: CODE_SERVICE_READY, lines: []string{identification}}
 }
 
 // ReplyBye used on close connection.
-func ReplyBye() *Reply { return &Reply{CODE_SERVICE_CLOSING, []string{"Bye"}} }
+func ReplyBye() *Reply {
+	return &Reply{Status: CODE_SERVICE_CLOSING, lines: []string{"Bye"}, Action: ActionClose}
+}
 
 // ReplyAuthOk creates a authentication successful reply.
 func ReplyAuthOk() *Reply {
-	return &Reply{CODE_AUTHENTICATION_SUCCESS, []string{"Authenticate successful"}}
+	return &Reply{Status: CODE_AUTHENTICATION_SUCCESS, lines: []string{"Authenticate successful"}}
 }
 
 // ReplyOk represents generic success response.
@@ -78,42 +102,121 @@ func ReplyOk(message ...string) *Reply {
 	if len(message) == 0 {
 		message = []string{"Ok"}
 	}
-	return &Reply{CODE_ACTION_OK, message}
+	return &Reply{Status: CODE_ACTION_OK, lines: message}
 }
 
 func ReplyUnrecognisedCommand() *Reply {
-	return &Reply{CODE_COMMAND_SYNTAX_ERROR, []string{"Unrecognised command"}}
+	return &Reply{Status: CODE_COMMAND_SYNTAX_ERROR, lines: []string{"Unrecognised command"}}
 }
 
 func ReplyCommandNotImplemented() *Reply {
-	return &Reply{CODE_COMMAND_NOT_IMPLEMENTED, []string{"Command not implemented"}}
+	return &Reply{Status: CODE_COMMAND_NOT_IMPLEMENTED, lines: []string{"Command not implemented"}}
 }
 
 // ReplyLineTooLong due to exceeding these limits
 func ReplyLineTooLong() *Reply {
-	return &Reply{CODE_COMMAND_SYNTAX_ERROR, []string{"Line too long."}}
+	return &Reply{Status: CODE_COMMAND_SYNTAX_ERROR, lines: []string{"Line too long."}}
 }
 
 // ReplyAuthCredentials creates reply with a 334 code and requests a username
 func ReplyAuthCredentials(response string) *Reply {
-	return &Reply{CODE_AUTH_CREDENTIALS, []string{response}}
+	return &Reply{Status: CODE_AUTH_CREDENTIALS, lines: []string{response}}
 }
 
 func ReplyAuthFailed(response string) *Reply {
 	if len(response) <= 0 {
 		response = "Authenticate failed"
 	}
-	return &Reply{CODE_AUTH_FAILED, []string{response}}
+	return &Reply{Status: CODE_AUTH_FAILED, lines: []string{response}}
+}
+
+// ReplyAuthRequired used when transaction started by client what is not able to authenticate.
+func ReplyAuthRequired(response string) *Reply {
+	return &Reply{Status: CODE_AUTH_REQUIRED, lines: []string{response}}
 }
 
 func ReplyMailbox404(response string) *Reply {
-	return &Reply{CODE_MAILBOX_404, []string{response}}
+	return &Reply{Status: CODE_MAILBOX_404, lines: []string{response}}
+}
+
+// ReplyMailboxUnavailable used when command temporarily rejected, for example limit exceeded.
+func ReplyMailboxUnavailable(response string) *Reply {
+	return &Reply{Status: CODE_MAILBOX_UNAVAILABLE, lines: []string{response}}
+}
+
+func ReplyLocalError(response string) *Reply {
+	return &Reply{Status: CODE_LOCAL_ERROR, lines: []string{response}}
 }
 
 func ReplyExceededStorage(response string) *Reply {
-	return &Reply{CODE_EXCEEDED_STORAGE, []string{response}}
+	return &Reply{Status: CODE_EXCEEDED_STORAGE, lines: []string{response}}
 }
 
 func ReplyMailData() *Reply {
-	return &Reply{CODE_MAIL_DATA, []string{"End data with <CR><LF>.<CR><LF>"}}
+	return &Reply{Status: CODE_MAIL_DATA, lines: []string{"End data with <CR><LF>.<CR><LF>"}}
+}
+
+// ReplyTooManyHops used when mail loop detected (rfc5321 section 6.3).
+func ReplyTooManyHops() *Reply {
+	return &Reply{Status: CODE_TRANSACTION_FAILED, lines: []string{"5.4.6 Too many hops"}}
+}
+
+// ReplyBareLineEnding used when command contains bare <CR> or <LF>.
+func ReplyBareLineEnding() *Reply {
+	return &Reply{Status: CODE_COMMAND_SYNTAX_ERROR, lines: []string{"5.5.2 Bare <CR> or <LF> not allowed"}}
+}
+
+// ReplyBareLineEndingInData used when message data contains bare <CR> or <LF>.
+func ReplyBareLineEndingInData() *Reply {
+	return &Reply{Status: CODE_MAILBOX_404, lines: []string{"5.5.2 Bare <CR> or <LF> not allowed in message data"}}
+}
+
+// ReplyPathTooLong used when reverse-path or forward-path exceeds limit.
+func ReplyPathTooLong() *Reply {
+	return &Reply{Status: CODE_PARAMETER_SYNTAX_ERROR, lines: []string{"5.5.4 Path too long"}}
+}
+
+// ReplyMailboxNameIncorrect used when mailbox name not allowed, for example too long.
+func ReplyMailboxNameIncorrect(response string) *Reply {
+	return &Reply{Status: CODE__MAILBOX_NAME_INCORRECT, lines: []string{response}}
+}
+
+// ReplyServiceNotAvailable used when server going to close connection.
+func ReplyServiceNotAvailable(response string) *Reply {
+	return &Reply{Status: CODE_SERVICE_NOT_AVAILABLE, lines: []string{response}, Action: ActionClose}
+}
+
+// ReplyReadyToStartTls used as positive reply to STARTTLS command.
+func ReplyReadyToStartTls() *Reply {
+	return &Reply{Status: CODE_SERVICE_READY, lines: []string{"2.0.0 Ready to start TLS"}, Action: ActionStartTls}
+}
+
+// ReplyBadSequence used when command received in wrong order.
+func ReplyBadSequence(response string) *Reply {
+	return &Reply{Status: CODE_COMMANDS_BAD_SEQUENCE, lines: []string{response}}
+}
+
+// ReplySyntaxError used when command parameters are invalid.
+func ReplySyntaxError(response string) *Reply {
+	return &Reply{Status: CODE_PARAMETER_SYNTAX_ERROR, lines: []string{response}}
+}
+
+// ReplyParametersNotRecognized used when MAIL FROM or RCPT TO parameters are not supported.
+func ReplyParametersNotRecognized(response string) *Reply {
+	return &Reply{Status: CODE_PARAMETERS_NOT_RECOGNIZED, lines: []string{response}}
+}
+
+// ShouldClose returns true when connection should be closed after reply.
+func (r Reply) ShouldClose() bool {
+	return r.Action == ActionClose
+}
+
+// ReplyProtocolViolation used when client does not wait for server replies.
+func ReplyProtocolViolation() *Reply {
+	return &Reply{Status: CODE_TRANSACTION_FAILED, lines: []string{"5.5.1 Protocol error, talking too early"}, Action: ActionClose}
+}
+
+// ReplyTransactionFailed used when client or transaction rejected by policy.
+func ReplyTransactionFailed(response string) *Reply {
+	return &Reply{Status: CODE_TRANSACTION_FAILED, lines: []string{response}}
 }
@@ -30,3 +30,10 @@ func TestLinesOfReply(t *testing.T) {
 	(*gounit.T)(t).AssertEqualsString("250-BAR"+CommandEndSymbol, lines[1])
 	(*gounit.T)(t).AssertEqualsString("250 baz"+CommandEndSymbol, lines[2])
 }
+
+func TestReplyAction(t *testing.T) {
+	(*gounit.T)(t).AssertFalse(ReplyOk().ShouldClose())
+	(*gounit.T)(t).AssertTrue(ReplyBye().ShouldClose())
+	(*gounit.T)(t).AssertTrue(ReplyServiceNotAvailable("foo").ShouldClose())
+	(*gounit.T)(t).AssertTrue(ReplyReadyToStartTls().Action == ActionStartTls)
+}
@@ -0,0 +1,110 @@
+package smtpServerProtocol
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// dnsLookupTimeout limits time of one DNS lookup made by policies.
+const dnsLookupTimeout = 10 * time.Second
+
+// Resolver allows to replace DNS lookups used by policies, net.Resolver satisfies this interface.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// DefaultResolver uses system DNS configuration.
+var DefaultResolver Resolver = net.DefaultResolver
+
+// MemoryResolver is in-memory Resolver implementation, useful for tests.
+// Names are case-insensitive, trailing dot is optional.
+type MemoryResolver struct {
+	// Addr contains PTR records, key is IP address.
+	Addr map[string][]string
+	// IP contains A and AAAA records.
+	IP map[string][]net.IP
+	// TXT contains TXT records.
+	TXT map[string][]string
+	// MX contains MX records.
+	MX map[string][]*net.MX
+	// Failing contains names what return temporary error for any lookup.
+	Failing map[string]bool
+}
+
+// CreateMemoryResolver creates resolver without records.
+func CreateMemoryResolver() *MemoryResolver {
+	return &MemoryResolver{
+		Addr:    map[string][]string{},
+		IP:      map[string][]net.IP{},
+		TXT:     map[string][]string{},
+		MX:      map[string][]*net.MX{},
+		Failing: map[string]bool{},
+	}
+}
+
+func (resolver *MemoryResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if err := resolver.check(addr, len(resolver.Addr[addr])); err != nil {
+		return nil, err
+	}
+	return resolver.Addr[addr], nil
+}
+
+func (resolver *MemoryResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	host = normalizeDnsName(host)
+	if err := resolver.check(host, len(resolver.IP[host])); err != nil {
+		return nil, err
+	}
+
+	var addresses []net.IPAddr
+	for _, ip := range resolver.IP[host] {
+		addresses = append(addresses, net.IPAddr{IP: ip})
+	}
+	return addresses, nil
+}
+
+func (resolver *MemoryResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	name = normalizeDnsName(name)
+	if err := resolver.check(name, len(resolver.TXT[name])); err != nil {
+		return nil, err
+	}
+	return resolver.TXT[name], nil
+}
+
+func (resolver *MemoryResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	name = normalizeDnsName(name)
+	if err := resolver.check(name, len(resolver.MX[name])); err != nil {
+		return nil, err
+	}
+	return resolver.MX[name], nil
+}
+
+func (resolver *MemoryResolver) check(name string, recordsCount int) error {
+	if resolver.Failing[name] {
+		return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	if recordsCount == 0 {
+		return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return nil
+}
+
+// normalizeDnsName converts name to lower case without trailing dot.
+func normalizeDnsName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// isNotFound returns true when DNS lookup error means what record not exists.
+func isNotFound(err error) bool {
+	var dnsError *net.DNSError
+	return errors.As(err, &dnsError) && dnsError.IsNotFound
+}
+
+func lookupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), dnsLookupTimeout)
+}
@@ -0,0 +1,77 @@
+package smtpServerProtocol
+
+import (
+	"fmt"
+	"net"
+)
+
+// maximumPtrNames limits count of PTR names what will be verified by forward lookup.
+const maximumPtrNames = 10
+
+// ReverseDnsPolicy makes forward-confirmed reverse DNS check of client Ip on connect
+// and stores verified name in Session.ReverseHostname.
+type ReverseDnsPolicy struct {
+	Resolver Resolver
+	// Reject closes session when client has no valid reverse DNS.
+	Reject bool
+}
+
+// CreateReverseDnsPolicy creates policy what uses DefaultResolver.
+func CreateReverseDnsPolicy(reject bool) *ReverseDnsPolicy {
+	return &ReverseDnsPolicy{
+		Resolver: DefaultResolver,
+		Reject:   reject,
+	}
+}
+
+func (policy *ReverseDnsPolicy) CheckConnect(protocol *Protocol) *Reply {
+	if protocol.Ip == nil {
+		return nil
+	}
+
+	hostname, err := VerifyReverseDns(policy.Resolver, protocol.Ip.IP.String())
+	protocol.Session().ReverseHostname = hostname
+	if len(hostname) > 0 || !policy.Reject {
+		return nil
+	}
+
+	if err != nil && !isNotFound(err) {
+		logManager().Debug(fmt.Sprintf("Reverse DNS lookup failed: %s", err.Error()))
+		return ReplyServiceNotAvailable("4.7.25 Reverse DNS lookup failed, try again later")
+	}
+
+	return ReplyTransactionFailed("5.7.25 Reverse DNS validation failed")
+}
+
+// VerifyReverseDns returns first PTR name of ip what resolves back to the same ip.
+func VerifyReverseDns(resolver Resolver, ip string) (string, error) {
+	ctx, cancel := lookupContext()
+	defer cancel()
+
+	names, err := resolver.LookupAddr(ctx, ip)
+	if err != nil {
+		return "", err
+	}
+	if len(names) > maximumPtrNames {
+		names = names[:maximumPtrNames]
+	}
+
+	parsedIp := net.ParseIP(ip)
+	var lookupErr error
+	for _, name := range names {
+		addresses, err := resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			if !isNotFound(err) {
+				lookupErr = err
+			}
+			continue
+		}
+		for _, address := range addresses {
+			if address.IP.Equal(parsedIp) {
+				return normalizeDnsName(name), nil
+			}
+		}
+	}
+
+	return "", lookupErr
+}
@@ -0,0 +1,92 @@
+package smtpServerProtocol
+
+import (
+	"github.com/mailhedgehog/gounit"
+	"net"
+	"testing"
+)
+
+func createReverseDnsResolver() *MemoryResolver {
+	resolver := CreateMemoryResolver()
+	resolver.Addr["192.0.2.1"] = []string{"mail.example.org."}
+	resolver.IP["mail.example.org"] = []net.IP{net.ParseIP("192.0.2.1")}
+	resolver.Addr["192.0.2.2"] = []string{"spoofed.example.org."}
+	resolver.IP["spoofed.example.org"] = []net.IP{net.ParseIP("198.51.100.1")}
+	resolver.Addr["192.0.2.3"] = []string{"broken.example.org."}
+	resolver.Failing["broken.example.org"] = true
+	resolver.Addr["::ffff:192.0.2.5"] = []string{"mapped.example.org."}
+	resolver.IP["mapped.example.org"] = []net.IP{net.ParseIP("192.0.2.5").To4()}
+	resolver.Addr["2001:db8:0:0::1"] = []string{"ipv6.example.org."}
+	resolver.IP["ipv6.example.org"] = []net.IP{net.ParseIP("2001:db8::1")}
+
+	return resolver
+}
+
+func TestVerifyReverseDns(t *testing.T) {
+	resolver := createReverseDnsResolver()
+
+	hostname, err := VerifyReverseDns(resolver, "192.0.2.1")
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertEqualsString("mail.example.org", hostname)
+
+	hostname, err = VerifyReverseDns(resolver, "192.0.2.2")
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertEqualsString("", hostname)
+
+	hostname, err = VerifyReverseDns(resolver, "::ffff:192.0.2.5")
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertEqualsString("mapped.example.org", hostname)
+
+	hostname, err = VerifyReverseDns(resolver, "2001:db8:0:0::1")
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertEqualsString("ipv6.example.org", hostname)
+
+	hostname, err = VerifyReverseDns(resolver, "192.0.2.4")
+	(*gounit.T)(t).AssertTrue(isNotFound(err))
+	(*gounit.T)(t).AssertEqualsString("", hostname)
+}
+
+func TestReverseDnsPolicy(t *testing.T) {
+	policy := &ReverseDnsPolicy{Resolver: createReverseDnsResolver(), Reject: true}
+
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, nil)
+	protocol.AddPolicy(policy)
+	reply := protocol.SayWelcome("")
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_READY, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("mail.example.org", protocol.Session().ReverseHostname)
+
+	protocol = CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("192.0.2.2")}, nil)
+	protocol.AddPolicy(policy)
+	reply = protocol.SayWelcome("")
+	(*gounit.T)(t).AssertEqualsInt(CODE_TRANSACTION_FAILED, reply.Status)
+	(*gounit.T)(t).AssertTrue(reply.ShouldClose())
+	(*gounit.T)(t).AssertEqualsString(string(StateClosed), string(protocol.state))
+
+	protocol = CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("192.0.2.3")}, nil)
+	protocol.AddPolicy(policy)
+	reply = protocol.SayWelcome("")
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_NOT_AVAILABLE, reply.Status)
+
+	policy.Reject = false
+	protocol = CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("192.0.2.2")}, nil)
+	protocol.AddPolicy(policy)
+	reply = protocol.SayWelcome("")
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_READY, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("", protocol.Session().ReverseHostname)
+}
+
+func TestReceivedHeaderWithReverseHostname(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, nil)
+	protocol.SetClock(fixedClock)
+	protocol.SetTraceHeaders(TraceHeaders{Received: true})
+	protocol.AddPolicy(&ReverseDnsPolicy{Resolver: createReverseDnsResolver()})
+	protocol.SayWelcome("")
+	protocol.message.ID = "queue-id"
+
+	message := sendTestMessage(protocol, "HELO client", "MAIL FROM:<foo@bar.com>", "DATA", "Subject: test", "", "body", ".")
+
+	(*gounit.T)(t).AssertEqualsString("Received: from client (mail.example.org [192.0.2.1])\r\n"+
+		"\tby mx.example.com with SMTP id queue-id;\r\n"+
+		"\tTue, 02 Jan 2024 15:04:05 +0000\r\n"+
+		"Subject: test\r\n\r\nbody", message.GetOrigin())
+}
@@ -0,0 +1,202 @@
+package smtpServerProtocol
+
+import (
+	"github.com/mailhedgehog/smtpMessage"
+	"strings"
+)
+
+// Session contains information collected about client during connection,
+// unlike message it is not reset between transactions.
+type Session struct {
+	// ReverseHostname is forward-confirmed PTR name of client Ip, empty when not verified.
+	ReverseHostname string
+	// DnsblListings contains block lists what contain client Ip, found by all DNSBL policies.
+	DnsblListings []DnsblListing
+	// SpfResult is result of SPF check of last transaction sender.
+	SpfResult SpfResult
+	// SpfDomain is domain of identity checked by SPF.
+	SpfDomain string
+	// SpfScope is identity checked by SPF, SpfScopeMailFrom or SpfScopeHelo.
+	SpfScope string
+	// DkimResults contains results of DKIM signatures verification of last message.
+	DkimResults []DkimResult
+	// DmarcResult is result of DMARC evaluation of last message.
+	DmarcResult DmarcResult
+	// ArcResult is result of ARC chain validation of last message.
+	ArcResult ArcResult
+	// SpamResult is result of spam scoring of last message.
+	SpamResult SpamResult
+	// VirusScanResult is result of antivirus scan of last message.
+	VirusScanResult VirusScanResult
+}
+
+// List of identities what can be checked by SPF.
+const (
+	SpfScopeMailFrom = "mailfrom"
+	SpfScopeHelo     = "helo"
+)
+
+// Policy is a check executed on conversation stages, policy should implement
+// one or more of stage interfaces, for example ConnectPolicy.
+type Policy interface{}
+
+// ConnectPolicy executed before greeting, returned reply replaces greeting and closes session.
+type ConnectPolicy interface {
+	CheckConnect(protocol *Protocol) *Reply
+}
+
+// HeloPolicy executed for HELO and EHLO commands, returned reply rejects greeting.
+type HeloPolicy interface {
+	CheckHelo(protocol *Protocol, helo string) *Reply
+}
+
+// MailPolicy executed for MAIL command, path is nil for null reverse-path, returned reply rejects sender.
+type MailPolicy interface {
+	CheckMail(protocol *Protocol, path *smtpMessage.MessagePath) *Reply
+}
+
+// RcptPolicy executed for each recipient, returned reply rejects recipient.
+type RcptPolicy interface {
+	CheckRcpt(protocol *Protocol, path *smtpMessage.MessagePath) *Reply
+}
+
+// DataPolicy executed after end of data for message content without trace headers,
+// returned reply rejects message.
+type DataPolicy interface {
+	CheckData(protocol *Protocol, origin string) *Reply
+}
+
+// ReplyPolicy executed for each reply to client line, policy can change reply, for example delay it.
+type ReplyPolicy interface {
+	CheckReply(protocol *Protocol, reply *Reply)
+}
+
+// ClosePolicy executed when session finished, allows policy to release resources.
+type ClosePolicy interface {
+	Close(protocol *Protocol)
+}
+
+// Session returns information collected about client.
+func (protocol *Protocol) Session() *Session {
+	return protocol.session
+}
+
+// AddPolicy adds check executed on conversation stages, policies executed in order they were added.
+func (protocol *Protocol) AddPolicy(policy Policy) {
+	protocol.policies = append(protocol.policies, policy)
+}
+
+// checkConnectPolicies returns rejection reply of first failed policy.
+func (protocol *Protocol) checkConnectPolicies() *Reply {
+	for _, policy := range protocol.policies {
+		if connectPolicy, ok := policy.(ConnectPolicy); ok {
+			if reply := connectPolicy.CheckConnect(protocol); reply != nil {
+				return reply
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkHeloPolicies returns rejection reply of first failed policy.
+func (protocol *Protocol) checkHeloPolicies(helo string) *Reply {
+	for _, policy := range protocol.policies {
+		if heloPolicy, ok := policy.(HeloPolicy); ok {
+			if reply := heloPolicy.CheckHelo(protocol, helo); reply != nil {
+				return reply
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkMailPolicies returns rejection reply of first failed policy.
+func (protocol *Protocol) checkMailPolicies(path *smtpMessage.MessagePath) *Reply {
+	for _, policy := range protocol.policies {
+		if mailPolicy, ok := policy.(MailPolicy); ok {
+			if reply := mailPolicy.CheckMail(protocol, path); reply != nil {
+				return reply
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkRcptPolicies returns rejection reply of first failed policy.
+func (protocol *Protocol) checkRcptPolicies(path *smtpMessage.MessagePath) *Reply {
+	for _, policy := range protocol.policies {
+		if rcptPolicy, ok := policy.(RcptPolicy); ok {
+			if reply := rcptPolicy.CheckRcpt(protocol, path); reply != nil {
+				return reply
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkDataPolicies returns rejection reply of first failed policy, each policy receives
+// content modified by previous ones.
+func (protocol *Protocol) checkDataPolicies() *Reply {
+	for _, policy := range protocol.policies {
+		if dataPolicy, ok := policy.(DataPolicy); ok {
+			if reply := dataPolicy.CheckData(protocol, protocol.tempOrigin); reply != nil {
+				return reply
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkReplyPolicies passes reply to all reply policies.
+func (protocol *Protocol) checkReplyPolicies(reply *Reply) *Reply {
+	if reply == nil {
+		return nil
+	}
+	for _, policy := range protocol.policies {
+		if replyPolicy, ok := policy.(ReplyPolicy); ok {
+			replyPolicy.CheckReply(protocol, reply)
+		}
+	}
+
+	return reply
+}
+
+// Close finishes session and executes close policies, should be called when connection closed.
+func (protocol *Protocol) Close() {
+	if protocol.policiesClosed {
+		return
+	}
+	protocol.policiesClosed = true
+	protocol.state = StateClosed
+
+	for _, policy := range protocol.policies {
+		if closePolicy, ok := policy.(ClosePolicy); ok {
+			closePolicy.Close(protocol)
+		}
+	}
+}
+
+// ReplaceMessageContent allows data policy to modify content of current message.
+func (protocol *Protocol) ReplaceMessageContent(origin string) {
+	protocol.tempOrigin = strings.TrimSuffix(origin, CommandEndSymbol)
+}
+
+// Discard accepts current message, but it will not be passed to OnMessageReceived callback.
+func (protocol *Protocol) Discard() {
+	protocol.discardMessage = true
+}
+
+// Quarantine marks current message as quarantined, reason available in OnMessageReceived callback.
+func (protocol *Protocol) Quarantine(reason string) {
+	protocol.quarantineReason = reason
+}
+
+// QuarantineReason returns reason of current message quarantine, empty when message is not quarantined.
+func (protocol *Protocol) QuarantineReason() string {
+	return protocol.quarantineReason
+}
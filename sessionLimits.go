@@ -0,0 +1,99 @@
+package smtpServerProtocol
+
+import (
+	"fmt"
+)
+
+// sessionCounters contains counters used to enforce per session limits, they are not reset between transactions.
+type sessionCounters struct {
+	commands          int
+	errors            int
+	transactions      int
+	authFailures      int
+	invalidRecipients int
+	// rejectedCommands counts unrecognised commands and command syntax errors.
+	rejectedCommands int
+}
+
+// tarpitErrors returns count of errors what are typical for attacks: failed authentication,
+// unknown recipients and unrecognised commands.
+func (counters *sessionCounters) tarpitErrors() int {
+	return counters.authFailures + counters.invalidRecipients + counters.rejectedCommands
+}
+
+// checkSessionLimits verifies limits before command will be executed.
+func (protocol *Protocol) checkSessionLimits(command *Command) *Reply {
+	protocol.counters.commands++
+	if protocol.validation.MaximumCommands > 0 && protocol.counters.commands > protocol.validation.MaximumCommands {
+		return protocol.closeSession("4.7.0", "Too many commands")
+	}
+
+	if command.verb == CommandMail &&
+		protocol.validation.MaximumTransactions > 0 &&
+		protocol.counters.transactions >= protocol.validation.MaximumTransactions {
+		return protocol.closeSession("4.7.0", "Too many transactions")
+	}
+
+	return nil
+}
+
+// countSessionErrors updates counters using reply and closes session when some limit exceeded,
+// so client is allowed to make exactly limit count of failures.
+// Command is nil when reply created by custom scene.
+func (protocol *Protocol) countSessionErrors(command *Command, reply *Reply) *Reply {
+	if reply == nil || protocol.state == StateClosed {
+		return reply
+	}
+
+	if command != nil && command.verb == CommandMail && reply.Status == CODE_ACTION_OK {
+		protocol.counters.transactions++
+	}
+
+	// Temporary failures (greylisting, rate limits) are expected from legitimate clients, so only
+	// permanent failures are counted.
+	if reply.Status < CODE_COMMAND_SYNTAX_ERROR {
+		return reply
+	}
+
+	protocol.counters.errors++
+	// 535 is also sent to commands waiting for authentication, only AUTH and auth scene replies are failures.
+	if reply.Status == CODE_AUTH_FAILED && (command == nil || command.verb == CommandAuth) {
+		protocol.counters.authFailures++
+	}
+	if command != nil && command.verb == CommandRcpt && isInvalidRecipientStatus(reply.Status) {
+		protocol.counters.invalidRecipients++
+	}
+	if command != nil && reply.Status >= CODE_COMMAND_SYNTAX_ERROR && reply.Status <= CODE_PARAMETER_NOT_IMPLEMENTED {
+		protocol.counters.rejectedCommands++
+	}
+
+	switch {
+	case protocol.validation.MaximumAuthFailures > 0 && protocol.counters.authFailures > protocol.validation.MaximumAuthFailures:
+		return protocol.closeSession("4.7.0", "Too many authentication failures")
+	case protocol.validation.MaximumInvalidRecipients > 0 && protocol.counters.invalidRecipients > protocol.validation.MaximumInvalidRecipients:
+		return protocol.closeSession("4.7.0", "Too many invalid recipients")
+	case protocol.validation.MaximumErrors > 0 && protocol.counters.errors > protocol.validation.MaximumErrors:
+		return protocol.closeSession("4.7.0", "Too many errors")
+	}
+
+	return reply
+}
+
+// isInvalidRecipientStatus checks is RCPT reply means what mailbox does not exist or its name
+// is not allowed, other rejections (relay, policies) are not about recipient.
+func isInvalidRecipientStatus(status int) bool {
+	return status == CODE_MAILBOX_404 || status == CODE__MAILBOX_NAME_INCORRECT
+}
+
+// closeSession switches protocol to closed state, client should be disconnected after reply.
+func (protocol *Protocol) closeSession(enhancedCode string, reason string) *Reply {
+	logManager().Debug(fmt.Sprintf("Closing session: %s", reason))
+	protocol.state = StateClosed
+
+	hostname := protocol.Hostname
+	if len(hostname) > 0 {
+		hostname = hostname + " "
+	}
+
+	return ReplyServiceNotAvailable(enhancedCode + " " + hostname + reason + ", closing connection")
+}
@@ -0,0 +1,92 @@
+package smtpServerProtocol
+
+import (
+	"github.com/mailhedgehog/gounit"
+	"net"
+	"testing"
+)
+
+type failingAuthScene struct{}
+
+func (scene *failingAuthScene) Start(receivedLine string, protocol *Protocol) *Reply {
+	return ReplyAuthCredentials("VXNlcm5hbWU6")
+}
+
+func (scene *failingAuthScene) ReadAndWriteReply(receivedLine string) *Reply {
+	return ReplyAuthFailed("")
+}
+
+func (scene *failingAuthScene) Finish() {}
+
+func TestMaximumCommands(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", nil, &Validation{MaximumCommands: 2})
+
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("HELO foo").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("RSET").Status)
+
+	reply := protocol.HandleReceivedLine("RSET")
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_NOT_AVAILABLE, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("4.7.0 mx.example.com Too many commands, closing connection", reply.lines[0])
+	(*gounit.T)(t).AssertEqualsString(string(StateClosed), string(protocol.state))
+
+	reply = protocol.HandleReceivedLine("QUIT")
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_NOT_AVAILABLE, reply.Status)
+}
+
+func TestMaximumErrors(t *testing.T) {
+	protocol := CreateProtocol("", nil, &Validation{MaximumErrors: 3})
+
+	(*gounit.T)(t).AssertEqualsInt(CODE_COMMAND_SYNTAX_ERROR, protocol.HandleReceivedLine("FOO").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_MAILBOX_404, protocol.HandleReceivedLine("MAIL foo").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_COMMAND_SYNTAX_ERROR, protocol.HandleReceivedLine("BAR").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_NOT_AVAILABLE, protocol.HandleReceivedLine("BAZ").Status)
+}
+
+func TestMaximumTransactions(t *testing.T) {
+	protocol := CreateProtocol("", nil, &Validation{MaximumTransactions: 1})
+
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("MAIL FROM:<foo@bar.com>").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("RSET").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_NOT_AVAILABLE, protocol.HandleReceivedLine("MAIL FROM:<foo@bar.com>").Status)
+}
+
+func TestMaximumInvalidRecipients(t *testing.T) {
+	protocol := CreateProtocol("", nil, &Validation{MaximumInvalidRecipients: 2})
+
+	(*gounit.T)(t).AssertEqualsInt(CODE_MAILBOX_404, protocol.HandleReceivedLine("RCPT foo").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("RCPT TO:<foo@bar.com>").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_MAILBOX_404, protocol.HandleReceivedLine("RCPT bar").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_NOT_AVAILABLE, protocol.HandleReceivedLine("RCPT baz").Status)
+}
+
+func TestGreylistedRecipientsAreNotInvalid(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("192.0.2.1")},
+		&Validation{MaximumInvalidRecipients: 1, MaximumErrors: 1})
+	protocol.AddPolicy(CreateGreylistPolicy(CreateMemoryGreylistStore()))
+
+	protocol.HandleReceivedLine("EHLO client.example.org")
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("MAIL FROM:<joe@example.org>").Status)
+	for _, recipient := range []string{"admin", "sales", "support"} {
+		(*gounit.T)(t).AssertEqualsInt(CODE_LOCAL_ERROR, protocol.HandleReceivedLine("RCPT TO:<"+recipient+"@example.com>").Status)
+	}
+	(*gounit.T)(t).AssertEqualsInt(CODE_MAILBOX_404, protocol.HandleReceivedLine("RCPT foo").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_NOT_AVAILABLE, protocol.HandleReceivedLine("RCPT bar").Status)
+}
+
+func TestMaximumAuthFailures(t *testing.T) {
+	protocol := CreateProtocol("", nil, &Validation{MaximumAuthFailures: 2})
+	protocol.SetAuthMechanisms([]string{"LOGIN"})
+	protocol.CreateCustomSceneUsing(func(sceneName string) Scene {
+		return &failingAuthScene{}
+	})
+
+	protocol.HandleReceivedLine("EHLO foo")
+	// Commands refused while waiting for authentication are not authentication failures.
+	for i := 0; i < 3; i++ {
+		(*gounit.T)(t).AssertEqualsInt(CODE_AUTH_FAILED, protocol.HandleReceivedLine("MAIL FROM:<foo@bar.com>").Status)
+	}
+	(*gounit.T)(t).AssertEqualsInt(CODE_AUTH_CREDENTIALS, protocol.HandleReceivedLine("AUTH LOGIN").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_AUTH_FAILED, protocol.HandleReceivedLine("Zm9v").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_AUTH_FAILED, protocol.HandleReceivedLine("Zm9v").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_NOT_AVAILABLE, protocol.HandleReceivedLine("Zm9v").Status)
+}
@@ -0,0 +1,224 @@
+package smtpServerProtocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// spamdProtocol is version of spamc protocol, 1.5 supports User header and SYMBOLS command.
+const spamdProtocol = "SPAMC/1.5"
+
+// spamdDefaultTimeout limits whole spamd request, scanning of large messages can take time.
+const spamdDefaultTimeout = 60 * time.Second
+
+// SpamResult is result of message scoring by spamd.
+type SpamResult struct {
+	// Checked is false when message was not scored, for example spamd was unavailable.
+	Checked bool
+	// Spam is true when score reached threshold.
+	Spam      bool
+	Score     float64
+	Threshold float64
+	// Symbols contains names of matched rules, for example "BAYES_99".
+	Symbols []string
+}
+
+// SpamdPolicy sends received message to SpamAssassin spamd (or compatible, for example rspamd) and stores
+// result in Session.SpamResult. Optionally adds X-Spam-* headers or rejects spam.
+type SpamdPolicy struct {
+	// Network is "tcp" or "unix".
+	Network string
+	Address string
+	// User is passed to spamd to select user preferences, empty means spamd default user.
+	User string
+	// Timeout limits whole request.
+	Timeout time.Duration
+	// AddHeaders adds X-Spam-Flag, X-Spam-Score and X-Spam-Status headers to message.
+	AddHeaders bool
+	// Reject rejects message when score reached RejectScore, or spamd threshold when RejectScore is zero.
+	Reject      bool
+	RejectScore float64
+	// FailOpen accepts messages when spamd is unavailable, by default they are temporarily rejected.
+	FailOpen bool
+}
+
+// CreateSpamdPolicy creates policy what adds X-Spam-* headers, for example ("tcp", "127.0.0.1:783").
+func CreateSpamdPolicy(network string, address string) *SpamdPolicy {
+	return &SpamdPolicy{
+		Network:    network,
+		Address:    address,
+		Timeout:    spamdDefaultTimeout,
+		AddHeaders: true,
+	}
+}
+
+func (policy *SpamdPolicy) CheckData(protocol *Protocol, origin string) *Reply {
+	session := protocol.Session()
+	session.SpamResult = SpamResult{}
+
+	result, err := policy.Check(origin + CommandEndSymbol)
+	if err != nil {
+		logManager().Error(fmt.Sprintf("Spamd %s %s failed: %s", policy.Network, policy.Address, err.Error()))
+		if policy.FailOpen {
+			return nil
+		}
+		return ReplyLocalError("4.7.1 Service unavailable - try again later")
+	}
+	session.SpamResult = result
+
+	if policy.AddHeaders {
+		flag := "NO"
+		if result.Spam {
+			flag = "YES"
+		}
+		protocol.AddHeader("X-Spam-Flag", flag)
+		protocol.AddHeader("X-Spam-Score", formatSpamScore(result.Score))
+		protocol.AddHeader("X-Spam-Status", result.status())
+	}
+
+	if policy.Reject {
+		threshold := policy.RejectScore
+		if threshold == 0 {
+			threshold = result.Threshold
+		}
+		if result.Score >= threshold {
+			return ReplyMailbox404("5.7.1 Message rejected as spam")
+		}
+	}
+
+	return nil
+}
+
+// Check sends message to spamd using SYMBOLS command and parses score and matched rules.
+func (policy *SpamdPolicy) Check(message string) (SpamResult, error) {
+	timeout := policy.Timeout
+	if timeout <= 0 {
+		timeout = spamdDefaultTimeout
+	}
+
+	conn, err := net.DialTimeout(policy.Network, policy.Address, timeout)
+	if err != nil {
+		return SpamResult{}, err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return SpamResult{}, err
+	}
+
+	request := "SYMBOLS " + spamdProtocol + CommandEndSymbol +
+		"Content-length: " + strconv.Itoa(len(message)) + CommandEndSymbol
+	if len(policy.User) > 0 {
+		request += "User: " + policy.User + CommandEndSymbol
+	}
+	if _, err = io.WriteString(conn, request+CommandEndSymbol); err != nil {
+		return SpamResult{}, err
+	}
+	if _, err = io.WriteString(conn, message); err != nil {
+		return SpamResult{}, err
+	}
+
+	return parseSpamdResponse(bufio.NewReader(conn))
+}
+
+// parseSpamdResponse parses reply to SYMBOLS command, for example:
+//
+//	SPAMD/1.1 0 EX_OK
+//	Content-length: 17
+//	Spam: True ; 15.0 / 5.0
+//
+//	BAYES_99,GTUBE
+func parseSpamdResponse(reader *bufio.Reader) (SpamResult, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return SpamResult{}, err
+	}
+	status := strings.Fields(line)
+	if len(status) < 3 || !strings.HasPrefix(status[0], "SPAMD/") {
+		return SpamResult{}, errors.New("malformed spamd response")
+	}
+	if status[1] != "0" {
+		return SpamResult{}, fmt.Errorf("spamd error %s", strings.Join(status[1:], " "))
+	}
+
+	result := SpamResult{}
+	contentLength := -1
+	for {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return SpamResult{}, err
+		}
+		line = strings.TrimRight(line, CommandEndSymbol)
+		if len(line) == 0 {
+			break
+		}
+
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			return SpamResult{}, errors.New("malformed spamd response header")
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(name) {
+		case "content-length":
+			if contentLength, err = strconv.Atoi(value); err != nil {
+				return SpamResult{}, errors.New("malformed spamd content length")
+			}
+		case "spam":
+			// Spam: True ; 15.0 / 5.0
+			flag, scores, _ := strings.Cut(value, ";")
+			score, threshold, _ := strings.Cut(scores, "/")
+			result.Spam = strings.EqualFold(strings.TrimSpace(flag), "true") || strings.EqualFold(strings.TrimSpace(flag), "yes")
+			if result.Score, err = strconv.ParseFloat(strings.TrimSpace(score), 64); err != nil {
+				return SpamResult{}, errors.New("malformed spamd score")
+			}
+			if result.Threshold, err = strconv.ParseFloat(strings.TrimSpace(threshold), 64); err != nil {
+				return SpamResult{}, errors.New("malformed spamd threshold")
+			}
+			result.Checked = true
+		}
+	}
+	if !result.Checked {
+		return SpamResult{}, errors.New("spamd response without score")
+	}
+
+	var body []byte
+	if contentLength >= 0 {
+		body = make([]byte, contentLength)
+		_, err = io.ReadFull(reader, body)
+	} else {
+		body, err = io.ReadAll(reader)
+	}
+	if err != nil {
+		return SpamResult{}, err
+	}
+	for _, symbol := range strings.Split(string(body), ",") {
+		if symbol = strings.TrimSpace(symbol); len(symbol) > 0 {
+			result.Symbols = append(result.Symbols, symbol)
+		}
+	}
+
+	return result, nil
+}
+
+// status formats result same way as SpamAssassin X-Spam-Status header.
+func (result SpamResult) status() string {
+	status := "No"
+	if result.Spam {
+		status = "Yes"
+	}
+	status += ", score=" + formatSpamScore(result.Score) + " required=" + formatSpamScore(result.Threshold)
+	if len(result.Symbols) > 0 {
+		status += " tests=" + strings.Join(result.Symbols, ",")
+	}
+
+	return status
+}
+
+func formatSpamScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', 1, 64)
+}
@@ -0,0 +1,157 @@
+package smtpServerProtocol
+
+import (
+	"bufio"
+	"github.com/mailhedgehog/gounit"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startStubSpamd starts spamd what scores messages containing GTUBE string as spam,
+// received requests sent to returned channel.
+func startStubSpamd(t *testing.T, response string) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	(*gounit.T)(t).AssertNotError(err)
+	t.Cleanup(func() { listener.Close() })
+
+	requests := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			request := ""
+			contentLength := 0
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					break
+				}
+				request += line
+				if strings.HasPrefix(line, "Content-length: ") {
+					contentLength, _ = strconv.Atoi(strings.TrimSpace(line[16:]))
+				}
+				if line == "\r\n" {
+					break
+				}
+			}
+			body := make([]byte, contentLength)
+			io.ReadFull(reader, body)
+			request += string(body)
+			requests <- request
+
+			reply := response
+			if len(reply) == 0 {
+				if strings.Contains(string(body), "GTUBE") {
+					reply = "SPAMD/1.1 0 EX_OK\r\nContent-length: 18\r\nSpam: True ; 1000.0 / 5.0\r\n\r\nGTUBE,MISSING_DATE"
+				} else {
+					reply = "SPAMD/1.1 0 EX_OK\r\nContent-length: 12\r\nSpam: False ; 0.3 / 5.0\r\n\r\nMISSING_DATE"
+				}
+			}
+			io.WriteString(conn, reply)
+			conn.Close()
+		}
+	}()
+
+	return listener.Addr().String(), requests
+}
+
+func TestSpamdPolicy(t *testing.T) {
+	address, requests := startStubSpamd(t, "")
+	policy := CreateSpamdPolicy("tcp", address)
+	policy.User = "qa"
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.AddPolicy(policy)
+
+	message := sendTestMessage(protocol, "HELO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>",
+		"DATA", "Subject: test", "", "body", ".")
+
+	(*gounit.T)(t).AssertEqualsString("SYMBOLS SPAMC/1.5\r\nContent-length: 23\r\nUser: qa\r\n\r\nSubject: test\r\n\r\nbody\r\n", <-requests)
+	(*gounit.T)(t).AssertEqualsString("X-Spam-Flag: NO\r\n"+
+		"X-Spam-Score: 0.3\r\n"+
+		"X-Spam-Status: No, score=0.3 required=5.0 tests=MISSING_DATE\r\n"+
+		"Subject: test\r\n\r\nbody", message.GetOrigin())
+
+	result := protocol.Session().SpamResult
+	(*gounit.T)(t).AssertTrue(result.Checked)
+	(*gounit.T)(t).AssertFalse(result.Spam)
+	(*gounit.T)(t).AssertEqualsString("MISSING_DATE", strings.Join(result.Symbols, ","))
+
+	message = sendTestMessage(protocol, "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>",
+		"DATA", "Subject: GTUBE", "", "body", ".")
+	(*gounit.T)(t).AssertTrue(strings.HasPrefix(message.GetOrigin(), "X-Spam-Flag: YES\r\n"+
+		"X-Spam-Score: 1000.0\r\n"+
+		"X-Spam-Status: Yes, score=1000.0 required=5.0 tests=GTUBE,MISSING_DATE\r\n"))
+	(*gounit.T)(t).AssertTrue(protocol.Session().SpamResult.Spam)
+}
+
+func TestSpamdPolicyReject(t *testing.T) {
+	address, _ := startStubSpamd(t, "")
+	policy := &SpamdPolicy{Network: "tcp", Address: address, Reject: true}
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.AddPolicy(policy)
+
+	message := sendTestMessage(protocol, "HELO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>",
+		"DATA", "Subject: test", "", "body", ".")
+	(*gounit.T)(t).AssertEqualsString("Subject: test\r\n\r\nbody", message.GetOrigin())
+
+	for _, line := range []string{"MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>", "DATA", "Subject: GTUBE", "", "body"} {
+		protocol.HandleReceivedLine(line)
+	}
+	reply := protocol.HandleReceivedLine(".")
+	(*gounit.T)(t).AssertEqualsInt(CODE_MAILBOX_404, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("5.7.1 Message rejected as spam", reply.lines[0])
+
+	// Custom score rejects message what spamd considers ham.
+	policy.RejectScore = 0.1
+	for _, line := range []string{"MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>", "DATA", "Subject: test", "", "body"} {
+		protocol.HandleReceivedLine(line)
+	}
+	(*gounit.T)(t).AssertEqualsInt(CODE_MAILBOX_404, protocol.HandleReceivedLine(".").Status)
+}
+
+func TestSpamdPolicyErrors(t *testing.T) {
+	address, _ := startStubSpamd(t, "SPAMD/1.0 76 Bad header line: (EOF)\r\n")
+	policy := CreateSpamdPolicy("tcp", address)
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.AddPolicy(policy)
+
+	for _, line := range []string{"HELO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>", "DATA", "Subject: test", "", "body"} {
+		protocol.HandleReceivedLine(line)
+	}
+	reply := protocol.HandleReceivedLine(".")
+	(*gounit.T)(t).AssertEqualsInt(CODE_LOCAL_ERROR, reply.Status)
+
+	policy.FailOpen = true
+	message := sendTestMessage(protocol, "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>",
+		"DATA", "Subject: test", "", "body", ".")
+	(*gounit.T)(t).AssertEqualsString("Subject: test\r\n\r\nbody", message.GetOrigin())
+	(*gounit.T)(t).AssertFalse(protocol.Session().SpamResult.Checked)
+}
+
+func TestParseSpamdResponse(t *testing.T) {
+	responses := map[string]string{
+		"SPAMD/1.1 0 EX_OK\r\nSpam: yes ; 7.5 / 5.0\r\n\r\nA, B\r\n": "",
+		"SPAMD/1.1 0 EX_OK\r\n\r\n":                                  "spamd response without score",
+		"SPAMD/1.1 0 EX_OK\r\nSpam: True ; high / 5.0\r\n\r\n":       "malformed spamd score",
+		"HTTP/1.1 200 OK\r\n\r\n":                                    "malformed spamd response",
+		"SPAMD/1.1 74 EX_NOHOST\r\n":                                 "spamd error 74 EX_NOHOST",
+	}
+
+	for response, expected := range responses {
+		result, err := parseSpamdResponse(bufio.NewReader(strings.NewReader(response)))
+		if len(expected) == 0 {
+			(*gounit.T)(t).AssertNotError(err)
+			(*gounit.T)(t).AssertTrue(result.Spam)
+			(*gounit.T)(t).AssertEqualsString("A,B", strings.Join(result.Symbols, ","))
+			continue
+		}
+		(*gounit.T)(t).ExpectError(err)
+		(*gounit.T)(t).AssertEqualsString(expected, err.Error())
+	}
+}
@@ -0,0 +1,618 @@
+package smtpServerProtocol
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/mailhedgehog/smtpMessage"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SpfResult represents result of SPF check described in rfc7208 section 2.6.
+type SpfResult string
+
+const (
+	SpfNone      = SpfResult("none")
+	SpfNeutral   = SpfResult("neutral")
+	SpfPass      = SpfResult("pass")
+	SpfFail      = SpfResult("fail")
+	SpfSoftFail  = SpfResult("softfail")
+	SpfTempError = SpfResult("temperror")
+	SpfPermError = SpfResult("permerror")
+)
+
+// Processing limits described in rfc7208 section 4.6.4.
+const (
+	spfMaximumDnsLookups   = 10
+	spfMaximumVoidLookups  = 2
+	spfMaximumMxRecords    = 10
+	spfMaximumPtrRecords   = 10
+	spfMaximumDomainLength = 253
+)
+
+var spfModifierRegexp = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9\-_.]*)=(.*)$`)
+var spfCidrRegexp = regexp.MustCompile(`^(.*?)(/\d+)?(//\d+)?$`)
+
+// spfError stops evaluation with given result.
+type spfError struct {
+	result  SpfResult
+	message string
+}
+
+func (err *spfError) Error() string {
+	return string(err.result) + ": " + err.message
+}
+
+// spfTerm is parsed mechanism or modifier of SPF record.
+type spfTerm struct {
+	qualifier byte
+	name      string
+	value     string
+}
+
+// spfEvaluation contains state of one check_host() evaluation, shared by included records.
+type spfEvaluation struct {
+	resolver    Resolver
+	ctx         context.Context
+	ip          net.IP
+	sender      string
+	helo        string
+	dnsLookups  int
+	voidLookups int
+}
+
+// CheckSpf evaluates SPF policy of sender domain for client ip (rfc7208). Empty sender means
+// null reverse-path, in this case HELO identity is checked.
+func CheckSpf(resolver Resolver, ip net.IP, sender string, helo string) SpfResult {
+	if len(sender) == 0 {
+		sender = "postmaster@" + helo
+	} else if !strings.Contains(sender, "@") {
+		sender = "postmaster@" + sender
+	}
+	domain := normalizeDnsName(sender[strings.LastIndex(sender, "@")+1:])
+	if !isValidSpfDomain(domain) {
+		return SpfNone
+	}
+
+	ctx, cancel := lookupContext()
+	defer cancel()
+
+	evaluation := &spfEvaluation{
+		resolver: resolver,
+		ctx:      ctx,
+		ip:       ip,
+		sender:   sender,
+		helo:     helo,
+	}
+
+	result, err := evaluation.checkHost(domain)
+	if err != nil {
+		logManager().Debug(fmt.Sprintf("SPF check of %s: %s", domain, err.Error()))
+	}
+
+	return result
+}
+
+func (evaluation *spfEvaluation) checkHost(domain string) (SpfResult, error) {
+	record, err := evaluation.lookupRecord(domain)
+	if err != nil {
+		return spfErrorResult(err)
+	}
+	if len(record) == 0 {
+		return SpfNone, nil
+	}
+
+	terms, err := parseSpfRecord(record)
+	if err != nil {
+		return spfErrorResult(err)
+	}
+
+	redirect := ""
+	for _, term := range terms {
+		if term.qualifier == 0 {
+			if term.name == "redirect" {
+				redirect = term.value
+			}
+			continue
+		}
+
+		match, err := evaluation.matchMechanism(term, domain)
+		if err != nil {
+			return spfErrorResult(err)
+		}
+		if match {
+			return spfQualifierResult(term.qualifier), nil
+		}
+	}
+
+	if len(redirect) == 0 {
+		return SpfNeutral, nil
+	}
+
+	if err = evaluation.countDnsLookup(); err != nil {
+		return spfErrorResult(err)
+	}
+	target, err := evaluation.expand(redirect, domain)
+	if err != nil {
+		return spfErrorResult(err)
+	}
+	result, err := evaluation.checkHost(target)
+	if result == SpfNone {
+		return SpfPermError, &spfError{SpfPermError, "redirect target has no SPF record"}
+	}
+
+	return result, err
+}
+
+// lookupRecord returns SPF record of domain or empty string when record not exists.
+func (evaluation *spfEvaluation) lookupRecord(domain string) (string, error) {
+	txts, err := evaluation.resolver.LookupTXT(evaluation.ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", &spfError{SpfTempError, err.Error()}
+	}
+
+	var records []string
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+	if len(records) > 1 {
+		return "", &spfError{SpfPermError, "multiple SPF records for " + domain}
+	}
+	if len(records) == 0 {
+		return "", nil
+	}
+
+	return records[0], nil
+}
+
+// parseSpfRecord validates whole record before evaluation, as syntax error results permerror.
+func parseSpfRecord(record string) ([]spfTerm, error) {
+	var terms []spfTerm
+	hasRedirect := false
+
+	for _, field := range strings.Fields(record)[1:] {
+		if match := spfModifierRegexp.FindStringSubmatch(field); match != nil {
+			name := strings.ToLower(match[1])
+			if name == "redirect" || name == "exp" {
+				if name == "redirect" && hasRedirect {
+					return nil, &spfError{SpfPermError, "duplicate redirect modifier"}
+				}
+				hasRedirect = hasRedirect || name == "redirect"
+				if len(match[2]) == 0 {
+					return nil, &spfError{SpfPermError, "empty " + name + " modifier"}
+				}
+			}
+			terms = append(terms, spfTerm{name: name, value: match[2]})
+			continue
+		}
+
+		term := spfTerm{qualifier: '+'}
+		if strings.ContainsAny(field[:1], "+-~?") {
+			term.qualifier = field[0]
+			field = field[1:]
+		}
+		name, value := field, ""
+		if index := strings.IndexAny(field, ":/"); index >= 0 {
+			name, value = field[:index], field[index:]
+		}
+		term.name = strings.ToLower(name)
+		term.value = strings.TrimPrefix(value, ":")
+
+		switch term.name {
+		case "all":
+			if len(value) > 0 {
+				return nil, &spfError{SpfPermError, "invalid mechanism " + field}
+			}
+		case "include", "exists", "ip4", "ip6":
+			if !strings.HasPrefix(value, ":") || len(term.value) == 0 {
+				return nil, &spfError{SpfPermError, "invalid mechanism " + field}
+			}
+		case "a", "mx", "ptr":
+			if strings.HasPrefix(value, ":") && len(term.value) == 0 {
+				return nil, &spfError{SpfPermError, "invalid mechanism " + field}
+			}
+		default:
+			return nil, &spfError{SpfPermError, "unknown mechanism " + field}
+		}
+
+		terms = append(terms, term)
+	}
+
+	return terms, nil
+}
+
+func (evaluation *spfEvaluation) matchMechanism(term spfTerm, domain string) (bool, error) {
+	switch term.name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		return evaluation.matchIp(term)
+	}
+
+	if err := evaluation.countDnsLookup(); err != nil {
+		return false, err
+	}
+
+	target, cidr4, cidr6, err := evaluation.parseDomainWithCidr(term.value, domain)
+	if err != nil {
+		return false, err
+	}
+
+	switch term.name {
+	case "include":
+		result, err := evaluation.checkHost(target)
+		switch result {
+		case SpfPass:
+			return true, nil
+		case SpfTempError:
+			return false, err
+		case SpfPermError, SpfNone:
+			return false, &spfError{SpfPermError, "include of " + target + " returns " + string(result)}
+		}
+		return false, nil
+	case "a":
+		return evaluation.matchHost(target, cidr4, cidr6)
+	case "mx":
+		mxs, err := evaluation.resolver.LookupMX(evaluation.ctx, target)
+		if err = evaluation.checkLookup(err, len(mxs)); err != nil {
+			return false, err
+		}
+		if len(mxs) > spfMaximumMxRecords {
+			return false, &spfError{SpfPermError, "too many MX records for " + target}
+		}
+		for _, mx := range mxs {
+			match, err := evaluation.matchHost(mx.Host, cidr4, cidr6)
+			if err != nil || match {
+				return match, err
+			}
+		}
+		return false, nil
+	case "ptr":
+		return evaluation.matchPtr(target)
+	case "exists":
+		addresses, err := evaluation.resolver.LookupIPAddr(evaluation.ctx, target)
+		if err = evaluation.checkLookup(err, len(addresses)); err != nil {
+			return false, err
+		}
+		return len(addresses) > 0, nil
+	}
+
+	return false, nil
+}
+
+func (evaluation *spfEvaluation) matchIp(term spfTerm) (bool, error) {
+	network := term.value
+	if !strings.Contains(network, "/") {
+		if term.name == "ip4" {
+			network += "/32"
+		} else {
+			network += "/128"
+		}
+	}
+
+	_, ipNet, err := net.ParseCIDR(network)
+	if err != nil || (term.name == "ip4") != (ipNet.IP.To4() != nil) {
+		return false, &spfError{SpfPermError, "invalid network " + term.value}
+	}
+
+	return ipNet.Contains(evaluation.ip), nil
+}
+
+// matchHost checks is client ip one of host addresses, addresses compared using cidr of same family.
+func (evaluation *spfEvaluation) matchHost(host string, cidr4 int, cidr6 int) (bool, error) {
+	addresses, err := evaluation.resolver.LookupIPAddr(evaluation.ctx, host)
+	if err = evaluation.checkLookup(err, len(addresses)); err != nil {
+		return false, err
+	}
+
+	clientIsIpv4 := evaluation.ip.To4() != nil
+	for _, address := range addresses {
+		if (address.IP.To4() != nil) != clientIsIpv4 {
+			continue
+		}
+		mask := net.CIDRMask(cidr6, 128)
+		if clientIsIpv4 {
+			mask = net.CIDRMask(cidr4, 32)
+		}
+		if address.IP.Mask(mask).Equal(evaluation.ip.Mask(mask)) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (evaluation *spfEvaluation) matchPtr(target string) (bool, error) {
+	names, err := evaluation.resolver.LookupAddr(evaluation.ctx, evaluation.ip.String())
+	if err != nil {
+		// Errors of PTR lookup are ignored, mechanism just not matches
+		return false, nil
+	}
+	if len(names) > spfMaximumPtrRecords {
+		names = names[:spfMaximumPtrRecords]
+	}
+
+	for _, name := range names {
+		name = normalizeDnsName(name)
+		if name != target && !strings.HasSuffix(name, "."+target) {
+			continue
+		}
+		addresses, err := evaluation.resolver.LookupIPAddr(evaluation.ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, address := range addresses {
+			if address.IP.Equal(evaluation.ip) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// parseDomainWithCidr parses "domain-spec/cidr4//cidr6" value, domain defaults to current domain.
+func (evaluation *spfEvaluation) parseDomainWithCidr(value string, domain string) (string, int, int, error) {
+	match := spfCidrRegexp.FindStringSubmatch(value)
+	cidr4, cidr6 := 32, 128
+	var err error
+
+	if len(match[2]) > 0 {
+		cidr4, err = strconv.Atoi(match[2][1:])
+		if err != nil || cidr4 > 32 {
+			return "", 0, 0, &spfError{SpfPermError, "invalid cidr " + value}
+		}
+	}
+	if len(match[3]) > 0 {
+		cidr6, err = strconv.Atoi(match[3][2:])
+		if err != nil || cidr6 > 128 {
+			return "", 0, 0, &spfError{SpfPermError, "invalid cidr " + value}
+		}
+	}
+	if len(match[1]) == 0 {
+		return domain, cidr4, cidr6, nil
+	}
+
+	target, err := evaluation.expand(match[1], domain)
+
+	return target, cidr4, cidr6, err
+}
+
+func (evaluation *spfEvaluation) countDnsLookup() error {
+	evaluation.dnsLookups++
+	if evaluation.dnsLookups > spfMaximumDnsLookups {
+		return &spfError{SpfPermError, "too many DNS lookups"}
+	}
+	return nil
+}
+
+// checkLookup converts lookup error to evaluation error and counts void lookups.
+func (evaluation *spfEvaluation) checkLookup(err error, recordsCount int) error {
+	if err != nil && !isNotFound(err) {
+		return &spfError{SpfTempError, err.Error()}
+	}
+	if recordsCount == 0 {
+		evaluation.voidLookups++
+		if evaluation.voidLookups > spfMaximumVoidLookups {
+			return &spfError{SpfPermError, "too many void DNS lookups"}
+		}
+	}
+	return nil
+}
+
+// expand applies macros described in rfc7208 section 7 to domain-spec.
+func (evaluation *spfEvaluation) expand(spec string, domain string) (string, error) {
+	result := ""
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			result += string(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", &spfError{SpfPermError, "invalid macro in " + spec}
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			result += "%"
+		case '_':
+			result += " "
+		case '-':
+			result += "%20"
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end < 2 {
+				return "", &spfError{SpfPermError, "invalid macro in " + spec}
+			}
+			value, err := evaluation.expandMacro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", err
+			}
+			result += value
+			i += end
+		default:
+			return "", &spfError{SpfPermError, "invalid macro in " + spec}
+		}
+	}
+
+	result = normalizeDnsName(result)
+	for len(result) > spfMaximumDomainLength && strings.Contains(result, ".") {
+		result = result[strings.Index(result, ".")+1:]
+	}
+
+	return result, nil
+}
+
+func (evaluation *spfEvaluation) expandMacro(macro string, domain string) (string, error) {
+	letter := macro[0]
+	local := evaluation.sender[:strings.LastIndex(evaluation.sender, "@")]
+
+	var value string
+	switch letter | 0x20 {
+	case 's':
+		value = evaluation.sender
+	case 'l':
+		value = local
+	case 'o':
+		value = evaluation.sender[strings.LastIndex(evaluation.sender, "@")+1:]
+	case 'd':
+		value = domain
+	case 'i':
+		value = spfIpMacro(evaluation.ip)
+	case 'p':
+		value = "unknown"
+	case 'v':
+		value = "ip6"
+		if evaluation.ip.To4() != nil {
+			value = "in-addr"
+		}
+	case 'h':
+		value = evaluation.helo
+	default:
+		return "", &spfError{SpfPermError, "unknown macro letter " + string(letter)}
+	}
+
+	transformers := macro[1:]
+	digits := ""
+	for len(transformers) > 0 && transformers[0] >= '0' && transformers[0] <= '9' {
+		digits += transformers[:1]
+		transformers = transformers[1:]
+	}
+	reverse := false
+	if len(transformers) > 0 && (transformers[0]|0x20) == 'r' {
+		reverse = true
+		transformers = transformers[1:]
+	}
+	delimiters := "."
+	if len(transformers) > 0 {
+		if strings.Trim(transformers, ".-+,/_=") != "" {
+			return "", &spfError{SpfPermError, "invalid macro delimiter " + transformers}
+		}
+		delimiters = transformers
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if len(digits) > 0 {
+		count, err := strconv.Atoi(digits)
+		if err != nil || count == 0 {
+			return "", &spfError{SpfPermError, "invalid macro digits " + digits}
+		}
+		if count < len(parts) {
+			parts = parts[len(parts)-count:]
+		}
+	}
+	value = strings.Join(parts, ".")
+
+	if letter >= 'A' && letter <= 'Z' {
+		value = strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+	}
+
+	return value, nil
+}
+
+// spfIpMacro formats ip for "i" macro, IPv6 written as dot separated nibbles.
+func spfIpMacro(ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4.String()
+	}
+
+	nibbles := hex.EncodeToString(ip.To16())
+	return strings.Join(strings.Split(nibbles, ""), ".")
+}
+
+func spfQualifierResult(qualifier byte) SpfResult {
+	switch qualifier {
+	case '-':
+		return SpfFail
+	case '~':
+		return SpfSoftFail
+	case '?':
+		return SpfNeutral
+	default:
+		return SpfPass
+	}
+}
+
+func spfErrorResult(err error) (SpfResult, error) {
+	if evaluationError, ok := err.(*spfError); ok {
+		return evaluationError.result, err
+	}
+	return SpfTempError, err
+}
+
+func isValidSpfDomain(domain string) bool {
+	if strings.HasPrefix(domain, "[") || strings.HasSuffix(domain, "]") || net.ParseIP(domain) != nil {
+		return false
+	}
+	// Top level label is never numeric (rfc3696 section 2), so name like 192.0.2.1 is not domain.
+	if _, err := strconv.Atoi(domain[strings.LastIndex(domain, ".")+1:]); err == nil {
+		return false
+	}
+
+	return len(domain) > 0 && len(domain) <= spfMaximumDomainLength && strings.Contains(domain, ".") &&
+		!strings.HasPrefix(domain, ".") && !strings.Contains(domain, "..")
+}
+
+// SpfPolicy checks SPF of MAIL FROM domain, or HELO identity for null sender,
+// result stored in Session.SpfResult.
+type SpfPolicy struct {
+	Resolver Resolver
+	// RejectFail rejects sender when SPF check result is "fail".
+	RejectFail bool
+}
+
+// CreateSpfPolicy creates policy what uses DefaultResolver.
+func CreateSpfPolicy(rejectFail bool) *SpfPolicy {
+	return &SpfPolicy{
+		Resolver:   DefaultResolver,
+		RejectFail: rejectFail,
+	}
+}
+
+func (policy *SpfPolicy) CheckMail(protocol *Protocol, from *smtpMessage.MessagePath) *Reply {
+	policy.check(protocol, from)
+
+	session := protocol.Session()
+	if policy.RejectFail && session.SpfResult == SpfFail {
+		return ReplyMailbox404(fmt.Sprintf("5.7.23 SPF validation failed for %s", session.SpfDomain))
+	}
+
+	return nil
+}
+
+// check stores SPF result of transaction sender in session and Authentication-Results header.
+func (policy *SpfPolicy) check(protocol *Protocol, from *smtpMessage.MessagePath) {
+	session := protocol.Session()
+	sender := ""
+	session.SpfScope = SpfScopeHelo
+	session.SpfDomain = protocol.message.Helo
+	if from != nil {
+		sender = from.Address()
+		session.SpfScope = SpfScopeMailFrom
+		session.SpfDomain = from.Domain
+	}
+
+	session.SpfResult = SpfNone
+	if protocol.Ip != nil {
+		session.SpfResult = CheckSpf(policy.Resolver, protocol.Ip.IP, sender, protocol.message.Helo)
+	}
+
+	protocol.AddAuthenticationResult(fmt.Sprintf("spf=%s smtp.%s=%s", session.SpfResult, session.SpfScope, session.SpfDomain))
+}
@@ -0,0 +1,146 @@
+package smtpServerProtocol
+
+import (
+	"fmt"
+	"github.com/mailhedgehog/gounit"
+	"net"
+	"testing"
+)
+
+func createSpfResolver() *MemoryResolver {
+	resolver := CreateMemoryResolver()
+	resolver.TXT["pass.example.org"] = []string{"some other record", "v=spf1 ip4:192.0.2.0/24 -all"}
+	resolver.TXT["fail.example.org"] = []string{"v=spf1 -all"}
+	resolver.TXT["softfail.example.org"] = []string{"v=spf1 ~all"}
+	resolver.TXT["neutral.example.org"] = []string{"v=spf1 ip4:198.51.100.1"}
+	resolver.TXT["multiple.example.org"] = []string{"v=spf1 -all", "v=spf1 +all"}
+	resolver.TXT["syntax.example.org"] = []string{"v=spf1 foo:bar -all"}
+	resolver.TXT["temp.example.org"] = []string{"v=spf1 a:broken.example.org -all"}
+	resolver.Failing["broken.example.org"] = true
+	resolver.Failing["[192.0.2.1]"] = true
+	resolver.Failing["192.0.2.1"] = true
+
+	resolver.TXT["include.example.org"] = []string{"v=spf1 include:pass.example.org -all"}
+	resolver.TXT["redirect.example.org"] = []string{"v=spf1 redirect=pass.example.org"}
+	resolver.TXT["redirect-none.example.org"] = []string{"v=spf1 redirect=none.example.org"}
+
+	resolver.TXT["a.example.org"] = []string{"v=spf1 a/24 a:ipv6.example.org//64 -all"}
+	resolver.IP["a.example.org"] = []net.IP{net.ParseIP("192.0.2.200")}
+	resolver.IP["ipv6.example.org"] = []net.IP{net.ParseIP("2001:db8::1")}
+
+	resolver.TXT["mx.example.org"] = []string{"v=spf1 mx -all"}
+	resolver.MX["mx.example.org"] = []*net.MX{{Host: "mail.example.org.", Pref: 10}}
+	resolver.IP["mail.example.org"] = []net.IP{net.ParseIP("192.0.2.1")}
+
+	resolver.TXT["exists.example.org"] = []string{"v=spf1 exists:%{i}.%{l1r-}._spf.%{d} -all"}
+	resolver.IP["192.0.2.1.user._spf.exists.example.org"] = []net.IP{net.ParseIP("127.0.0.2")}
+
+	resolver.TXT["void.example.org"] = []string{"v=spf1 a:void1.example.org a:void2.example.org a:void3.example.org +all"}
+
+	for i := 0; i < 11; i++ {
+		resolver.TXT[fmt.Sprintf("chain%d.example.org", i)] = []string{fmt.Sprintf("v=spf1 include:chain%d.example.org -all", i+1)}
+	}
+	resolver.TXT["chain11.example.org"] = []string{"v=spf1 +all"}
+
+	return resolver
+}
+
+func TestCheckSpf(t *testing.T) {
+	resolver := createSpfResolver()
+	ip := net.ParseIP("192.0.2.1")
+
+	tests := map[string]SpfResult{
+		"user@pass.example.org":          SpfPass,
+		"user@fail.example.org":          SpfFail,
+		"user@softfail.example.org":      SpfSoftFail,
+		"user@neutral.example.org":       SpfNeutral,
+		"user@none.example.org":          SpfNone,
+		"user@multiple.example.org":      SpfPermError,
+		"user@syntax.example.org":        SpfPermError,
+		"user@temp.example.org":          SpfTempError,
+		"user@include.example.org":       SpfPass,
+		"user@redirect.example.org":      SpfPass,
+		"user@redirect-none.example.org": SpfPermError,
+		"user@a.example.org":             SpfPass,
+		"user@mx.example.org":            SpfPass,
+		"user@exists.example.org":        SpfPass,
+		"other@exists.example.org":       SpfFail,
+		"user@void.example.org":          SpfPermError,
+		"user@chain0.example.org":        SpfPermError,
+		"user@chain2.example.org":        SpfPass,
+		"user@localhost":                 SpfNone,
+	}
+
+	for sender, expected := range tests {
+		(*gounit.T)(t).AssertEqualsString(string(expected), string(CheckSpf(resolver, ip, sender, "client.example.org")))
+	}
+
+	(*gounit.T)(t).AssertEqualsString(string(SpfFail), string(CheckSpf(resolver, net.ParseIP("198.51.100.2"), "user@pass.example.org", "")))
+	(*gounit.T)(t).AssertEqualsString(string(SpfPass), string(CheckSpf(resolver, net.ParseIP("2001:db8::ffff"), "user@a.example.org", "")))
+	(*gounit.T)(t).AssertEqualsString(string(SpfPass), string(CheckSpf(resolver, ip, "", "pass.example.org")))
+	(*gounit.T)(t).AssertEqualsString(string(SpfNone), string(CheckSpf(resolver, ip, "", "[192.0.2.1]")))
+	(*gounit.T)(t).AssertEqualsString(string(SpfNone), string(CheckSpf(resolver, ip, "", "[IPv6:2001:db8::1]")))
+	(*gounit.T)(t).AssertEqualsString(string(SpfNone), string(CheckSpf(resolver, ip, "", "192.0.2.1")))
+}
+
+func TestSpfMacroExpansion(t *testing.T) {
+	evaluation := &spfEvaluation{
+		ip:     net.ParseIP("192.0.2.3"),
+		sender: "strong-bad@email.example.com",
+		helo:   "mx.example.org",
+	}
+
+	expected := map[string]string{
+		"%{s}":                  "strong-bad@email.example.com",
+		"%{o}":                  "email.example.com",
+		"%{d}":                  "email.example.com",
+		"%{d4}":                 "email.example.com",
+		"%{d2}":                 "example.com",
+		"%{d1}":                 "com",
+		"%{dr}":                 "com.example.email",
+		"%{d2r}":                "example.email",
+		"%{l}":                  "strong-bad",
+		"%{l-}":                 "strong.bad",
+		"%{lr}":                 "strong-bad",
+		"%{lr-}":                "bad.strong",
+		"%{l1r-}":               "strong",
+		"%{ir}.%{v}._spf.%{d2}": "3.2.0.192.in-addr._spf.example.com",
+		"%{h}":                  "mx.example.org",
+	}
+
+	for macro, value := range expected {
+		result, err := evaluation.expand(macro, "email.example.com")
+		(*gounit.T)(t).AssertNotError(err)
+		(*gounit.T)(t).AssertEqualsString(value, result)
+	}
+
+	evaluation.ip = net.ParseIP("2001:db8::cb01")
+	result, _ := evaluation.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com")
+	(*gounit.T)(t).AssertEqualsString("1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com", result)
+
+	_, err := evaluation.expand("%{x}", "example.com")
+	(*gounit.T)(t).ExpectError(err)
+}
+
+func TestSpfPolicy(t *testing.T) {
+	policy := &SpfPolicy{Resolver: createSpfResolver(), RejectFail: true}
+	protocol := CreateProtocol("", &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, nil)
+	protocol.AddPolicy(policy)
+
+	protocol.HandleReceivedLine("EHLO pass.example.org")
+	reply := protocol.HandleReceivedLine("MAIL FROM:<user@fail.example.org>")
+	(*gounit.T)(t).AssertEqualsInt(CODE_MAILBOX_404, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("5.7.23 SPF validation failed for fail.example.org", reply.lines[0])
+	(*gounit.T)(t).AssertNil(protocol.message.From)
+
+	reply = protocol.HandleReceivedLine("MAIL FROM:<user@softfail.example.org>")
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, reply.Status)
+	(*gounit.T)(t).AssertEqualsString(string(SpfSoftFail), string(protocol.Session().SpfResult))
+	(*gounit.T)(t).AssertEqualsString(SpfScopeMailFrom, protocol.Session().SpfScope)
+
+	reply = protocol.HandleReceivedLine("MAIL FROM:<>")
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, reply.Status)
+	(*gounit.T)(t).AssertEqualsString(string(SpfPass), string(protocol.Session().SpfResult))
+	(*gounit.T)(t).AssertEqualsString(SpfScopeHelo, protocol.Session().SpfScope)
+	(*gounit.T)(t).AssertEqualsString("pass.example.org", protocol.Session().SpfDomain)
+}
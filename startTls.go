@@ -0,0 +1,27 @@
+package smtpServerProtocol
+
+// EnableStartTls allows client to upgrade connection using STARTTLS command (rfc3207),
+// connection driver must be able to handle ActionStartTls.
+func (protocol *Protocol) EnableStartTls() {
+	protocol.startTlsEnabled = true
+}
+
+func (protocol *Protocol) STARTTLS(command *Command) *Reply {
+	if !protocol.startTlsEnabled {
+		return ReplyCommandNotImplemented()
+	}
+	if protocol.tlsState != nil {
+		return ReplyBadSequence("5.5.1 TLS already active")
+	}
+	if len(command.args) > 0 {
+		return ReplySyntaxError("5.5.4 Syntax error, no parameters allowed")
+	}
+
+	// Server must discard any knowledge obtained from the client before TLS negotiation,
+	// client greets again and EHLO reply enables waiting for authentication.
+	protocol.resetState()
+	protocol.message.Helo = ""
+	protocol.greeting = ""
+
+	return ReplyReadyToStartTls()
+}
@@ -0,0 +1,71 @@
+package smtpServerProtocol
+
+import (
+	"crypto/tls"
+	"github.com/mailhedgehog/gounit"
+	"testing"
+)
+
+func TestSTARTTLS(t *testing.T) {
+	protocol := CreateProtocol("", nil, nil)
+
+	reply := protocol.HandleReceivedLine("STARTTLS")
+	(*gounit.T)(t).AssertEqualsInt(CODE_COMMAND_NOT_IMPLEMENTED, reply.Status)
+
+	protocol.EnableStartTls()
+	reply = protocol.HandleReceivedLine("EHLO foo")
+	(*gounit.T)(t).AssertEqualsString("STARTTLS", reply.lines[len(reply.lines)-1])
+
+	reply = protocol.HandleReceivedLine("STARTTLS now")
+	(*gounit.T)(t).AssertEqualsInt(CODE_PARAMETER_SYNTAX_ERROR, reply.Status)
+
+	reply = protocol.HandleReceivedLine("STARTTLS")
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_READY, reply.Status)
+	(*gounit.T)(t).AssertTrue(reply.Action == ActionStartTls)
+	(*gounit.T)(t).AssertEqualsString("", protocol.message.Helo)
+	(*gounit.T)(t).AssertFalse(protocol.isExtended())
+}
+
+// acceptingAuthScene authenticates client with any credentials.
+type acceptingAuthScene struct {
+	protocol *Protocol
+}
+
+func (scene *acceptingAuthScene) Start(receivedLine string, protocol *Protocol) *Reply {
+	scene.protocol = protocol
+	return ReplyAuthCredentials("VXNlcm5hbWU6")
+}
+
+func (scene *acceptingAuthScene) ReadAndWriteReply(receivedLine string) *Reply {
+	scene.protocol.SetAuthenticated("joe")
+	scene.protocol.SetStateCommandsExchange()
+	return ReplyAuthOk()
+}
+
+func (scene *acceptingAuthScene) Finish() {}
+
+func TestSTARTTLSKeepsAuthRequirement(t *testing.T) {
+	protocol := CreateProtocol("", nil, nil)
+	protocol.EnableStartTls()
+	protocol.SetAuthMechanisms([]string{"LOGIN"})
+	protocol.CreateCustomSceneUsing(func(sceneName string) Scene {
+		return &acceptingAuthScene{}
+	})
+
+	protocol.HandleReceivedLine("EHLO foo")
+	reply := protocol.HandleReceivedLine("STARTTLS")
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_READY, reply.Status)
+	(*gounit.T)(t).AssertEqualsString(string(StateCommandsExchange), string(protocol.state))
+
+	protocol.SetTLS(&tls.ConnectionState{Version: tls.VersionTLS13})
+	reply = protocol.HandleReceivedLine("EHLO foo")
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("AUTH LOGIN", reply.lines[len(reply.lines)-1])
+	(*gounit.T)(t).AssertEqualsString(string(StateWaitingAuth), string(protocol.state))
+	(*gounit.T)(t).AssertEqualsInt(CODE_AUTH_FAILED, protocol.HandleReceivedLine("MAIL FROM:<joe@example.org>").Status)
+
+	(*gounit.T)(t).AssertEqualsInt(CODE_AUTH_CREDENTIALS, protocol.HandleReceivedLine("AUTH LOGIN").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_AUTHENTICATION_SUCCESS, protocol.HandleReceivedLine("am9l").Status)
+	(*gounit.T)(t).AssertEqualsInt(CODE_ACTION_OK, protocol.HandleReceivedLine("MAIL FROM:<joe@example.org>").Status)
+	(*gounit.T)(t).AssertEqualsString(KeywordEsmtpSA, protocol.protocolKeyword())
+}
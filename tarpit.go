@@ -0,0 +1,75 @@
+package smtpServerProtocol
+
+import (
+	"time"
+)
+
+// TarpitCurve configures how delay grows with number of errors.
+type TarpitCurve string
+
+const (
+	// TarpitCurveLinear increases delay by Delay after each error.
+	TarpitCurveLinear = TarpitCurve("linear")
+	// TarpitCurveExponential doubles delay after each error.
+	TarpitCurveExponential = TarpitCurve("exponential")
+)
+
+// TarpitPolicy delays replies to clients what made errors in session (unknown recipients,
+// failed authentication, unrecognised commands), so dictionary attacks become slow.
+// Delay executed by connection driver, see Reply.Delay. Policy can be shared between protocols.
+type TarpitPolicy struct {
+	Curve TarpitCurve
+	// Delay is delay after first counted error.
+	Delay time.Duration
+	// MaximumDelay caps delay, 0 means tarpitDelayLimit.
+	MaximumDelay time.Duration
+	// AllowedErrors is number of errors what are not delayed, clients sometimes make mistakes.
+	AllowedErrors int
+}
+
+// tarpitDelayLimit caps delay when MaximumDelay not set, so doubled delay can't overflow.
+const tarpitDelayLimit = time.Hour
+
+// CreateTarpitPolicy creates policy what delays replies after 3 errors by 1, 2, 4... seconds up to 30 seconds.
+func CreateTarpitPolicy() *TarpitPolicy {
+	return &TarpitPolicy{
+		Curve:         TarpitCurveExponential,
+		Delay:         time.Second,
+		MaximumDelay:  30 * time.Second,
+		AllowedErrors: 3,
+	}
+}
+
+func (policy *TarpitPolicy) CheckReply(protocol *Protocol, reply *Reply) {
+	if delay := policy.delay(protocol.counters.tarpitErrors()); delay > reply.Delay {
+		reply.Delay = delay
+	}
+}
+
+// delay returns delay for session with given number of errors.
+func (policy *TarpitPolicy) delay(errors int) time.Duration {
+	errors -= policy.AllowedErrors
+	if errors <= 0 || policy.Delay <= 0 {
+		return 0
+	}
+
+	maximumDelay := policy.MaximumDelay
+	if maximumDelay <= 0 || maximumDelay > tarpitDelayLimit {
+		maximumDelay = tarpitDelayLimit
+	}
+
+	// Loop stops at limit, so delay is never doubled above tarpitDelayLimit.
+	delay := policy.Delay
+	for i := 1; i < errors && delay < maximumDelay; i++ {
+		if policy.Curve == TarpitCurveExponential {
+			delay *= 2
+		} else {
+			delay += policy.Delay
+		}
+	}
+
+	if delay > maximumDelay {
+		delay = maximumDelay
+	}
+	return delay
+}
@@ -0,0 +1,105 @@
+package smtpServerProtocol
+
+import (
+	"github.com/mailhedgehog/gounit"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTarpitDelay(t *testing.T) {
+	policy := &TarpitPolicy{Curve: TarpitCurveExponential, Delay: time.Second, MaximumDelay: 10 * time.Second, AllowedErrors: 1}
+	expected := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for errors, delay := range expected {
+		(*gounit.T)(t).AssertEqualsInt(int(delay), int(policy.delay(errors)))
+	}
+
+	policy = &TarpitPolicy{Curve: TarpitCurveLinear, Delay: time.Second}
+	expected = []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second}
+	for errors, delay := range expected {
+		(*gounit.T)(t).AssertEqualsInt(int(delay), int(policy.delay(errors)))
+	}
+	(*gounit.T)(t).AssertEqualsInt(int(tarpitDelayLimit), int(policy.delay(100000)))
+
+	// Delay without cap does not overflow for many errors.
+	policy = &TarpitPolicy{Curve: TarpitCurveExponential, Delay: time.Second}
+	for _, errors := range []int{30, 35, 70, 1000} {
+		(*gounit.T)(t).AssertEqualsInt(int(tarpitDelayLimit), int(policy.delay(errors)))
+	}
+}
+
+func TestTarpitPolicy(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.AddPolicy(&TarpitPolicy{Curve: TarpitCurveLinear, Delay: time.Second, AllowedErrors: 1})
+
+	(*gounit.T)(t).AssertEqualsInt(0, int(protocol.HandleReceivedLine("EHLO client.example.org").Delay))
+	(*gounit.T)(t).AssertEqualsInt(0, int(protocol.HandleReceivedLine("FOO").Delay))
+	(*gounit.T)(t).AssertEqualsInt(int(time.Second), int(protocol.HandleReceivedLine("BAR").Delay))
+	// Successful replies delayed too, client already made errors.
+	(*gounit.T)(t).AssertEqualsInt(int(time.Second), int(protocol.HandleReceivedLine("RSET").Delay))
+	(*gounit.T)(t).AssertEqualsInt(int(2*time.Second), int(protocol.HandleReceivedLine("RCPT foo").Delay))
+}
+
+func TestTarpitPolicyIgnoresTemporaryFailures(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, nil)
+	protocol.AddPolicy(CreateRelayPolicy("example.com"))
+	protocol.AddPolicy(CreateGreylistPolicy(CreateMemoryGreylistStore()))
+	protocol.AddPolicy(&TarpitPolicy{Curve: TarpitCurveLinear, Delay: time.Second})
+
+	protocol.HandleReceivedLine("EHLO client.example.org")
+	protocol.HandleReceivedLine("MAIL FROM:<joe@example.org>")
+	reply := protocol.HandleReceivedLine("RCPT TO:<admin@example.com>")
+	(*gounit.T)(t).AssertEqualsInt(CODE_LOCAL_ERROR, reply.Status)
+	(*gounit.T)(t).AssertEqualsInt(0, int(reply.Delay))
+	// Relay denial is policy rejection, not unknown recipient.
+	reply = protocol.HandleReceivedLine("RCPT TO:<user@example.net>")
+	(*gounit.T)(t).AssertEqualsInt(CODE_TRANSACTION_FAILED, reply.Status)
+	(*gounit.T)(t).AssertEqualsInt(0, int(reply.Delay))
+	(*gounit.T)(t).AssertEqualsInt(0, int(protocol.HandleReceivedLine("RCPT TO:<sales@example.com>").Delay))
+}
+
+func TestConnectionReplyDelay(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.AddPolicy(&TarpitPolicy{Curve: TarpitCurveLinear, Delay: 50 * time.Millisecond})
+	client, reader, done := startTestConnection(protocol)
+	defer client.Close()
+	readReplyLine(t, reader)
+
+	_, err := client.Write([]byte("FOO\r\n"))
+	(*gounit.T)(t).AssertNotError(err)
+	started := time.Now()
+	(*gounit.T)(t).AssertEqualsString("500 Unrecognised command\r\n", readReplyLine(t, reader))
+	(*gounit.T)(t).AssertTrue(time.Since(started) >= 50*time.Millisecond)
+
+	_, err = client.Write([]byte("QUIT\r\n"))
+	(*gounit.T)(t).AssertNotError(err)
+	readReplyLine(t, reader)
+	(*gounit.T)(t).AssertNotError(<-done)
+}
+
+func TestConnectionReplyDelayDoesNotBlockOthers(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.AddPolicy(&TarpitPolicy{Curve: TarpitCurveLinear, Delay: time.Minute})
+	client, reader, _ := startTestConnection(protocol)
+	defer client.Close()
+	readReplyLine(t, reader)
+
+	delayed := make(chan string, 1)
+	go func() {
+		line, _ := reader.ReadString('\n')
+		delayed <- line
+	}()
+	_, err := client.Write([]byte("FOO\r\n"))
+	(*gounit.T)(t).AssertNotError(err)
+
+	// Other session finishes while reply of delayed session is still pending.
+	other, otherReader, otherDone := startTestConnection(CreateProtocol("mx.example.com", nil, nil))
+	defer other.Close()
+	readReplyLine(t, otherReader)
+	_, err = other.Write([]byte("QUIT\r\n"))
+	(*gounit.T)(t).AssertNotError(err)
+	(*gounit.T)(t).AssertEqualsString("221 Bye\r\n", readReplyLine(t, otherReader))
+	(*gounit.T)(t).AssertNotError(<-otherDone)
+
+	(*gounit.T)(t).AssertEqualsInt(0, len(delayed))
+}
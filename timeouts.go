@@ -0,0 +1,94 @@
+package smtpServerProtocol
+
+import (
+	"time"
+)
+
+// Timeouts configures how long server waits for client on each conversation stage,
+// default values described in rfc5321 section 4.5.3.2. Zero value disables timeout.
+type Timeouts struct {
+	// Greeting limits time between greeting and first command.
+	Greeting time.Duration
+	// Mail limits time between MAIL reply and next command.
+	Mail time.Duration
+	// Rcpt limits time between RCPT reply and next command.
+	Rcpt time.Duration
+	// DataInitiation limits time between 354 reply and first data line.
+	DataInitiation time.Duration
+	// DataBlock limits time between data lines.
+	DataBlock time.Duration
+	// DataTermination limits time between 354 reply and end of data.
+	DataTermination time.Duration
+	// Idle limits time between other commands.
+	Idle time.Duration
+	// Session limits whole session lifetime.
+	Session time.Duration
+}
+
+// CreateRfcTimeouts returns timeouts recommended by rfc5321, session lifetime not limited.
+func CreateRfcTimeouts() Timeouts {
+	return Timeouts{
+		Greeting:        5 * time.Minute,
+		Mail:            5 * time.Minute,
+		Rcpt:            5 * time.Minute,
+		DataInitiation:  2 * time.Minute,
+		DataBlock:       3 * time.Minute,
+		DataTermination: 10 * time.Minute,
+		Idle:            5 * time.Minute,
+	}
+}
+
+// SetTimeouts replaces default rfc5321 timeouts.
+func (protocol *Protocol) SetTimeouts(timeouts Timeouts) {
+	protocol.timeouts = timeouts
+}
+
+// ReadDeadline returns time until what server should receive next line from client,
+// zero time means no deadline. Deadline does not move while client sends line by parts.
+func (protocol *Protocol) ReadDeadline() time.Time {
+	var deadline time.Time
+
+	if timeout := protocol.stageTimeout(); timeout > 0 {
+		deadline = protocol.lineStartedAt.Add(timeout)
+	}
+	if protocol.state == StateData && protocol.timeouts.DataTermination > 0 {
+		deadline = earliestDeadline(deadline, protocol.dataStartedAt.Add(protocol.timeouts.DataTermination))
+	}
+	if protocol.timeouts.Session > 0 {
+		deadline = earliestDeadline(deadline, protocol.startedAt.Add(protocol.timeouts.Session))
+	}
+
+	return deadline
+}
+
+// Timeout closes session and returns reply what should be sent to client when deadline exceeded.
+func (protocol *Protocol) Timeout() *Reply {
+	return protocol.closeSession("4.4.2", "Timeout exceeded")
+}
+
+func (protocol *Protocol) stageTimeout() time.Duration {
+	if protocol.state == StateData {
+		if len(protocol.tempOrigin) == 0 {
+			return protocol.timeouts.DataInitiation
+		}
+		return protocol.timeouts.DataBlock
+	}
+
+	switch protocol.lastCommand {
+	case "":
+		return protocol.timeouts.Greeting
+	case CommandMail:
+		return protocol.timeouts.Mail
+	case CommandRcpt:
+		return protocol.timeouts.Rcpt
+	default:
+		return protocol.timeouts.Idle
+	}
+}
+
+func earliestDeadline(deadline time.Time, limit time.Time) time.Time {
+	if deadline.IsZero() || limit.Before(deadline) {
+		return limit
+	}
+	return deadline
+}
@@ -0,0 +1,50 @@
+package smtpServerProtocol
+
+import (
+	"github.com/mailhedgehog/gounit"
+	"testing"
+	"time"
+)
+
+func TestReadDeadline(t *testing.T) {
+	now := fixedClock()
+	protocol := CreateProtocol("", nil, nil)
+	protocol.SetClock(func() time.Time { return now })
+
+	(*gounit.T)(t).AssertTrue(protocol.ReadDeadline().Equal(now.Add(5 * time.Minute)))
+
+	protocol.HandleReceivedLine("DATA")
+	(*gounit.T)(t).AssertTrue(protocol.ReadDeadline().Equal(now.Add(2 * time.Minute)))
+
+	protocol.HandleReceivedLine("Subject: test")
+	(*gounit.T)(t).AssertTrue(protocol.ReadDeadline().Equal(now.Add(3 * time.Minute)))
+
+	// Deadline counted from last complete line, not from current time.
+	now = now.Add(time.Minute)
+	(*gounit.T)(t).AssertTrue(protocol.ReadDeadline().Equal(fixedClock().Add(3 * time.Minute)))
+
+	now = now.Add(8 * time.Minute)
+	protocol.HandleReceivedLine("body")
+	(*gounit.T)(t).AssertTrue(protocol.ReadDeadline().Equal(fixedClock().Add(10 * time.Minute)))
+}
+
+func TestSessionDeadline(t *testing.T) {
+	now := fixedClock()
+	protocol := CreateProtocol("", nil, nil)
+	protocol.SetClock(func() time.Time { return now })
+	protocol.SetTimeouts(Timeouts{Session: time.Minute})
+
+	(*gounit.T)(t).AssertTrue(protocol.ReadDeadline().Equal(now.Add(time.Minute)))
+
+	protocol.SetTimeouts(Timeouts{})
+	(*gounit.T)(t).AssertTrue(protocol.ReadDeadline().IsZero())
+}
+
+func TestTimeout(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	reply := protocol.Timeout()
+
+	(*gounit.T)(t).AssertEqualsInt(CODE_SERVICE_NOT_AVAILABLE, reply.Status)
+	(*gounit.T)(t).AssertEqualsString("4.4.2 mx.example.com Timeout exceeded, closing connection", reply.lines[0])
+	(*gounit.T)(t).AssertEqualsString(string(StateClosed), string(protocol.state))
+}
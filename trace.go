@@ -0,0 +1,257 @@
+package smtpServerProtocol
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// List of protocol keywords used in "with" clause of Received header (rfc3848).
+const (
+	KeywordSmtp    = "SMTP"
+	KeywordEsmtp   = "ESMTP"
+	KeywordEsmtpA  = "ESMTPA"
+	KeywordEsmtpS  = "ESMTPS"
+	KeywordEsmtpSA = "ESMTPSA"
+	KeywordLmtp    = "LMTP"
+)
+
+// TraceHeaders configures trace information (rfc5321 section 4.4) what
+// protocol prepends to received message.
+type TraceHeaders struct {
+	// Received adds "Received" header describing current hop.
+	Received bool
+	// ReturnPath adds "Return-Path" header with envelope sender.
+	ReturnPath bool
+	// Keyword overrides protocol keyword in "with" clause, for example KeywordLmtp.
+	Keyword string
+}
+
+// SetTraceHeaders configures what trace headers will be added to received message.
+func (protocol *Protocol) SetTraceHeaders(traceHeaders TraceHeaders) {
+	protocol.traceHeaders = traceHeaders
+}
+
+// SetClock allows to replace clock used for timestamps and timeouts, useful for tests.
+// Should be called before conversation started, as session start time is reset.
+func (protocol *Protocol) SetClock(clock func() time.Time) {
+	protocol.now = clock
+	protocol.startedAt = clock()
+	protocol.lineStartedAt = protocol.startedAt
+}
+
+// SetTLS notifies protocol what connection is encrypted, cipher will be used in trace headers.
+func (protocol *Protocol) SetTLS(state *tls.ConnectionState) {
+	protocol.tlsState = state
+}
+
+// SetAuthenticated notifies protocol what client successfully authenticated, usually called by auth scene.
+func (protocol *Protocol) SetAuthenticated(identity string) {
+	protocol.authIdentity = identity
+}
+
+// AuthIdentity returns identity of authenticated client or empty string.
+func (protocol *Protocol) AuthIdentity() string {
+	return protocol.authIdentity
+}
+
+// protocolKeyword returns keyword what describes current conversation.
+func (protocol *Protocol) protocolKeyword() string {
+	if len(protocol.traceHeaders.Keyword) > 0 {
+		return protocol.traceHeaders.Keyword
+	}
+	if !protocol.isExtended() {
+		return KeywordSmtp
+	}
+
+	keyword := KeywordEsmtp
+	if protocol.tlsState != nil {
+		keyword += "S"
+	}
+	if len(protocol.authIdentity) > 0 {
+		if protocol.tlsState == nil {
+			return KeywordEsmtpA
+		}
+		keyword += "A"
+	}
+
+	return keyword
+}
+
+// traceHeadersBlock returns header lines what need to be prepended to message origin.
+func (protocol *Protocol) traceHeadersBlock() string {
+	block := ""
+
+	if protocol.traceHeaders.ReturnPath {
+		block += "Return-Path: " + protocol.reversePath() + CommandEndSymbol
+	}
+
+	if protocol.traceHeaders.Received {
+		block += protocol.receivedHeader()
+	}
+
+	if len(protocol.authenticationResults) > 0 {
+		block += protocol.authenticationResultsHeader()
+	}
+
+	for _, header := range protocol.addedHeaders {
+		block += header + CommandEndSymbol
+	}
+
+	return block
+}
+
+// AddAuthenticationResult adds method result, for example "dkim=pass header.d=example.org",
+// to Authentication-Results header (rfc8601) of current message.
+func (protocol *Protocol) AddAuthenticationResult(result string) {
+	protocol.authenticationResults = append(protocol.authenticationResults, result)
+}
+
+// hasAuthenticationResult returns true when result of method, for example "spf", already added.
+func (protocol *Protocol) hasAuthenticationResult(method string) bool {
+	for _, result := range protocol.authenticationResults {
+		if strings.HasPrefix(result, method+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// AddHeader adds header field to current message, value can be folded using "\r\n\t".
+func (protocol *Protocol) AddHeader(name string, value string) {
+	protocol.addedHeaders = append(protocol.addedHeaders, name+": "+value)
+}
+
+// authServId returns identifier of server used in Authentication-Results header.
+func (protocol *Protocol) authServId() string {
+	if len(protocol.Hostname) == 0 {
+		return "localhost"
+	}
+	return protocol.Hostname
+}
+
+// removeAuthenticationResults removes Authentication-Results header fields what claim to be added by
+// server with given authserv-id, so forged results are not shown as own (rfc8601 section 5).
+func removeAuthenticationResults(origin string, authServId string) string {
+	if strings.HasPrefix(origin, CommandEndSymbol) {
+		return origin
+	}
+	header, body := origin, ""
+	if index := strings.Index(origin, CommandEndSymbol+CommandEndSymbol); index >= 0 {
+		header, body = origin[:index], origin[index:]
+	}
+
+	var fields []string
+	for _, line := range strings.Split(header, CommandEndSymbol) {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += CommandEndSymbol + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+
+	var kept []string
+	for _, field := range fields {
+		parts := strings.SplitN(field, ":", 2)
+		if len(parts) == 2 && strings.EqualFold(strings.TrimRight(parts[0], " \t"), "Authentication-Results") &&
+			normalizeDnsName(authenticationResultsServId(parts[1])) == normalizeDnsName(authServId) {
+			logManager().Debug("Removed Authentication-Results header with own authserv-id")
+			continue
+		}
+		kept = append(kept, field)
+	}
+	if len(kept) == len(fields) {
+		return origin
+	}
+
+	return strings.Join(kept, CommandEndSymbol) + body
+}
+
+// authenticationResultsServId returns authserv-id from Authentication-Results header value,
+// for example "example.com" from "example.com 1; spf=pass".
+func authenticationResultsServId(value string) string {
+	value = strings.ReplaceAll(value, CommandEndSymbol, "")
+	value = regexp.MustCompile(`\([^()]*\)`).ReplaceAllString(value, " ")
+	value = strings.SplitN(value, ";", 2)[0]
+	if fields := strings.Fields(value); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
+
+func (protocol *Protocol) authenticationResultsHeader() string {
+	return "Authentication-Results: " + protocol.authServId() + ";" + CommandEndSymbol + "\t" +
+		strings.Join(protocol.authenticationResults, ";"+CommandEndSymbol+"\t") + CommandEndSymbol
+}
+
+func (protocol *Protocol) reversePath() string {
+	if protocol.message.From == nil {
+		return "<>"
+	}
+	return "<" + protocol.message.From.Address() + ">"
+}
+
+func (protocol *Protocol) receivedHeader() string {
+	from := protocol.message.Helo
+	if len(from) == 0 {
+		from = "unknown"
+	}
+
+	clientInfo := []string{}
+	if len(protocol.session.ReverseHostname) > 0 {
+		clientInfo = append(clientInfo, protocol.session.ReverseHostname)
+	}
+	if protocol.Ip != nil {
+		clientInfo = append(clientInfo, addressLiteral(protocol.Ip.IP))
+	}
+	if len(clientInfo) > 0 {
+		from += " (" + strings.Join(clientInfo, " ") + ")"
+	}
+
+	header := "Received: from " + from
+
+	by := protocol.Hostname
+	if len(by) == 0 {
+		by = "localhost"
+	}
+	header += CommandEndSymbol + "\tby " + by + " with " + protocol.protocolKeyword()
+	if protocol.tlsState != nil {
+		header += fmt.Sprintf(" (%s %s)", tlsVersionName(protocol.tlsState.Version), tls.CipherSuiteName(protocol.tlsState.CipherSuite))
+	}
+	header += " id " + string(protocol.message.ID)
+
+	// Recipient is added only for single recipient messages to not expose bcc.
+	if len(protocol.message.To) == 1 {
+		header += CommandEndSymbol + "\tfor <" + protocol.message.To[0].Address() + ">"
+	}
+
+	header += ";" + CommandEndSymbol + "\t" + protocol.now().Format(time.RFC1123Z) + CommandEndSymbol
+
+	return header
+}
+
+// addressLiteral formats ip as rfc5321 address literal, eg "[192.0.2.1]" or "[IPv6:2001:db8::1]".
+func addressLiteral(ip net.IP) string {
+	if ip.To4() != nil {
+		return "[" + ip.String() + "]"
+	}
+	return "[IPv6:" + ip.String() + "]"
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	default:
+		return "TLS"
+	}
+}
@@ -0,0 +1,126 @@
+package smtpServerProtocol
+
+import (
+	"crypto/tls"
+	"github.com/mailhedgehog/gounit"
+	"github.com/mailhedgehog/smtpMessage"
+	"net"
+	"testing"
+	"time"
+)
+
+func fixedClock() time.Time {
+	return time.Date(2024, time.January, 2, 15, 4, 5, 0, time.UTC)
+}
+
+func sendTestMessage(protocol *Protocol, lines ...string) *smtpMessage.SmtpMessage {
+	var received *smtpMessage.SmtpMessage
+	protocol.OnMessageReceived(func(message *smtpMessage.SmtpMessage) (string, error) {
+		received = message
+		return string(message.ID), nil
+	})
+	for _, line := range lines {
+		protocol.HandleReceivedLine(line)
+	}
+
+	return received
+}
+
+func TestTraceHeadersDisabledByDefault(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	message := sendTestMessage(protocol, "HELO client.example.org", "MAIL FROM:<foo@bar.com>", "RCPT TO:<baz@example.com>", "DATA", "Subject: test", "", "body", ".")
+
+	(*gounit.T)(t).AssertEqualsString("Subject: test\r\n\r\nbody", message.GetOrigin())
+}
+
+func TestTraceHeaders(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2525}, nil)
+	protocol.SetClock(fixedClock)
+	protocol.SetTraceHeaders(TraceHeaders{Received: true, ReturnPath: true})
+	protocol.message.ID = "queue-id"
+
+	message := sendTestMessage(protocol, "EHLO client.example.org", "MAIL FROM:<foo@bar.com>", "RCPT TO:<baz@example.com>", "DATA", "Subject: test", "", "body", ".")
+
+	(*gounit.T)(t).AssertEqualsString("Return-Path: <foo@bar.com>\r\n"+
+		"Received: from client.example.org ([192.0.2.1])\r\n"+
+		"\tby mx.example.com with ESMTP id queue-id\r\n"+
+		"\tfor <baz@example.com>;\r\n"+
+		"\tTue, 02 Jan 2024 15:04:05 +0000\r\n"+
+		"Subject: test\r\n\r\nbody", message.GetOrigin())
+}
+
+func TestReceivedHeaderMultipleRecipients(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", &net.TCPAddr{IP: net.ParseIP("2001:db8::1")}, nil)
+	protocol.SetClock(fixedClock)
+	protocol.SetTraceHeaders(TraceHeaders{Received: true})
+	protocol.SetTLS(&tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256})
+	protocol.SetAuthenticated("user")
+	protocol.message.ID = "queue-id"
+
+	message := sendTestMessage(protocol, "EHLO client.example.org", "MAIL FROM:<foo@bar.com>", "RCPT TO:<a@example.com>", "RCPT TO:<b@example.com>", "DATA", "Subject: test", "", "body", ".")
+
+	(*gounit.T)(t).AssertEqualsString("Received: from client.example.org ([IPv6:2001:db8::1])\r\n"+
+		"\tby mx.example.com with ESMTPSA (TLS1.3 TLS_AES_128_GCM_SHA256) id queue-id;\r\n"+
+		"\tTue, 02 Jan 2024 15:04:05 +0000\r\n"+
+		"Subject: test\r\n\r\nbody", message.GetOrigin())
+}
+
+func TestProtocolKeyword(t *testing.T) {
+	protocol := CreateProtocol("", nil, nil)
+	(*gounit.T)(t).AssertEqualsString(KeywordSmtp, protocol.protocolKeyword())
+
+	protocol.HandleReceivedLine("EHLO foo")
+	(*gounit.T)(t).AssertEqualsString(KeywordEsmtp, protocol.protocolKeyword())
+
+	protocol.SetAuthenticated("user")
+	(*gounit.T)(t).AssertEqualsString(KeywordEsmtpA, protocol.protocolKeyword())
+
+	protocol.SetTLS(&tls.ConnectionState{})
+	(*gounit.T)(t).AssertEqualsString(KeywordEsmtpSA, protocol.protocolKeyword())
+
+	protocol.SetTraceHeaders(TraceHeaders{Keyword: KeywordLmtp})
+	(*gounit.T)(t).AssertEqualsString(KeywordLmtp, protocol.protocolKeyword())
+}
+
+func TestRemoveAuthenticationResults(t *testing.T) {
+	origin := "Authentication-Results: MX.example.com.;\r\n\tdkim=pass header.d=example.org\r\n" +
+		"Subject: test\r\n" +
+		"Authentication-Results: (forged) mx.example.com 1; dmarc=pass\r\n" +
+		"authentication-results : mx.example.com;arc=pass\r\n" +
+		"Authentication-Results: relay.example.org; spf=fail\r\n" +
+		"Authentication-Results: mx.example.com.example.org; spf=fail\r\n" +
+		"\r\n" +
+		"Authentication-Results: mx.example.com; body is not header"
+
+	(*gounit.T)(t).AssertEqualsString("Subject: test\r\n"+
+		"Authentication-Results: relay.example.org; spf=fail\r\n"+
+		"Authentication-Results: mx.example.com.example.org; spf=fail\r\n"+
+		"\r\n"+
+		"Authentication-Results: mx.example.com; body is not header", removeAuthenticationResults(origin, "mx.example.com"))
+
+	origin = "Subject: test\r\n\r\nbody"
+	(*gounit.T)(t).AssertEqualsString(origin, removeAuthenticationResults(origin, "mx.example.com"))
+	origin = "\r\nAuthentication-Results: mx.example.com; spf=pass"
+	(*gounit.T)(t).AssertEqualsString(origin, removeAuthenticationResults(origin, "mx.example.com"))
+}
+
+type testAuthenticationResultPolicy struct {
+	result string
+}
+
+func (policy *testAuthenticationResultPolicy) CheckData(protocol *Protocol, origin string) *Reply {
+	protocol.AddAuthenticationResult(policy.result)
+	return nil
+}
+
+func TestForgedAuthenticationResultsRemoved(t *testing.T) {
+	protocol := CreateProtocol("mx.example.com", nil, nil)
+	protocol.AddPolicy(&testAuthenticationResultPolicy{result: "spf=none smtp.mailfrom=example.org"})
+
+	message := sendTestMessage(protocol, "EHLO client.example.org", "MAIL FROM:<joe@example.org>", "RCPT TO:<admin@example.com>", "DATA",
+		"Authentication-Results: mx.example.com; dkim=pass header.d=example.org; dmarc=pass", "Subject: test", "", "body", ".")
+
+	(*gounit.T)(t).AssertEqualsString("Authentication-Results: mx.example.com;\r\n"+
+		"\tspf=none smtp.mailfrom=example.org\r\n"+
+		"Subject: test\r\n\r\nbody", message.GetOrigin())
+}